@@ -0,0 +1,174 @@
+package main
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/charmbracelet/bubbles/list"
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// account is one configured mailbox along with the inbox list state the
+// user last left it in, so switching back restores cursor and results.
+type account struct {
+	name    string
+	cfg     accountConfig
+	backend MailBackend
+	list    list.Model
+	pager   listPager
+	loaded  bool
+
+	historyID uint64 // last History API record applied; 0 until known
+	polling   bool
+
+	addresses []string // reported by the backend, see IdentityBackend
+}
+
+// inboxQuery selects the messages shown in an account's inbox.
+const inboxQuery = "in:inbox category:primary"
+
+type (
+	inboxLoadedMsg struct {
+		account string
+		ids     []string
+		pager   listPager
+	}
+	unifiedInboxMsg struct{ items []list.Item }
+)
+
+func inboxTitle(accounts []*account, name string) string {
+	if len(accounts) < 2 {
+		return "Inbox"
+	}
+	return "Inbox · " + name
+}
+
+func (m model) currentAccount() *account {
+	return m.accounts[m.active]
+}
+
+// backend returns the mail backend for the named account, defaulting to
+// the active one for items that predate account tagging.
+func (m model) backend(name string) MailBackend {
+	return m.account(name).backend
+}
+
+// account returns the named account, defaulting to the active one.
+func (m model) account(name string) *account {
+	for _, a := range m.accounts {
+		if a.name == name {
+			return a
+		}
+	}
+	return m.currentAccount()
+}
+
+// switchAccount stores the visible list on the current account and brings
+// up the list of account i, loading its inbox on first use. A list left
+// while its rows were still streaming in is loaded again next time.
+func (m *model) switchAccount(i int) tea.Cmd {
+	if !m.unified {
+		m.stashList()
+	}
+	m.unified = false
+	m.active = i
+
+	acct := m.currentAccount()
+	m.list = acct.list
+	m.pager = acct.pager
+	m.list.SetSize(m.width, m.height-4)
+	if acct.loaded {
+		return nil
+	}
+	m.state = loading
+	return tea.Batch(m.loading.Tick, loadInbox(acct))
+}
+
+// toggleUnified switches between the active account's inbox and a merged
+// inbox of every account, newest first.
+func (m *model) toggleUnified() tea.Cmd {
+	if m.unified {
+		return m.switchAccount(m.active)
+	}
+	m.stashList()
+	m.unified = true
+	m.pager = listPager{}
+	m.list = newEmailList("Unified Inbox", nil)
+	m.list.SetSize(m.width, m.height-4)
+	m.state = loading
+	return tea.Batch(m.loading.Tick, loadUnifiedInbox(m.accounts))
+}
+
+func (m *model) stashList() {
+	acct := m.currentAccount()
+	acct.list = m.list
+	acct.pager = m.pager
+	if m.rows != nil {
+		acct.loaded = false
+		m.rows = nil
+	}
+}
+
+func fetchInboxItems(acct *account) ([]emailItem, error) {
+	msgs, err := acct.backend.ListMessages(inboxQuery, nil, "", pageSize)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, msg := range msgs.Messages {
+		ids = append(ids, msg.Id)
+	}
+	return fetchItems(acct.backend, acct.name, ids), nil
+}
+
+func loadInbox(acct *account) tea.Cmd {
+	return func() tea.Msg {
+		ids, pager, err := listPage(acct.backend, listPager{account: acct.name, query: inboxQuery})
+		if err != nil {
+			return emailLoadErrorMsg{err: err}
+		}
+		return inboxLoadedMsg{account: acct.name, ids: ids, pager: pager}
+	}
+}
+
+func loadUnifiedInbox(accounts []*account) tea.Cmd {
+	return func() tea.Msg {
+		var (
+			mu   sync.Mutex
+			wg   sync.WaitGroup
+			all  []emailItem
+			errs []error
+		)
+		for _, acct := range accounts {
+			wg.Add(1)
+			go func(acct *account) {
+				defer wg.Done()
+				// The merged list isn't paged; each account contributes
+				// its first page.
+				items, err := fetchInboxItems(acct)
+				mu.Lock()
+				defer mu.Unlock()
+				if err != nil {
+					errs = append(errs, err)
+					return
+				}
+				all = append(all, items...)
+			}(acct)
+		}
+		wg.Wait()
+
+		if len(all) == 0 && len(errs) > 0 {
+			return emailLoadErrorMsg{err: errs[0]}
+		}
+
+		sort.SliceStable(all, func(i, j int) bool {
+			return all[i].timestamp > all[j].timestamp
+		})
+		items := make([]list.Item, len(all))
+		for i, item := range all {
+			item.showAccount = true
+			items[i] = item
+		}
+		return unifiedInboxMsg{items: items}
+	}
+}
@@ -2,13 +2,23 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
-	"os/user"
+	"os/exec"
 	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
 
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
@@ -16,20 +26,23 @@ import (
 	"google.golang.org/api/option"
 )
 
-func getGmailService() (*gmail.Service, error) {
+func getGmailService(ac accountConfig) (*gmail.Service, error) {
     ctx := context.Background()
 
-    b, err := os.ReadFile("credentials.json")
+    config, err := oauthConfig(ac)
     if err != nil {
-        return nil, fmt.Errorf("unable to read client secret file: %v", err)
+        return nil, err
+    }
+
+    store, err := openTokenStore(ac)
+    if err != nil {
+        return nil, err
+    }
+    if err := migrateLegacyToken(store, ac.legacyToken); err != nil {
+        log.Printf("Warning: %v", err)
     }
-    
-	config, err := google.ConfigFromJSON(b, gmail.MailGoogleComScope)
-	if err != nil {
-    return nil, fmt.Errorf("unable to parse client secret file: %v", err)
-}
 
-    client, err := getClient(config)
+    client, err := getClient(ac.Name, config, store)
     if err != nil {
         return nil, fmt.Errorf("unable to get client: %v", err)
     }
@@ -42,19 +55,148 @@ func getGmailService() (*gmail.Service, error) {
     return srv, nil
 }
 
-func getClient(config *oauth2.Config) (*http.Client, error) {
-	tokFile := tokenFilePath()
-	tok, err := tokenFromFile(tokFile)
+func oauthConfig(ac accountConfig) (*oauth2.Config, error) {
+	b, err := os.ReadFile(ac.Credentials)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read client secret file: %v", err)
+	}
+	config, err := google.ConfigFromJSON(b, gmail.MailGoogleComScope)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse client secret file: %v", err)
+	}
+	return config, nil
+}
+
+func getClient(account string, config *oauth2.Config, store tokenStore) (*http.Client, error) {
+	tok, err := store.Load()
+	if err != nil && !errors.Is(err, errNoToken) {
+		return nil, err
+	}
+	if err != nil {
+		tok, err = getTokenFromWeb(config)
+		if err != nil {
+			return nil, err
+		}
+		if err := store.Save(tok); err != nil {
+			log.Printf("Warning: couldn't cache oauth token: %v", err)
+		}
+	}
+
+	ts := newPersistingTokenSource(account, config, store, tok)
+	// Fetch a token up front so an expired or revoked refresh token sends
+	// the user through the login flow before the TUI starts. Without a
+	// network, or while the token endpoint fails with a 5xx, the refresh
+	// can't happen yet; start anyway so cached mail can be read, and
+	// retry on the first request.
+	if _, err := ts.Token(); err != nil {
+		var reauth *reauthError
+		var re *oauth2.RetrieveError
+		switch {
+		case errors.As(err, &reauth):
+			log.Printf("Refresh token rejected, signing in again: %v", reauth.err)
+			tok, err := getTokenFromWeb(config)
+			if err != nil {
+				return nil, err
+			}
+			if err := store.Save(tok); err != nil {
+				log.Printf("Warning: couldn't cache oauth token: %v", err)
+			}
+			ts = newPersistingTokenSource(account, config, store, tok)
+		case errors.As(err, &re) && (re.Response == nil || re.Response.StatusCode < 500):
+			return nil, err
+		default:
+			log.Printf("Warning: couldn't refresh oauth token, starting offline: %v", err)
+		}
+	}
+	return oauth2.NewClient(context.Background(), ts), nil
+}
+
+// reauthError means Google rejected the account's refresh token. Once the
+// TUI is running, signing in again is left to the login command, which
+// owns the terminal and the browser.
+type reauthError struct {
+	account string
+	err     error
+}
+
+func (e *reauthError) Error() string {
+	return fmt.Sprintf("Signed out of %s; run `gmail-tui --account %s login`", e.account, e.account)
+}
+
+func (e *reauthError) Unwrap() error { return e.err }
+
+// persistingTokenSource writes every refreshed token back to its store.
+// When Google rejects the refresh token it picks up a token that login
+// saved since, or fails with a reauthError.
+type persistingTokenSource struct {
+	mu      sync.Mutex
+	account string
+	config  *oauth2.Config
+	store   tokenStore
+	base    oauth2.TokenSource
+	last    *oauth2.Token
+}
+
+func newPersistingTokenSource(account string, config *oauth2.Config, store tokenStore, tok *oauth2.Token) *persistingTokenSource {
+	return &persistingTokenSource{
+		account: account,
+		config:  config,
+		store:   store,
+		base:    config.TokenSource(context.Background(), tok),
+		last:    tok,
+	}
+}
+
+func (s *persistingTokenSource) Token() (*oauth2.Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tok, err := s.base.Token()
+	if isInvalidGrant(err) {
+		if saved, lerr := s.store.Load(); lerr == nil && saved.RefreshToken != s.last.RefreshToken {
+			s.base = s.config.TokenSource(context.Background(), saved)
+			s.last = saved
+			tok, err = s.base.Token()
+		}
+	}
+	if isInvalidGrant(err) {
+		return nil, &reauthError{account: s.account, err: err}
+	}
 	if err != nil {
-		tok = getTokenFromWeb(config)
-		saveToken(tokFile, tok)
+		return nil, err
+	}
+
+	if s.last == nil || tok.AccessToken != s.last.AccessToken || tok.RefreshToken != s.last.RefreshToken {
+		if err := s.store.Save(tok); err != nil {
+			warnToken(fmt.Sprintf("Couldn't save the refreshed token of %s: %v", s.account, err))
+		}
+		s.last = tok
 	}
-	return config.Client(context.Background(), tok), nil
+	return tok, nil
+}
+
+// tokenWarnings carries token sources' warnings to the status log, as
+// refreshes happen under the TUI, where printing would draw over it.
+var tokenWarnings = make(chan string, 16)
+
+// warnToken queues text for the status log, dropping it if the log is
+// this far behind.
+func warnToken(text string) {
+	select {
+	case tokenWarnings <- text:
+	default:
+	}
+}
+
+// isInvalidGrant reports whether err means the refresh token is no longer
+// valid, either because it expired or because access was revoked.
+func isInvalidGrant(err error) bool {
+	var re *oauth2.RetrieveError
+	return errors.As(err, &re) && re.ErrorCode == "invalid_grant"
 }
 
 func tokenFilePath() string {
-	usr, _ := user.Current()
-	return filepath.Join(usr.HomeDir, ".gmail-tui-token.json")
+	return filepath.Join(homeDir(), ".gmail-tui-token.json")
 }
 
 func tokenFromFile(file string) (*oauth2.Token, error) {
@@ -69,31 +211,228 @@ func tokenFromFile(file string) (*oauth2.Token, error) {
 	return tok, err
 }
 
-func getTokenFromWeb(config *oauth2.Config) *oauth2.Token {
-	authURL := config.AuthCodeURL("state-token", oauth2.AccessTypeOffline)
-	fmt.Printf("Go to the following URL in your browser then paste the authorization code:\n%v\n", authURL)
+// authTimeout bounds how long getTokenFromWeb waits for the browser to
+// come back with an authorization code.
+const authTimeout = 5 * time.Minute
+
+// getTokenFromWeb runs the installed-app OAuth flow. It listens on a random
+// loopback port, sends the user to the consent page and waits for Google to
+// redirect back with the authorization code, which is exchanged using PKCE.
+func getTokenFromWeb(config *oauth2.Config) (*oauth2.Token, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("unable to start local redirect listener: %v", err)
+	}
+
+	cfg := *config
+	cfg.RedirectURL = fmt.Sprintf("http://%s/", ln.Addr().String())
+
+	state, err := randomState()
+	if err != nil {
+		ln.Close()
+		return nil, fmt.Errorf("unable to generate state: %v", err)
+	}
+	verifier := oauth2.GenerateVerifier()
+
+	codeCh := make(chan string, 1)
+	errCh := make(chan error, 1)
+	srv := &http.Server{
+		ReadHeaderTimeout: 10 * time.Second,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/" {
+				http.NotFound(w, r)
+				return
+			}
+			q := r.URL.Query()
+			if q.Get("state") != state {
+				// Not our redirect; keep waiting for the real one.
+				http.Error(w, "Invalid state parameter.", http.StatusBadRequest)
+				return
+			}
+			if e := q.Get("error"); e != "" {
+				http.Error(w, "Authorization failed: "+e, http.StatusBadRequest)
+				select {
+				case errCh <- fmt.Errorf("authorization denied: %s", e):
+				default:
+				}
+				return
+			}
+			code := q.Get("code")
+			if code == "" {
+				http.Error(w, "Missing authorization code.", http.StatusBadRequest)
+				return
+			}
+			fmt.Fprintln(w, "gmail-tui is authorized. You can close this window and return to the terminal.")
+			select {
+			case codeCh <- code:
+			default:
+			}
+		}),
+	}
+	go srv.Serve(ln)
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		srv.Shutdown(ctx)
+	}()
+
+	authURL := cfg.AuthCodeURL(state, oauth2.AccessTypeOffline, oauth2.S256ChallengeOption(verifier))
+	fmt.Printf("Opening your browser to authorize gmail-tui. If it doesn't open, visit:\n%v\n", authURL)
+	if err := openAuthURL(authURL); err != nil {
+		log.Printf("Couldn't open browser: %v", err)
+	}
+
+	var code string
+	select {
+	case code = <-codeCh:
+	case err := <-errCh:
+		return nil, err
+	case <-time.After(authTimeout):
+		return nil, fmt.Errorf("timed out waiting for authorization")
+	}
+
+	tok, err := cfg.Exchange(context.Background(), code, oauth2.VerifierOption(verifier))
+	if err != nil {
+		return nil, fmt.Errorf("unable to retrieve token from web: %v", err)
+	}
+	return tok, nil
+}
+
+func randomState() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// openAuthURL sends the user to the consent page; tests replace it with a
+// client that follows the redirect itself.
+var openAuthURL = openBrowser
 
-	var authCode string
-	fmt.Print("Enter code: ")
-	if _, err := fmt.Scan(&authCode); err != nil {
-		log.Fatalf("Unable to read authorization code: %v", err)
+func openBrowser(link string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("open", link)
+	case "windows":
+		cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", link)
+	default:
+		cmd = exec.Command("xdg-open", link)
 	}
+	return cmd.Start()
+}
 
-	tok, err := config.Exchange(context.TODO(), authCode)
+// saveToken writes the token as plaintext JSON readable only by the user.
+func saveToken(path string, token *oauth2.Token) error {
+	data, err := json.Marshal(token)
 	if err != nil {
-		log.Fatalf("Unable to retrieve token from web: %v", err)
+		return fmt.Errorf("failed to encode token: %v", err)
+	}
+	if err := writeFileAtomic(path, data, 0600); err != nil {
+		return fmt.Errorf("unable to cache oauth token: %v", err)
 	}
-	return tok
+	return nil
 }
 
-func saveToken(path string, token *oauth2.Token) {
-	f, err := os.Create(path)
+// writeFileAtomic replaces path with data via a temporary file in the same
+// directory, so readers never observe a partially written file.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*")
 	if err != nil {
-		log.Fatalf("Unable to cache oauth token: %v", err)
+		return err
 	}
-	defer f.Close()
+	defer os.Remove(f.Name())
+
+	if err := f.Chmod(perm); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
 
-	if err := json.NewEncoder(f).Encode(token); err != nil {
-		log.Fatalf("Failed to encode token: %v", err)
+// login runs the browser sign-in for the account and saves the new token,
+// replacing any token Google stopped accepting.
+func login(ac accountConfig) error {
+	if ac.Type != "" && ac.Type != "gmail" {
+		return fmt.Errorf("account %s is a %s account; there is no OAuth sign-in", ac.Name, ac.Type)
+	}
+	config, err := oauthConfig(ac)
+	if err != nil {
+		return err
+	}
+	store, err := openTokenStore(ac)
+	if err != nil {
+		return err
+	}
+	tok, err := getTokenFromWeb(config)
+	if err != nil {
+		return err
 	}
-}
\ No newline at end of file
+	if err := store.Save(tok); err != nil {
+		return fmt.Errorf("unable to save token: %v", err)
+	}
+	return nil
+}
+
+const revokeURL = "https://oauth2.googleapis.com/revoke"
+
+// logout revokes the account's token with Google and removes it from the
+// token store. A token Google no longer recognises is still removed.
+func logout(ac accountConfig) error {
+	if ac.Type != "" && ac.Type != "gmail" {
+		return fmt.Errorf("account %s is a %s account; there is no OAuth token to revoke", ac.Name, ac.Type)
+	}
+	store, err := openTokenStore(ac)
+	if err != nil {
+		return err
+	}
+	tok, err := store.Load()
+	if errors.Is(err, errNoToken) {
+		tok, err = tokenFromFile(ac.legacyToken)
+		if err != nil {
+			return fmt.Errorf("account %s is not logged in", ac.Name)
+		}
+	} else if err != nil {
+		return err
+	}
+
+	if err := revokeToken(tok); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+	if err := store.Delete(); err != nil {
+		return fmt.Errorf("unable to remove token: %v", err)
+	}
+	return removeIfExists(ac.legacyToken)
+}
+
+func revokeToken(tok *oauth2.Token) error {
+	t := tok.RefreshToken
+	if t == "" {
+		t = tok.AccessToken
+	}
+	resp, err := http.PostForm(revokeURL, url.Values{"token": {t}})
+	if err != nil {
+		return fmt.Errorf("unable to revoke token: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("token revocation failed: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// fakeAuthServer is an OAuth authorization server that checks the PKCE
+// exchange: the verifier sent to the token endpoint must hash to the
+// challenge the consent page was given.
+type fakeAuthServer struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	challenge string
+	redirect  string
+	// deny makes the consent page redirect back with access_denied.
+	deny bool
+	// refreshStatus is how the token endpoint answers refreshes: OK with
+	// a new token, or with that status. Zero means every refresh token has
+	// been revoked.
+	refreshStatus int
+}
+
+func newFakeAuthServer(t *testing.T) *fakeAuthServer {
+	s := &fakeAuthServer{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/auth", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+			http.Error(w, "PKCE challenge missing", http.StatusBadRequest)
+			return
+		}
+		if q.Get("access_type") != "offline" {
+			http.Error(w, "offline access not requested", http.StatusBadRequest)
+			return
+		}
+		s.mu.Lock()
+		s.challenge = q.Get("code_challenge")
+		s.redirect = q.Get("redirect_uri")
+		deny := s.deny
+		s.mu.Unlock()
+
+		back := url.Values{"state": {q.Get("state")}}
+		if deny {
+			back.Set("error", "access_denied")
+		} else {
+			back.Set("code", "the-code")
+		}
+		http.Redirect(w, r, q.Get("redirect_uri")+"?"+back.Encode(), http.StatusFound)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		s.mu.Lock()
+		challenge, redirect, refreshStatus := s.challenge, s.redirect, s.refreshStatus
+		s.mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		switch r.Form.Get("grant_type") {
+		case "authorization_code":
+			sum := sha256.Sum256([]byte(r.Form.Get("code_verifier")))
+			if base64.RawURLEncoding.EncodeToString(sum[:]) != challenge ||
+				r.Form.Get("code") != "the-code" || r.Form.Get("redirect_uri") != redirect {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]any{
+				"access_token":  "access-1",
+				"refresh_token": "refresh-1",
+				"token_type":    "Bearer",
+				"expires_in":    3600,
+			})
+		case "refresh_token":
+			switch refreshStatus {
+			case http.StatusOK:
+				json.NewEncoder(w).Encode(map[string]any{"access_token": "access-2", "token_type": "Bearer", "expires_in": 3600})
+				return
+			case 0:
+			default:
+				w.WriteHeader(refreshStatus)
+				return
+			}
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant", "error_description": "Token has been expired or revoked."})
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	})
+	s.Server = httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *fakeAuthServer) config() *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     "client",
+		ClientSecret: "secret",
+		Endpoint: oauth2.Endpoint{
+			AuthURL:   s.URL + "/auth",
+			TokenURL:  s.URL + "/token",
+			AuthStyle: oauth2.AuthStyleInParams,
+		},
+		Scopes: []string{"mail"},
+	}
+}
+
+// fakeBrowser follows the consent page's redirect to the loopback
+// listener, as the user's browser would.
+func fakeBrowser(t *testing.T) func(string) error {
+	return func(link string) error {
+		go func() {
+			resp, err := http.Get(link)
+			if err != nil {
+				t.Errorf("browser: %v", err)
+				return
+			}
+			resp.Body.Close()
+		}()
+		return nil
+	}
+}
+
+func TestGetTokenFromWeb(t *testing.T) {
+	srv := newFakeAuthServer(t)
+	defer func(old func(string) error) { openAuthURL = old }(openAuthURL)
+	openAuthURL = fakeBrowser(t)
+
+	tok, err := getTokenFromWeb(srv.config())
+	if err != nil {
+		t.Fatalf("getTokenFromWeb: %v", err)
+	}
+	if tok.AccessToken != "access-1" || tok.RefreshToken != "refresh-1" {
+		t.Errorf("got token %+v", tok)
+	}
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if !strings.HasPrefix(srv.redirect, "http://127.0.0.1:") {
+		t.Errorf("redirect URI %q is not a loopback address", srv.redirect)
+	}
+}
+
+func TestGetTokenFromWebDenied(t *testing.T) {
+	srv := newFakeAuthServer(t)
+	srv.deny = true
+	defer func(old func(string) error) { openAuthURL = old }(openAuthURL)
+	openAuthURL = fakeBrowser(t)
+
+	_, err := getTokenFromWeb(srv.config())
+	if err == nil || !strings.Contains(err.Error(), "access_denied") {
+		t.Fatalf("got %v, want an access_denied error", err)
+	}
+}
+
+func TestGetTokenFromWebIgnoresForeignState(t *testing.T) {
+	srv := newFakeAuthServer(t)
+	defer func(old func(string) error) { openAuthURL = old }(openAuthURL)
+	openAuthURL = func(link string) error {
+		u, _ := url.Parse(link)
+		redirect := u.Query().Get("redirect_uri")
+		go func() {
+			// A request with someone else's state is turned away
+			// without ending the flow.
+			resp, err := http.Get(redirect + "?state=forged&code=stolen")
+			if err != nil {
+				t.Errorf("forged redirect: %v", err)
+				return
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusBadRequest {
+				t.Errorf("forged redirect got %s", resp.Status)
+			}
+			fakeBrowser(t)(link)
+		}()
+		return nil
+	}
+
+	tok, err := getTokenFromWeb(srv.config())
+	if err != nil {
+		t.Fatalf("getTokenFromWeb: %v", err)
+	}
+	if tok.AccessToken != "access-1" {
+		t.Errorf("got token %+v", tok)
+	}
+}
+
+// memTokenStore is a tokenStore held in memory.
+type memTokenStore struct {
+	mu  sync.Mutex
+	tok *oauth2.Token
+}
+
+func (s *memTokenStore) Load() (*oauth2.Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.tok == nil {
+		return nil, errNoToken
+	}
+	return s.tok, nil
+}
+
+func (s *memTokenStore) Save(tok *oauth2.Token) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tok = tok
+	return nil
+}
+
+func (s *memTokenStore) Delete() error { return s.Save(nil) }
+
+func (s *memTokenStore) Describe() string { return "memory" }
+
+func TestTokenSourceRevokedNeedsLogin(t *testing.T) {
+	srv := newFakeAuthServer(t)
+	defer func(old func(string) error) { openAuthURL = old }(openAuthURL)
+	openAuthURL = func(string) error {
+		t.Error("the sign-in flow was started from the token source")
+		return nil
+	}
+
+	expired := &oauth2.Token{AccessToken: "old", RefreshToken: "revoked", Expiry: time.Now().Add(-time.Hour)}
+	store := &memTokenStore{tok: expired}
+	ts := newPersistingTokenSource("work", srv.config(), store, expired)
+
+	_, err := ts.Token()
+	var reauth *reauthError
+	if !errors.As(err, &reauth) {
+		t.Fatalf("got %v, want a reauthError", err)
+	}
+	if !strings.Contains(errorText(fmt.Errorf("request failed: %w", err)), "--account work login") {
+		t.Errorf("toast %q doesn't say how to sign in again", errorText(err))
+	}
+	if tok, _ := store.Load(); tok != expired {
+		t.Errorf("the rejected token was replaced with %+v", tok)
+	}
+
+	// Once login saves a new token, the next request uses it.
+	store.Save(&oauth2.Token{AccessToken: "fresh", RefreshToken: "new", Expiry: time.Now().Add(time.Hour)})
+	tok, err := ts.Token()
+	if err != nil {
+		t.Fatalf("Token after login: %v", err)
+	}
+	if tok.AccessToken != "fresh" {
+		t.Errorf("got token %+v, want the one login saved", tok)
+	}
+}
+
+func TestPassphraseNotPromptedWhileTUIRuns(t *testing.T) {
+	t.Setenv("GMAIL_TUI_PASSPHRASE", "")
+	terminalBusy.Store(true)
+	defer terminalBusy.Store(false)
+
+	s := newEncryptedTokenStore(accountConfig{Name: "work", Token: filepath.Join(t.TempDir(), "token.json")})
+	if err := s.Save(&oauth2.Token{AccessToken: "a"}); err == nil {
+		t.Fatal("Save asked for a passphrase while the TUI owns the terminal")
+	}
+}
+
+// failingStore is a tokenStore that can't save, like a locked keyring.
+type failingStore struct{ memTokenStore }
+
+func (s *failingStore) Save(*oauth2.Token) error { return errors.New("keyring is locked") }
+
+func TestTokenSaveFailureGoesToStatusLog(t *testing.T) {
+	srv := newFakeAuthServer(t)
+	srv.refreshStatus = http.StatusOK
+	var stderr bytes.Buffer
+	log.SetOutput(&stderr)
+	defer log.SetOutput(os.Stderr)
+
+	expired := &oauth2.Token{AccessToken: "old", RefreshToken: "refresh-1", Expiry: time.Now().Add(-time.Hour)}
+	ts := newPersistingTokenSource("work", srv.config(), &failingStore{}, expired)
+	tok, err := ts.Token()
+	if err != nil || tok.AccessToken != "access-2" {
+		t.Fatalf("Token = %+v, %v; want the refreshed token despite the failed save", tok, err)
+	}
+	if stderr.Len() > 0 {
+		t.Errorf("printed %q over the TUI", stderr.String())
+	}
+	select {
+	case text := <-tokenWarnings:
+		if !strings.Contains(text, "keyring is locked") {
+			t.Errorf("warning %q", text)
+		}
+	default:
+		t.Error("the failed save wasn't reported")
+	}
+}
+
+func TestGetClientStartsOfflineOnServerError(t *testing.T) {
+	srv := newFakeAuthServer(t)
+	srv.refreshStatus = http.StatusServiceUnavailable
+	defer func(old func(string) error) { openAuthURL = old }(openAuthURL)
+	openAuthURL = func(string) error {
+		t.Error("the sign-in flow was started for a server error")
+		return nil
+	}
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	expired := &oauth2.Token{AccessToken: "old", RefreshToken: "refresh-1", Expiry: time.Now().Add(-time.Hour)}
+	if _, err := getClient("work", srv.config(), &memTokenStore{tok: expired}); err != nil {
+		t.Errorf("getClient: %v; want to start offline while the token endpoint is down", err)
+	}
+}
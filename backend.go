@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// MailBackend is the set of mailbox operations the TUI needs. Messages,
+// labels and MIME parts use the Gmail API types as the common model so
+// that parsing and views behave the same regardless of where mail lives.
+//
+// Message formats follow the Gmail API: "minimal" (IDs and labels only),
+// "metadata" (plus the requested headers), "full" (parsed payload) and
+// "raw" (the RFC 822 source in Raw).
+type MailBackend interface {
+	// ListMessages returns one page of message IDs matching query and
+	// labelIDs. An empty pageToken starts from the newest message.
+	ListMessages(query string, labelIDs []string, pageToken string, max int64) (*gmail.ListMessagesResponse, error)
+	GetMessage(id, format string, metadataHeaders ...string) (*gmail.Message, error)
+	// SendMessage sends msg.Raw, an RFC 822 message in base64url.
+	SendMessage(msg *gmail.Message) (*gmail.Message, error)
+	ModifyMessage(id string, addLabelIDs, removeLabelIDs []string) error
+	TrashMessage(id string) error
+	ListLabels() ([]*gmail.Label, error)
+	// GetAttachment returns the decoded contents of an attachment part.
+	GetAttachment(msgID, attachmentID string) ([]byte, error)
+}
+
+// ThreadBackend is implemented by backends that group messages into
+// conversations on the server. Thread formats match those of GetMessage;
+// a thread's messages come oldest first.
+type ThreadBackend interface {
+	ListThreads(query string, labelIDs []string, pageToken string, max int64) (*gmail.ListThreadsResponse, error)
+	GetThread(id, format string, metadataHeaders ...string) (*gmail.Thread, error)
+	ModifyThread(id string, addLabelIDs, removeLabelIDs []string) error
+	TrashThread(id string) error
+}
+
+var (
+	errNotFound  = errors.New("not found")
+	errNoThreads = errors.New("this account doesn't support conversations")
+)
+
+// sentCopyError is returned by SendMessage when the message went out but
+// filing the copy in the sent folder failed. Sending it again would
+// deliver it twice.
+type sentCopyError struct {
+	folder string
+	err    error
+}
+
+func (e *sentCopyError) Error() string {
+	return fmt.Sprintf("sent, but couldn't save to %s: %v", e.folder, e.err)
+}
+
+func (e *sentCopyError) Unwrap() error { return e.err }
+
+// openBackend connects the backend configured for an account.
+func openBackend(ac accountConfig) (MailBackend, error) {
+	switch ac.Type {
+	case "imap":
+		return newIMAPBackend(ac)
+	case "maildir":
+		return newMaildirBackend(ac)
+	default:
+		srv, err := getGmailService(ac)
+		if err != nil {
+			return nil, err
+		}
+		return newGmailBackend(srv), nil
+	}
+}
@@ -0,0 +1,520 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
+)
+
+// defaultCacheSizeMB caps each account's message cache unless the config
+// file sets cache_size_mb.
+const defaultCacheSizeMB = 256
+
+// diskCache is a size-capped store of JSON files with least recently
+// used eviction. File modification times record the last use, so the
+// order survives restarts without a separate index.
+type diskCache struct {
+	dir     string
+	maxSize int64
+
+	mu      sync.Mutex
+	entries map[string]*diskCacheEntry // by file name
+	size    int64
+}
+
+type diskCacheEntry struct {
+	size int64
+	used time.Time
+}
+
+func openDiskCache(dir string, maxSize int64) *diskCache {
+	c := &diskCache{dir: dir, maxSize: maxSize, entries: make(map[string]*diskCacheEntry)}
+	files, _ := os.ReadDir(dir)
+	for _, f := range files {
+		info, err := f.Info()
+		if err != nil || !f.Type().IsRegular() || !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		c.entries[f.Name()] = &diskCacheEntry{size: info.Size(), used: info.ModTime()}
+		c.size += info.Size()
+	}
+	c.mu.Lock()
+	c.evict()
+	c.mu.Unlock()
+	return c
+}
+
+func cacheFileName(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:16]) + ".json"
+}
+
+// get decodes the entry for key into v and marks it as recently used. The
+// file is read without holding the lock; put replaces files atomically, so
+// a concurrent write is seen either before or after.
+func (c *diskCache) get(key string, v any) bool {
+	name := cacheFileName(key)
+	c.mu.Lock()
+	e, ok := c.entries[name]
+	c.mu.Unlock()
+	if !ok {
+		return false
+	}
+	path := filepath.Join(c.dir, name)
+	data, err := os.ReadFile(path)
+	if err == nil {
+		err = json.Unmarshal(data, v)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err != nil {
+		// Unless put replaced the entry meanwhile, it is unreadable.
+		if c.entries[name] == e {
+			c.removeLocked(name)
+		}
+		return false
+	}
+	e.used = time.Now()
+	os.Chtimes(path, e.used, e.used)
+	return true
+}
+
+func (c *diskCache) put(key string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	name := cacheFileName(key)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := writeFileAtomic(filepath.Join(c.dir, name), data, 0600); err != nil {
+		return err
+	}
+	if old, ok := c.entries[name]; ok {
+		c.size -= old.size
+	}
+	c.entries[name] = &diskCacheEntry{size: int64(len(data)), used: time.Now()}
+	c.size += int64(len(data))
+	c.evict()
+	return nil
+}
+
+func (c *diskCache) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.removeLocked(cacheFileName(key))
+}
+
+func (c *diskCache) removeLocked(name string) {
+	if e, ok := c.entries[name]; ok {
+		c.size -= e.size
+		delete(c.entries, name)
+	}
+	os.Remove(filepath.Join(c.dir, name))
+}
+
+// evict drops least recently used entries until the cache fits.
+func (c *diskCache) evict() {
+	if c.size <= c.maxSize {
+		return
+	}
+	names := make([]string, 0, len(c.entries))
+	for name := range c.entries {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return c.entries[names[i]].used.Before(c.entries[names[j]].used) })
+	for _, name := range names {
+		if c.size <= c.maxSize {
+			break
+		}
+		c.removeLocked(name)
+	}
+}
+
+// cachingBackend keeps messages, the last result of each listing and the
+// label list on disk. A message's headers and body never change, only its
+// labels do. Over a backend with history, cached messages are served
+// without asking it: history polling applies the label changes it reads
+// to the cache, and checks those of messages served since the last poll
+// (see historyCache). Without history, opening a cached message fetches
+// its labels again. When the backend can't be reached, listings and
+// metadata fall back to the cache, so cached mail stays readable offline.
+type cachingBackend struct {
+	MailBackend
+	cache *diskCache
+	// polled is set when history polling keeps the cache's labels current.
+	polled bool
+
+	mu sync.Mutex
+	// unchecked are the messages served from the cache since the last
+	// poll, whose labels may have changed while the app wasn't running.
+	unchecked map[string]bool
+}
+
+// cachingThreadBackend is a cachingBackend over a backend with
+// conversations, which it caches the same way.
+type cachingThreadBackend struct {
+	*cachingBackend
+	threads ThreadBackend
+}
+
+// withCache wraps b with a message cache under the cache directory. A
+// negative size disables caching.
+func withCache(b MailBackend, ac accountConfig, p appPaths, sizeMB int64) MailBackend {
+	if sizeMB < 0 {
+		return b
+	}
+	if sizeMB == 0 {
+		sizeMB = defaultCacheSizeMB
+	}
+	dir := filepath.Join(p.CacheDir, "messages", ac.Name)
+	_, polled := capability[HistoryBackend](b)
+	c := &cachingBackend{MailBackend: b, cache: openDiskCache(dir, sizeMB<<20), polled: polled}
+	if tb, ok := capability[ThreadBackend](b); ok {
+		return &cachingThreadBackend{cachingBackend: c, threads: tb}
+	}
+	return c
+}
+
+func (c *cachingBackend) Unwrap() MailBackend { return c.MailBackend }
+
+// cachedListing is a stored ListMessages result.
+type cachedListing struct {
+	Messages      []*gmail.Message `json:"messages"`
+	NextPageToken string           `json:"next_page_token,omitempty"`
+	Estimate      int64            `json:"estimate"`
+}
+
+func listingKey(query string, labelIDs []string, pageToken string) string {
+	return "list\x00" + query + "\x00" + strings.Join(labelIDs, ",") + "\x00" + pageToken
+}
+
+func (c *cachingBackend) ListMessages(query string, labelIDs []string, pageToken string, max int64) (*gmail.ListMessagesResponse, error) {
+	key := listingKey(query, labelIDs, pageToken)
+	resp, err := c.MailBackend.ListMessages(query, labelIDs, pageToken, max)
+	if err != nil {
+		var l cachedListing
+		if isNotFound(err) || !c.cache.get(key, &l) {
+			return nil, err
+		}
+		return &gmail.ListMessagesResponse{Messages: l.Messages, NextPageToken: l.NextPageToken, ResultSizeEstimate: l.Estimate}, nil
+	}
+	c.cache.put(key, cachedListing{Messages: resp.Messages, NextPageToken: resp.NextPageToken, Estimate: resp.ResultSizeEstimate})
+	return resp, nil
+}
+
+// cachedMessage is a stored message. List rows are cached with just their
+// metadata headers so they can be listed offline; Full marks a complete
+// payload that can also be opened.
+type cachedMessage struct {
+	Message *gmail.Message `json:"message"`
+	Full    bool           `json:"full,omitempty"`
+}
+
+func messageKey(id string) string { return "msg\x00" + id }
+
+func (c *cachingBackend) GetMessage(id, format string, metadataHeaders ...string) (*gmail.Message, error) {
+	var cached cachedMessage
+	have := c.cache.get(messageKey(id), &cached) && cached.Message != nil
+	if have && c.polled && (format != "full" || cached.Full) {
+		c.mu.Lock()
+		if c.unchecked == nil {
+			c.unchecked = make(map[string]bool)
+		}
+		c.unchecked[id] = true
+		c.mu.Unlock()
+		return formatMessage(cached.Message, format, metadataHeaders), nil
+	}
+	if have && cached.Full && format == "full" {
+		// The payload can't change but the labels can; a minimal fetch
+		// is enough to bring them up to date.
+		msg, err := c.MailBackend.GetMessage(id, "minimal")
+		if isNotFound(err) {
+			c.cache.remove(messageKey(id))
+			return nil, err
+		}
+		if err == nil {
+			c.refreshLabels(id, cached, msg)
+		}
+		return cached.Message, nil
+	}
+
+	msg, err := c.MailBackend.GetMessage(id, format, metadataHeaders...)
+	if err != nil {
+		if isNotFound(err) {
+			c.cache.remove(messageKey(id))
+			return nil, err
+		}
+		if have && (format == "metadata" || format == "minimal") {
+			return formatMessage(cached.Message, format, metadataHeaders), nil
+		}
+		return nil, err
+	}
+
+	switch {
+	case format == "full":
+		c.cache.put(messageKey(id), cachedMessage{Message: msg, Full: true})
+	case format == "metadata" && !have:
+		c.cache.put(messageKey(id), cachedMessage{Message: msg})
+	case have:
+		c.refreshLabels(id, cached, msg)
+	}
+	return msg, nil
+}
+
+// refreshLabels stores the labels of msg in the cached copy, unless msg
+// is older than it.
+func (c *cachingBackend) refreshLabels(id string, cached cachedMessage, msg *gmail.Message) {
+	if msg.HistoryId < cached.Message.HistoryId || slices.Equal(msg.LabelIds, cached.Message.LabelIds) {
+		return
+	}
+	cached.Message.LabelIds = msg.LabelIds
+	cached.Message.HistoryId = msg.HistoryId
+	c.cache.put(messageKey(id), cached)
+}
+
+// historyCache is the cache as history polling sees it.
+type historyCache interface {
+	// applyHistory brings the cached labels up to date with records.
+	applyHistory(records []*gmail.History)
+	// recheck fetches the labels of the messages served from the cache
+	// since it last ran, and returns those that changed or are gone.
+	recheck() (changed []*gmail.Message, gone []string)
+}
+
+func (c *cachingBackend) applyHistory(records []*gmail.History) {
+	for _, h := range records {
+		for _, a := range h.LabelsAdded {
+			if a.Message != nil {
+				c.relabel(a.Message.Id, a.LabelIds, nil)
+			}
+		}
+		for _, r := range h.LabelsRemoved {
+			if r.Message != nil {
+				c.relabel(r.Message.Id, nil, r.LabelIds)
+			}
+		}
+		for _, d := range h.MessagesDeleted {
+			if d.Message != nil {
+				c.cache.remove(messageKey(d.Message.Id))
+			}
+		}
+	}
+}
+
+func (c *cachingBackend) recheck() (changed []*gmail.Message, gone []string) {
+	c.mu.Lock()
+	ids := make([]string, 0, len(c.unchecked))
+	for id := range c.unchecked {
+		ids = append(ids, id)
+	}
+	c.mu.Unlock()
+
+	for _, id := range ids {
+		msg, err := c.MailBackend.GetMessage(id, "minimal")
+		if err != nil && !isNotFound(err) {
+			// Still offline; try again next poll.
+			break
+		}
+		c.mu.Lock()
+		delete(c.unchecked, id)
+		c.mu.Unlock()
+		var cached cachedMessage
+		if !c.cache.get(messageKey(id), &cached) || cached.Message == nil {
+			continue
+		}
+		if err != nil {
+			c.cache.remove(messageKey(id))
+			gone = append(gone, id)
+			continue
+		}
+		if !slices.Equal(msg.LabelIds, cached.Message.LabelIds) {
+			c.refreshLabels(id, cached, msg)
+			changed = append(changed, &gmail.Message{Id: id, ThreadId: cached.Message.ThreadId})
+		}
+	}
+	return changed, gone
+}
+
+func (c *cachingBackend) ModifyMessage(id string, addLabelIDs, removeLabelIDs []string) error {
+	if err := c.MailBackend.ModifyMessage(id, addLabelIDs, removeLabelIDs); err != nil {
+		return err
+	}
+	c.relabel(id, addLabelIDs, removeLabelIDs)
+	return nil
+}
+
+func (c *cachingBackend) TrashMessage(id string) error {
+	if err := c.MailBackend.TrashMessage(id); err != nil {
+		return err
+	}
+	c.relabel(id, []string{"TRASH"}, []string{"INBOX"})
+	return nil
+}
+
+func (c *cachingBackend) relabel(id string, add, remove []string) {
+	var cached cachedMessage
+	if c.cache.get(messageKey(id), &cached) && cached.Message != nil {
+		cached.Message.LabelIds = modifyLabels(cached.Message.LabelIds, add, remove)
+		c.cache.put(messageKey(id), cached)
+	}
+}
+
+// cachedThreadListing is a stored ListThreads result.
+type cachedThreadListing struct {
+	Threads       []*gmail.Thread `json:"threads"`
+	NextPageToken string          `json:"next_page_token,omitempty"`
+	Estimate      int64           `json:"estimate"`
+}
+
+func (c *cachingThreadBackend) ListThreads(query string, labelIDs []string, pageToken string, max int64) (*gmail.ListThreadsResponse, error) {
+	key := "threads\x00" + listingKey(query, labelIDs, pageToken)
+	resp, err := c.threads.ListThreads(query, labelIDs, pageToken, max)
+	if err != nil {
+		var l cachedThreadListing
+		if isNotFound(err) || !c.cache.get(key, &l) {
+			return nil, err
+		}
+		return &gmail.ListThreadsResponse{Threads: l.Threads, NextPageToken: l.NextPageToken, ResultSizeEstimate: l.Estimate}, nil
+	}
+	c.cache.put(key, cachedThreadListing{Threads: resp.Threads, NextPageToken: resp.NextPageToken, Estimate: resp.ResultSizeEstimate})
+	return resp, nil
+}
+
+func threadKey(id string) string { return "thread\x00" + id }
+
+// GetThread caches the messages of a conversation like GetMessage does,
+// and remembers which they are, so the conversation can be put together
+// from the cache offline.
+func (c *cachingThreadBackend) GetThread(id, format string, metadataHeaders ...string) (*gmail.Thread, error) {
+	thread, err := c.threads.GetThread(id, format, metadataHeaders...)
+	if err != nil {
+		if isNotFound(err) {
+			c.cache.remove(threadKey(id))
+			return nil, err
+		}
+		if cached := c.cachedThread(id, format, metadataHeaders); cached != nil {
+			return cached, nil
+		}
+		return nil, err
+	}
+
+	ids := make([]string, len(thread.Messages))
+	for i, msg := range thread.Messages {
+		ids[i] = msg.Id
+		var cached cachedMessage
+		have := c.cache.get(messageKey(msg.Id), &cached) && cached.Message != nil
+		switch {
+		case format == "full":
+			c.cache.put(messageKey(msg.Id), cachedMessage{Message: msg, Full: true})
+		case format == "metadata" && !have:
+			c.cache.put(messageKey(msg.Id), cachedMessage{Message: msg})
+		case have:
+			c.refreshLabels(msg.Id, cached, msg)
+		}
+	}
+	c.cache.put(threadKey(id), ids)
+	return thread, nil
+}
+
+// cachedThread assembles a conversation from cached messages, or returns
+// nil if any of them is missing or lacks the payload format needs.
+func (c *cachingThreadBackend) cachedThread(id, format string, metadataHeaders []string) *gmail.Thread {
+	var ids []string
+	if !c.cache.get(threadKey(id), &ids) || len(ids) == 0 {
+		return nil
+	}
+	thread := &gmail.Thread{Id: id}
+	for _, msgID := range ids {
+		var cached cachedMessage
+		if !c.cache.get(messageKey(msgID), &cached) || cached.Message == nil || format == "full" && !cached.Full {
+			return nil
+		}
+		thread.Messages = append(thread.Messages, formatMessage(cached.Message, format, metadataHeaders))
+	}
+	return thread
+}
+
+func (c *cachingThreadBackend) ModifyThread(id string, addLabelIDs, removeLabelIDs []string) error {
+	if err := c.threads.ModifyThread(id, addLabelIDs, removeLabelIDs); err != nil {
+		return err
+	}
+	c.relabelThread(id, addLabelIDs, removeLabelIDs)
+	return nil
+}
+
+func (c *cachingThreadBackend) TrashThread(id string) error {
+	if err := c.threads.TrashThread(id); err != nil {
+		return err
+	}
+	c.relabelThread(id, []string{"TRASH"}, []string{"INBOX"})
+	return nil
+}
+
+func (c *cachingThreadBackend) relabelThread(id string, add, remove []string) {
+	var ids []string
+	if c.cache.get(threadKey(id), &ids) {
+		for _, msgID := range ids {
+			c.relabel(msgID, add, remove)
+		}
+	}
+}
+
+func (c *cachingBackend) ListLabels() ([]*gmail.Label, error) {
+	const key = "labels"
+	labels, err := c.MailBackend.ListLabels()
+	if err != nil {
+		var cached []*gmail.Label
+		if c.cache.get(key, &cached) {
+			return cached, nil
+		}
+		return nil, err
+	}
+	c.cache.put(key, labels)
+	return labels, nil
+}
+
+// isNotFound reports whether err means the message is gone rather than
+// that the backend couldn't be reached.
+func isNotFound(err error) bool {
+	var gerr *googleapi.Error
+	if errors.As(err, &gerr) {
+		return gerr.Code == http.StatusNotFound
+	}
+	return errors.Is(err, errNotFound)
+}
+
+// unwrappedBackend is implemented by backends that decorate another one.
+type unwrappedBackend interface {
+	Unwrap() MailBackend
+}
+
+// capability returns the first backend in b's decorator chain that
+// implements T, such as ThreadBackend or HistoryBackend.
+func capability[T any](b MailBackend) (T, bool) {
+	for b != nil {
+		if t, ok := b.(T); ok {
+			return t, true
+		}
+		w, ok := b.(unwrappedBackend)
+		if !ok {
+			break
+		}
+		b = w.Unwrap()
+	}
+	var zero T
+	return zero, false
+}
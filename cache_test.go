@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// unreachableBackend is a memoryBackend whose reads fail, as if offline,
+// while down is set.
+type unreachableBackend struct {
+	*memoryBackend
+	down bool
+}
+
+var errUnreachable = errors.New("dial tcp: network is unreachable")
+
+func (b *unreachableBackend) ListMessages(query string, labelIDs []string, pageToken string, max int64) (*gmail.ListMessagesResponse, error) {
+	if b.down {
+		return nil, errUnreachable
+	}
+	return b.memoryBackend.ListMessages(query, labelIDs, pageToken, max)
+}
+
+func (b *unreachableBackend) GetMessage(id, format string, metadataHeaders ...string) (*gmail.Message, error) {
+	if b.down {
+		return nil, errUnreachable
+	}
+	return b.memoryBackend.GetMessage(id, format, metadataHeaders...)
+}
+
+func (b *unreachableBackend) GetThread(id, format string, metadataHeaders ...string) (*gmail.Thread, error) {
+	if b.down {
+		return nil, errUnreachable
+	}
+	return b.memoryBackend.GetThread(id, format, metadataHeaders...)
+}
+
+// onlyMail hides every capability of the backend it wraps.
+type onlyMail struct{ MailBackend }
+
+func mustAdd(t *testing.T, mb *memoryBackend, raw string, labels ...string) *gmail.Message {
+	t.Helper()
+	msg, err := mb.AddRaw([]byte(raw), labels...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func newCachedBackend(t *testing.T, b MailBackend) MailBackend {
+	t.Helper()
+	return withCache(b, accountConfig{Name: "test"}, appPaths{CacheDir: t.TempDir()}, 0)
+}
+
+func TestCacheServesFullMessagesOffline(t *testing.T) {
+	mb := newMemoryBackend()
+	id := mustAdd(t, mb, "From: a@example.org\r\nSubject: Hello\r\n\r\nbody\r\n", "INBOX", "UNREAD").Id
+	ub := &unreachableBackend{memoryBackend: mb}
+	b := newCachedBackend(t, ub)
+	hc, ok := capability[historyCache](b)
+	if !ok {
+		t.Fatal("history polling can't reach the cache")
+	}
+
+	if _, err := b.GetMessage(id, "full"); err != nil {
+		t.Fatalf("GetMessage: %v", err)
+	}
+	// Read on another device: the next poll picks up the change.
+	mb.ModifyMessage(id, nil, []string{"UNREAD"})
+	if _, err := b.GetMessage(id, "full"); err != nil {
+		t.Fatalf("GetMessage: %v", err)
+	}
+	if changed, _ := hc.recheck(); len(changed) != 1 || changed[0].Id != id {
+		t.Errorf("recheck reports %v, want the message read elsewhere", changed)
+	}
+	msg, err := b.GetMessage(id, "full")
+	if err != nil {
+		t.Fatalf("GetMessage: %v", err)
+	}
+	if slices.Contains(msg.LabelIds, "UNREAD") {
+		t.Errorf("cached message still has labels %v", msg.LabelIds)
+	}
+
+	// Starred here and seen by a poll, which applies it to the cache.
+	start, _ := mb.HistoryID()
+	mb.ModifyMessage(id, []string{"STARRED"}, nil)
+	resp, _ := mb.ListHistory(start, "")
+	hc.applyHistory(resp.History)
+
+	ub.down = true
+	msg, err = b.GetMessage(id, "full")
+	if err != nil {
+		t.Fatalf("GetMessage offline: %v", err)
+	}
+	if headerValue(msg.Payload.Headers, "Subject") != "Hello" || !slices.Equal(msg.LabelIds, []string{"INBOX", "STARRED"}) {
+		t.Errorf("offline copy has subject %q and labels %v", headerValue(msg.Payload.Headers, "Subject"), msg.LabelIds)
+	}
+	if changed, _ := hc.recheck(); len(changed) != 0 {
+		t.Errorf("recheck offline reports %v", changed)
+	}
+}
+
+// hangingBackend is a memoryBackend whose reads never answer while hung
+// is set, like a request on a captive network without a timeout.
+type hangingBackend struct {
+	*memoryBackend
+	hung atomic.Bool
+}
+
+func (b *hangingBackend) GetMessage(id, format string, metadataHeaders ...string) (*gmail.Message, error) {
+	if b.hung.Load() {
+		select {}
+	}
+	return b.memoryBackend.GetMessage(id, format, metadataHeaders...)
+}
+
+func TestCacheDoesNotWaitForTheNetwork(t *testing.T) {
+	mb := newMemoryBackend()
+	opened := mustAdd(t, mb, "From: a@example.org\r\nSubject: Opened\r\n\r\nbody\r\n", "INBOX").Id
+	listed := mustAdd(t, mb, "From: a@example.org\r\nSubject: Listed\r\n\r\nbody\r\n", "INBOX").Id
+	hb := &hangingBackend{memoryBackend: mb}
+	b := newCachedBackend(t, hb)
+	if _, err := b.GetMessage(opened, "full"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.GetMessage(listed, "metadata", listHeaders...); err != nil {
+		t.Fatal(err)
+	}
+
+	hb.hung.Store(true)
+	done := make(chan error, 2)
+	go func() {
+		_, err := b.GetMessage(opened, "full")
+		done <- err
+	}()
+	go func() {
+		_, err := b.GetMessage(listed, "metadata", listHeaders...)
+		done <- err
+	}()
+	for range 2 {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Errorf("GetMessage: %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("a cached message waited on the network")
+		}
+	}
+}
+
+func TestCacheThreads(t *testing.T) {
+	mb := newMemoryBackend()
+	first := mustAdd(t, mb, "From: a@example.org\r\nSubject: Plans\r\nMessage-ID: <1@example.org>\r\n\r\nSaturday?\r\n", "INBOX")
+	reply := "To: a@example.org\r\nSubject: Re: Plans\r\nIn-Reply-To: <1@example.org>\r\n\r\nSure.\r\n"
+	if _, err := mb.SendMessage(&gmail.Message{Raw: base64.URLEncoding.EncodeToString([]byte(reply)), ThreadId: first.ThreadId}); err != nil {
+		t.Fatal(err)
+	}
+	ub := &unreachableBackend{memoryBackend: mb}
+	b := newCachedBackend(t, ub)
+
+	tb, ok := capability[ThreadBackend](b)
+	if !ok {
+		t.Fatal("the cache hides the backend's conversations")
+	}
+	if _, ok := tb.(*cachingThreadBackend); !ok {
+		t.Fatalf("conversations bypass the cache: %T", tb)
+	}
+	thread, err := tb.GetThread(first.ThreadId, "full")
+	if err != nil {
+		t.Fatalf("GetThread: %v", err)
+	}
+	if len(thread.Messages) != 2 {
+		t.Fatalf("conversation has %d messages, want 2", len(thread.Messages))
+	}
+
+	if err := tb.TrashThread(first.ThreadId); err != nil {
+		t.Fatalf("TrashThread: %v", err)
+	}
+	ub.down = true
+	thread, err = tb.GetThread(first.ThreadId, "full")
+	if err != nil {
+		t.Fatalf("GetThread offline: %v", err)
+	}
+	for _, msg := range thread.Messages {
+		if !slices.Contains(msg.LabelIds, "TRASH") || slices.Contains(msg.LabelIds, "INBOX") {
+			t.Errorf("cached message %s has labels %v after trashing the conversation", msg.Id, msg.LabelIds)
+		}
+	}
+}
+
+func TestCacheWithoutThreads(t *testing.T) {
+	b := newCachedBackend(t, onlyMail{newMemoryBackend()})
+	if _, ok := capability[ThreadBackend](b); ok {
+		t.Error("the cache claims conversations its backend doesn't have")
+	}
+}
+
+func TestDiskCacheConcurrentUse(t *testing.T) {
+	c := openDiskCache(t.TempDir(), 1<<20)
+	if err := c.put("k", 0); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				c.put("k", j)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				var v int
+				if !c.get("k", &v) {
+					t.Errorf("entry lost while it was being rewritten (read %d)", j)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
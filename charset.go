@@ -0,0 +1,107 @@
+package main
+
+import (
+	"mime"
+	"net/mail"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/html/charset"
+	"google.golang.org/api/gmail/v1"
+)
+
+// headerDecoder decodes RFC 2047 encoded words in any charset the HTML
+// spec knows, which covers what mail clients send.
+var headerDecoder = &mime.WordDecoder{CharsetReader: charset.NewReaderLabel}
+
+// decodeHeader returns a header value with its encoded words decoded, or
+// as it is if they don't decode. Either way it is made safe to print.
+func decodeHeader(s string) string {
+	if !strings.Contains(s, "=?") {
+		return printableHeader(s)
+	}
+	decoded, err := headerDecoder.DecodeHeader(s)
+	if err != nil {
+		return printableHeader(s)
+	}
+	return printableHeader(decoded)
+}
+
+// printableHeader is header text that can't drive the terminal: tabs and
+// line breaks become spaces and other control characters, which encoded
+// words can carry, are shown as � like printableSource does.
+func printableHeader(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r == '\t' || r == '\r' || r == '\n':
+			return ' '
+		case isControl(r):
+			return '�'
+		}
+		return r
+	}, strings.ToValidUTF8(s, "�"))
+}
+
+// decodeAddresses decodes the display names in an address list. Names are
+// quoted where they need it, so that the result still parses as a list
+// when it is used to reply.
+func decodeAddresses(s string) string {
+	if !strings.Contains(s, "=?") {
+		return printableHeader(s)
+	}
+	parser := mail.AddressParser{WordDecoder: headerDecoder}
+	list, err := parser.ParseList(s)
+	if err != nil {
+		return decodeHeader(s)
+	}
+	out := make([]string, len(list))
+	for i, a := range list {
+		a.Name = printableHeader(a.Name)
+		switch {
+		case a.Name == "":
+			out[i] = a.Address
+		case strings.ContainsAny(a.Name, `()<>[]:;@\,."`):
+			out[i] = `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(a.Name) + `" <` + a.Address + ">"
+		default:
+			out[i] = a.Name + " <" + a.Address + ">"
+		}
+	}
+	return strings.Join(out, ", ")
+}
+
+// partText is the body of a text part converted to UTF-8 from the charset
+// its Content-Type declares. HTML without one is sniffed for a <meta>
+// charset, and undeclared text that isn't UTF-8 is taken as Windows-1252,
+// the usual culprit.
+func partText(part *gmail.MessagePart) string {
+	data := []byte(decodeBody(part.Body.Data))
+	contentType := headerValue(part.Headers, "Content-Type")
+	var label string
+	if _, params, err := mime.ParseMediaType(contentType); err == nil {
+		label = params["charset"]
+	}
+	if strings.EqualFold(label, "us-ascii") {
+		// Often UTF-8 in practice.
+		label = ""
+	}
+	if label == "" && part.MimeType == "text/html" {
+		if _, name, certain := charset.DetermineEncoding(data, contentType); certain || name != "windows-1252" {
+			label = name
+		}
+	}
+	if label == "" {
+		if utf8.Valid(data) {
+			return string(data)
+		}
+		label = "windows-1252"
+	}
+	enc, name := charset.Lookup(label)
+	if enc == nil || name == "utf-8" {
+		return string(data)
+	}
+	decoded, err := enc.NewDecoder().Bytes(data)
+	if err != nil {
+		return string(data)
+	}
+	return string(decoded)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+func TestPartText(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		mimeType    string
+		contentType string
+		data        string
+		want        string
+	}{
+		{"ISO-8859-1", "text/plain", "text/plain; charset=iso-8859-1", "Gr\xfc\xdfe aus K\xf6ln", "Grüße aus Köln"},
+		{"Windows-1252", "text/plain", `text/plain; charset="windows-1252"`, "\x93Quoted\x94 \x80 5", "“Quoted” € 5"},
+		{"Shift_JIS", "text/plain", "text/plain; charset=Shift_JIS", "\x82\xb1\x82\xf1\x82\xc9\x82\xbf\x82\xcd", "こんにちは"},
+		{"GB2312", "text/plain", "text/plain; charset=gb2312", "\xc4\xe3\xba\xc3\xa3\xac\xca\xc0\xbd\xe7", "你好，世界"},
+		{"UTF-8", "text/plain", "text/plain; charset=utf-8", "naïve café", "naïve café"},
+		{"undeclared UTF-8", "text/plain", "text/plain", "naïve café", "naïve café"},
+		{"undeclared 8-bit", "text/plain", "text/plain", "caf\xe9 \x96 bar", "café – bar"},
+		{"us-ascii that is UTF-8", "text/plain", "text/plain; charset=us-ascii", "Zoë", "Zoë"},
+		{"us-ascii that is 8-bit", "text/plain", "text/plain; charset=US-ASCII", "Zo\xeb", "Zoë"},
+		{"unknown charset", "text/plain", "text/plain; charset=x-unheard-of", "plain", "plain"},
+		{"HTML meta charset", "text/html", "text/html",
+			"<html><head><meta charset=\"iso-8859-15\"></head><body>Preis: 5 \xa4</body></html>",
+			`<html><head><meta charset="iso-8859-15"></head><body>Preis: 5 €</body></html>`},
+		{"HTML http-equiv", "text/html", "text/html",
+			"<meta http-equiv=\"Content-Type\" content=\"text/html; charset=shift_jis\"><p>\x93\xfa\x96\x7b</p>",
+			`<meta http-equiv="Content-Type" content="text/html; charset=shift_jis"><p>日本</p>`},
+		{"HTML header beats meta", "text/html", "text/html; charset=utf-8",
+			`<meta charset="iso-8859-1"><p>Grüße</p>`, `<meta charset="iso-8859-1"><p>Grüße</p>`},
+		{"HTML undeclared UTF-8", "text/html", "text/html", "<p>Grüße</p>", "<p>Grüße</p>"},
+	} {
+		part := &gmail.MessagePart{
+			MimeType: tc.mimeType,
+			Headers:  []*gmail.MessagePartHeader{{Name: "Content-Type", Value: tc.contentType}},
+			Body:     &gmail.MessagePartBody{Data: base64.URLEncoding.EncodeToString([]byte(tc.data))},
+		}
+		if got := partText(part); got != tc.want {
+			t.Errorf("%s: partText = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestDecodeHeader(t *testing.T) {
+	for _, tc := range []struct{ in, want string }{
+		{"Plain subject", "Plain subject"},
+		{"=?utf-8?q?Caf=C3=A9_menu?=", "Café menu"},
+		{"=?ISO-8859-1?B?R3L832U=?=", "Grüße"},
+		{"=?shift_jis?b?grGC8YLJgr+CzQ==?=", "こんにちは"},
+		{"=?utf-8?q?split_?= =?utf-8?q?words?=", "split words"},
+		{"Re: =?windows-1252?q?=93hi=94?=", "Re: “hi”"},
+		{"=?x-unheard-of?q?kept?=", "=?x-unheard-of?q?kept?="},
+		{"=?gb2312?b?xOO6ww==?=", "你好"},
+		{"=?utf-8?q?=1B]52;c;aGk=3D=07_hi?=", "�]52;c;aGk=� hi"},
+		{"=?utf-8?q?=C2=9B31m_red?=", "�31m red"},
+		{"=?utf-8?q?two=0Alines?=", "two lines"},
+	} {
+		if got := decodeHeader(tc.in); got != tc.want {
+			t.Errorf("decodeHeader(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestDecodeAddresses(t *testing.T) {
+	for _, tc := range []struct{ in, want string }{
+		{"Ann <ann@example.org>", "Ann <ann@example.org>"},
+		{"=?utf-8?q?Zo=C3=AB_M=C3=BCller?= <zoe@example.org>", "Zoë Müller <zoe@example.org>"},
+		{"=?iso-8859-1?q?M=FCller=2C_J=F6rg?= <jm@example.org>", `"Müller, Jörg" <jm@example.org>`},
+		{`=?utf-8?b?QW5uICJBIiBCLg==?= <ann@example.org>`, `"Ann \"A\" B." <ann@example.org>`},
+		{"=?utf-8?q?Zo=C3=AB?= <zoe@example.org>, bob@example.org", "Zoë <zoe@example.org>, bob@example.org"},
+		{"=?utf-8?q?Bo=C3=AB?= <not an address", "Boë <not an address"},
+		{"=?utf-8?q?Ann=C2=9B2J?= <ann@example.org>", "Ann�2J <ann@example.org>"},
+		{"=?utf-8?q?=1B]0;title=07Ann?= <ann@example.org>", "�]0;title�Ann <ann@example.org>"},
+	} {
+		got := decodeAddresses(tc.in)
+		if got != tc.want {
+			t.Errorf("decodeAddresses(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+		if len(parseAddresses(tc.want)) > 0 && len(parseAddresses(got)) != len(parseAddresses(tc.want)) {
+			t.Errorf("decodeAddresses(%q) = %q, which no longer parses as a list", tc.in, got)
+		}
+	}
+}
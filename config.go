@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// config is the user configuration, read from config.json in the config
+// directory (see resolveConfigFile). CacheSizeMB caps each account's
+// message cache; zero means defaultCacheSizeMB and a negative size turns
+// the cache off. Markdown starts compose and reply in Markdown mode.
+// Opener is a shell command that opens links, which get passed as its
+// last argument; the system's handler is used without it.
+type config struct {
+	DefaultAccount string          `json:"default_account,omitempty"`
+	Credentials    string          `json:"credentials,omitempty"`
+	DataDir        string          `json:"data_dir,omitempty"`
+	CacheDir       string          `json:"cache_dir,omitempty"`
+	DownloadDir    string          `json:"download_dir,omitempty"`
+	CacheSizeMB    int64           `json:"cache_size_mb,omitempty"`
+	Markdown       bool            `json:"markdown,omitempty"`
+	Opener         string          `json:"opener,omitempty"`
+	Accounts       []accountConfig `json:"accounts"`
+}
+
+// accountConfig describes one mailbox. Type selects the backend: "gmail"
+// (the default) authenticates with the OAuth client in Credentials and
+// keeps its token as configured by TokenStore, one of "auto", "keyring",
+// "encrypted" or "file"; "imap" and "maildir" use their own settings.
+type accountConfig struct {
+	Name        string         `json:"name"`
+	Type        string         `json:"type,omitempty"`
+	Credentials string         `json:"credentials,omitempty"`
+	Token       string         `json:"token,omitempty"`
+	TokenStore  string         `json:"token_store,omitempty"`
+	IMAP        *imapConfig    `json:"imap,omitempty"`
+	Maildir     *maildirConfig `json:"maildir,omitempty"`
+	// Addresses are more addresses of the account's owner, left out of
+	// reply-all along with those the backend reports.
+	Addresses []string `json:"addresses,omitempty"`
+	// AuthServers name the servers, by the authserv-id they write in
+	// Authentication-Results, whose sender checks are believed; see
+	// authServers for the default.
+	AuthServers []string `json:"auth_servers,omitempty"`
+	// InternalDomains are the domains of the owner's organization. Mail
+	// from anywhere else is marked external.
+	InternalDomains []string `json:"internal_domains,omitempty"`
+
+	// legacyToken is where versions before the XDG layout kept the token.
+	legacyToken string
+}
+
+// loadConfig reads the config file at path. A missing file is not an
+// error; it yields an empty config that applyDefaults fills in.
+func loadConfig(path string) (*config, error) {
+	cfg := &config{}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return cfg, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read config file: %v", err)
+	}
+	if err := json.Unmarshal(b, cfg); err != nil {
+		return nil, fmt.Errorf("unable to parse config file %s: %v", path, err)
+	}
+	return cfg, nil
+}
+
+// applyDefaults validates the accounts and fills in their credential and
+// token paths. Without any accounts a single "default" account is used.
+func (c *config) applyDefaults(p appPaths) error {
+	if len(c.Accounts) == 0 {
+		c.Accounts = []accountConfig{{Name: "default"}}
+	}
+
+	seen := map[string]bool{}
+	for i := range c.Accounts {
+		ac := &c.Accounts[i]
+		if ac.Name == "" {
+			return fmt.Errorf("account %d has no name", i+1)
+		}
+		if seen[ac.Name] {
+			return fmt.Errorf("duplicate account name %q", ac.Name)
+		}
+		seen[ac.Name] = true
+
+		switch ac.Type {
+		case "", "gmail":
+		case "imap":
+			if err := ac.IMAP.validate(); err != nil {
+				return fmt.Errorf("account %s: %v", ac.Name, err)
+			}
+		case "maildir":
+			if err := ac.Maildir.validate(); err != nil {
+				return fmt.Errorf("account %s: %v", ac.Name, err)
+			}
+			ac.Maildir.Path = p.resolve(ac.Maildir.Path)
+		default:
+			return fmt.Errorf("account %s: unknown type %q", ac.Name, ac.Type)
+		}
+
+		if ac.Credentials == "" {
+			ac.Credentials = p.Credentials
+		}
+		ac.Credentials = p.resolve(ac.Credentials)
+		if ac.Token == "" {
+			ac.Token = filepath.Join(p.DataDir, fmt.Sprintf("token-%s.json", sanitizeFilename(ac.Name)))
+		}
+		ac.Token = p.resolve(ac.Token)
+		ac.legacyToken = legacyTokenPath(ac.Name, len(c.Accounts) == 1)
+	}
+	return nil
+}
+
+// legacyTokenPath is where older versions kept the token: the original
+// ~/.gmail-tui-token.json for single-account setups, one file per account
+// otherwise.
+func legacyTokenPath(name string, only bool) string {
+	if only {
+		return tokenFilePath()
+	}
+	return filepath.Join(homeDir(), fmt.Sprintf(".gmail-tui-token-%s.json", sanitizeFilename(name)))
+}
+
+// accountIndex returns the position of the named account, falling back to
+// the configured default and then to the first account.
+func (c *config) accountIndex(name string) (int, error) {
+	if name == "" {
+		name = c.DefaultAccount
+	}
+	if name == "" {
+		return 0, nil
+	}
+	for i, ac := range c.Accounts {
+		if ac.Name == name {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("no account named %q", name)
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"mime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/bubbles/key"
+	"github.com/charmbracelet/bubbles/list"
+	tea "github.com/charmbracelet/bubbletea"
+	"google.golang.org/api/gmail/v1"
+)
+
+// DraftBackend is implemented by backends that keep drafts on the server.
+type DraftBackend interface {
+	// ListDrafts returns every draft along with the ID of its message.
+	ListDrafts() ([]*gmail.Draft, error)
+	// SaveDraft stores msg as a new draft when id is empty and as the new
+	// content of draft id otherwise.
+	SaveDraft(id string, msg *gmail.Message) (*gmail.Draft, error)
+	// SendDraft sends draft id with msg as its final content, which
+	// removes the draft.
+	SendDraft(id string, msg *gmail.Message) (*gmail.Message, error)
+	DeleteDraft(id string) error
+}
+
+// draftAutosaveInterval is how often the compose screen is saved while
+// it changes.
+const draftAutosaveInterval = 30 * time.Second
+
+// draftSession is the server draft behind one visit to the compose
+// screen. Saves run as commands and can finish in any order: mu makes
+// the first create the draft and the rest update it, and a save that a
+// newer one overtook is dropped.
+type draftSession struct {
+	account string
+	// Threading of a resumed reply.
+	threadID   string
+	inReplyTo  string
+	references string
+
+	// last is the content most recently handed to a save, and seq counts
+	// saves; both belong to the model.
+	last string
+	seq  int
+
+	mu    sync.Mutex
+	id    string
+	saved int // seq of the content on the server
+	sent  bool
+}
+
+type draftTickMsg struct{ session *draftSession }
+
+type draftSavedMsg struct {
+	session *draftSession
+	seq     int
+	auto    bool
+	err     error
+}
+
+// save stores raw as the draft unless a newer save or a send got there
+// first.
+func (s *draftSession) save(b DraftBackend, raw []byte, seq int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sent || seq <= s.saved {
+		return nil
+	}
+	msg := &gmail.Message{Raw: base64.URLEncoding.EncodeToString(raw), ThreadId: s.threadID}
+	d, err := b.SaveDraft(s.id, msg)
+	if s.id != "" && isNotFound(err) {
+		// Deleted elsewhere in the meantime.
+		d, err = b.SaveDraft("", msg)
+	}
+	if err != nil {
+		return err
+	}
+	s.id, s.saved = d.Id, seq
+	return nil
+}
+
+// finish ends the session for a send and returns the draft to send, if
+// one was saved. Saves still queued are dropped.
+func (s *draftSession) finish() string {
+	if s == nil {
+		return ""
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sent = true
+	return s.id
+}
+
+// composeOutgoing is the message on the compose screen.
+func (m model) composeOutgoing() outgoing {
+	out := outgoing{
+		to:          m.composeTo.Value(),
+		cc:          m.composeCc.Value(),
+		bcc:         m.composeBcc.Value(),
+		subject:     m.composeSubj.Value(),
+		body:        m.composeBody.Value(),
+		markdown:    m.markdown,
+		attachments: m.composeAttachments,
+		kept:        m.composeKept,
+		forward:     m.composeForward,
+		draft:       m.draft,
+	}
+	if s := m.draft; s != nil {
+		out.account = s.account
+		// Drafts are saved as they are typed; a From that isn't valid
+		// yet is left to sending to report.
+		from, err := m.senderAddress(s.account, m.composeFrom.Value())
+		if err != nil {
+			from = m.fromAddress(s.account)
+		}
+		out.from = from
+		out.threadID, out.inReplyTo, out.references = s.threadID, s.inReplyTo, s.references
+	}
+	return out
+}
+
+// fingerprint tells whether the compose screen changed since a save.
+func (out outgoing) fingerprint() string {
+	return fmt.Sprintf("%q %q %q %q %q %q %t %q %d", out.from, out.to, out.cc, out.bcc, out.subject, out.body, out.markdown, out.attachments, len(out.kept))
+}
+
+// watchDraft takes the compose screen as it is now as the baseline, so
+// that leaving it untouched saves nothing, and starts auto-saving.
+func (m *model) watchDraft() tea.Cmd {
+	m.draft.last = m.composeOutgoing().fingerprint()
+	return draftTick(m.draft)
+}
+
+func draftTick(s *draftSession) tea.Cmd {
+	return tea.Tick(draftAutosaveInterval, func(time.Time) tea.Msg { return draftTickMsg{session: s} })
+}
+
+// saveDraft saves the compose screen if it changed since the last save.
+// Accounts without server drafts keep nothing.
+func (m *model) saveDraft(auto bool) tea.Cmd {
+	s := m.draft
+	if s == nil {
+		return nil
+	}
+	b := m.backend(s.account)
+	db, ok := capability[DraftBackend](b)
+	if !ok {
+		return nil
+	}
+	out := m.composeOutgoing()
+	fp := out.fingerprint()
+	if fp == s.last {
+		if !auto && s.seq > 0 {
+			return showNotification("Draft saved")
+		}
+		return nil
+	}
+	s.last = fp
+	s.seq++
+	seq := s.seq
+	return func() tea.Msg {
+		raw, err := buildMessage(b, out)
+		if err == nil {
+			err = s.save(db, raw, seq)
+		}
+		return draftSavedMsg{session: s, seq: seq, auto: auto, err: err}
+	}
+}
+
+func (m *model) draftSaved(msg draftSavedMsg) tea.Cmd {
+	if msg.err != nil {
+		if msg.seq == msg.session.seq {
+			// Try again on the next tick.
+			msg.session.last = ""
+		}
+		return showStatus(severityWarning, "Couldn't save the draft: "+errorText(msg.err))
+	}
+	if msg.auto {
+		return nil
+	}
+	return showNotification("Draft saved")
+}
+
+// draftItem is a row on the drafts screen.
+type draftItem struct {
+	id  string
+	msg emailItem
+}
+
+func (d draftItem) Title() string { return firstNonEmpty(d.msg.subject, "(no subject)") }
+
+func (d draftItem) Description() string {
+	return fmt.Sprintf("To: %s · %s", firstNonEmpty(d.msg.recipient, "(nobody yet)"), d.msg.date)
+}
+
+func (d draftItem) FilterValue() string { return d.msg.subject + " " + d.msg.recipient }
+
+type draftsLoadedMsg struct {
+	account string
+	items   []list.Item
+}
+
+type draftResumedMsg struct {
+	account string
+	id      string
+	msg     *gmail.Message
+	kept    []mimePart
+}
+
+func loadDrafts(acct *account) tea.Cmd {
+	db, ok := capability[DraftBackend](acct.backend)
+	if !ok {
+		return showStatus(severityWarning, fmt.Sprintf("%s doesn't keep drafts on the server", acct.name))
+	}
+	return func() tea.Msg {
+		drafts, err := db.ListDrafts()
+		if err != nil {
+			return emailLoadErrorMsg{err: fmt.Errorf("failed to list drafts: %w", err)}
+		}
+		byMessage := make(map[string]string, len(drafts))
+		ids := make([]string, 0, len(drafts))
+		for _, d := range drafts {
+			if d.Message == nil {
+				continue
+			}
+			byMessage[d.Message.Id] = d.Id
+			ids = append(ids, d.Message.Id)
+		}
+		var items []list.Item
+		for _, it := range fetchItems(acct.backend, acct.name, ids) {
+			items = append(items, draftItem{id: byMessage[it.id], msg: it})
+		}
+		return draftsLoadedMsg{account: acct.name, items: items}
+	}
+}
+
+// resumeDraft fetches a draft with its attachments for the compose
+// screen.
+func resumeDraft(acct *account, d draftItem) tea.Cmd {
+	return func() tea.Msg {
+		msg, err := acct.backend.GetMessage(d.msg.id, "full")
+		if err != nil {
+			return emailLoadErrorMsg{err: fmt.Errorf("failed to load the draft: %w", err)}
+		}
+		item := newEmailItem(msg)
+		item.account = acct.name
+		kept, err := attachmentParts(acct.backend, item)
+		if err != nil {
+			return emailLoadErrorMsg{err: err}
+		}
+		return draftResumedMsg{account: acct.name, id: d.id, msg: msg, kept: kept}
+	}
+}
+
+func deleteDraft(acct *account, id string) tea.Cmd {
+	db, ok := capability[DraftBackend](acct.backend)
+	if !ok {
+		return nil
+	}
+	return func() tea.Msg {
+		if err := db.DeleteDraft(id); err != nil && !isNotFound(err) {
+			return notificationMsg{message: "Couldn't delete the draft: " + errorText(err), level: severityError}
+		}
+		return nil
+	}
+}
+
+func (m *model) openDrafts(items []list.Item) {
+	m.draftsList = list.New(items, list.NewDefaultDelegate(), m.width, m.height-4)
+	m.draftsList.Title = "Drafts"
+	m.draftsList.SetShowHelp(false)
+	m.draftsList.SetStatusBarItemName("draft", "drafts")
+	m.draftsList.DisableQuitKeybindings()
+	m.state = viewingDrafts
+}
+
+// resumeDraftLoaded fills the compose screen from a resumed draft; later
+// saves update that draft and sending it sends the draft.
+func (m *model) resumeDraftLoaded(msg draftResumedMsg) tea.Cmd {
+	m.resetCompose()
+	h := msg.msg.Payload.Headers
+	m.draft.account = msg.account
+	m.draft.id = msg.id
+	m.draft.threadID = msg.msg.ThreadId
+	m.draft.inReplyTo = headerValue(h, "In-Reply-To")
+	m.draft.references = headerValue(h, "References")
+	m.composeFrom.SetValue(firstNonEmpty(decodeAddresses(headerValue(h, "From")), m.fromAddress(msg.account)))
+	m.composeTo.SetValue(decodeAddresses(headerValue(h, "To")))
+	m.composeCc.SetValue(decodeAddresses(headerValue(h, "Cc")))
+	m.composeBcc.SetValue(decodeAddresses(headerValue(h, "Bcc")))
+	m.composeSubj.SetValue(decodeHeader(headerValue(h, "Subject")))
+	m.composeBody.SetValue(strings.TrimRight(extractPlainText(msg.msg.Payload), "\r\n"))
+	m.composeKept = msg.kept
+	m.state = composing
+	m.focused = 1
+	return tea.Batch(m.focusComposeField(), m.watchDraft())
+}
+
+func updateDrafts(msg tea.Msg, m model) (tea.Model, tea.Cmd) {
+	if msg, ok := msg.(tea.KeyMsg); ok && m.draftsList.FilterState() != list.Filtering {
+		selected, _ := m.draftsList.SelectedItem().(draftItem)
+		switch {
+		case key.Matches(msg, keys.Back):
+			m.state = inbox
+			return m, nil
+
+		case key.Matches(msg, keys.Select):
+			if selected.id == "" {
+				return m, nil
+			}
+			m.state = loading
+			return m, resumeDraft(m.currentAccount(), selected)
+
+		case key.Matches(msg, keys.Delete):
+			if selected.id == "" {
+				return m, nil
+			}
+			m.draftsList.RemoveItem(m.draftsList.Index())
+			return m, deleteDraft(m.currentAccount(), selected.id)
+
+		case key.Matches(msg, keys.Quit):
+			return m, tea.Quit
+		}
+	}
+	var cmd tea.Cmd
+	m.draftsList, cmd = m.draftsList.Update(msg)
+	return m, cmd
+}
+
+func draftsView(m model) string {
+	if len(m.draftsList.Items()) == 0 {
+		return "\n  Drafts\n\n  No drafts.\n\n[b] back\n"
+	}
+	return m.draftsList.View() + "\n[enter] resume • [d] delete • [b] back\n"
+}
+
+// filename is the name a part is attached under.
+func (p mimePart) filename() string {
+	if _, params, err := mime.ParseMediaType(p.header.Get("Content-Disposition")); err == nil && params["filename"] != "" {
+		return params["filename"]
+	}
+	if _, params, err := mime.ParseMediaType(p.header.Get("Content-Type")); err == nil && params["name"] != "" {
+		return params["name"]
+	}
+	return "attachment"
+}
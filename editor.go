@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// draftFields are the parts of a message that can be edited in $EDITOR.
+type draftFields struct {
+	to, cc, bcc, subject string
+	body                 string
+}
+
+// editorFinishedMsg carries the edited draft back once the editor exits.
+type editorFinishedMsg struct {
+	reply  bool
+	fields draftFields
+	err    error
+}
+
+// editorCommand is $VISUAL or $EDITOR, falling back to vi.
+func editorCommand() []string {
+	for _, env := range []string{"VISUAL", "EDITOR"} {
+		if args := strings.Fields(os.Getenv(env)); len(args) > 0 {
+			return args
+		}
+	}
+	return []string{"vi"}
+}
+
+// formatDraft lays f out as a header block, a blank line and the body.
+func formatDraft(f draftFields) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "To: %s\nCc: %s\nBcc: %s\nSubject: %s\n\n", f.to, f.cc, f.bcc, f.subject)
+	b.WriteString(f.body)
+	return b.Bytes()
+}
+
+// parseDraft reads back a file written by formatDraft. Headers other than
+// To, Cc, Bcc and Subject are ignored.
+func parseDraft(data []byte) (draftFields, error) {
+	r := bufio.NewReader(bytes.NewReader(data))
+	var f draftFields
+	for {
+		line, err := r.ReadString('\n')
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return draftFields{}, fmt.Errorf("expected a header line, got %q; leave a blank line before the body", line)
+		}
+		value = strings.TrimSpace(value)
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "to":
+			f.to = value
+		case "cc":
+			f.cc = value
+		case "bcc":
+			f.bcc = value
+		case "subject":
+			f.subject = value
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	body, _ := io.ReadAll(r)
+	f.body = string(body)
+	return f, nil
+}
+
+// editInEditor suspends the TUI and opens f in the user's editor.
+func editInEditor(f draftFields, reply bool) tea.Cmd {
+	tmp, err := os.CreateTemp("", "gmail-tui-*.eml")
+	if err != nil {
+		return showStatus(severityError, "Couldn't create a file for the editor: "+err.Error())
+	}
+	_, err = tmp.Write(formatDraft(f))
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return showStatus(severityError, "Couldn't write the draft for the editor: "+err.Error())
+	}
+
+	args := editorCommand()
+	cmd := exec.Command(args[0], append(args[1:], tmp.Name())...)
+	return tea.ExecProcess(cmd, func(err error) tea.Msg {
+		defer os.Remove(tmp.Name())
+		if err != nil {
+			return editorFinishedMsg{reply: reply, err: fmt.Errorf("editor %s failed: %w", args[0], err)}
+		}
+		data, err := os.ReadFile(tmp.Name())
+		if err != nil {
+			return editorFinishedMsg{reply: reply, err: err}
+		}
+		fields, err := parseDraft(data)
+		return editorFinishedMsg{reply: reply, fields: fields, err: err}
+	})
+}
+
+// editDraft opens the message being composed or replied to in $EDITOR.
+func (m *model) editDraft() tea.Cmd {
+	if m.state == replying {
+		return editInEditor(draftFields{
+			to:      m.reply.to,
+			cc:      m.reply.cc,
+			bcc:     m.reply.bcc,
+			subject: m.reply.subject,
+			body:    m.replyBody.Value(),
+		}, true)
+	}
+	return editInEditor(draftFields{
+		to:      m.composeTo.Value(),
+		cc:      m.composeCc.Value(),
+		bcc:     m.composeBcc.Value(),
+		subject: m.composeSubj.Value(),
+		body:    m.composeBody.Value(),
+	}, false)
+}
+
+// applyEditedDraft copies the editor's result into the compose or reply
+// fields.
+func (m *model) applyEditedDraft(msg editorFinishedMsg) tea.Cmd {
+	if msg.err != nil {
+		return showStatus(severityError, msg.err.Error())
+	}
+	f := msg.fields
+	body := strings.TrimRight(f.body, "\n")
+	if msg.reply {
+		m.reply.to, m.reply.cc, m.reply.bcc, m.reply.subject = f.to, f.cc, f.bcc, f.subject
+		m.replyBody.SetValue(body)
+		return nil
+	}
+	m.composeTo.SetValue(f.to)
+	m.composeCc.SetValue(f.cc)
+	m.composeBcc.SetValue(f.bcc)
+	m.composeSubj.SetValue(f.subject)
+	m.composeBody.SetValue(body)
+	return nil
+}
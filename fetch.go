@@ -0,0 +1,180 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/charmbracelet/bubbles/list"
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// listHeaders are the headers a list row needs; rows are fetched with
+// Format("metadata") so bodies and attachments aren't downloaded.
+var listHeaders = []string{"Subject", "From", "To", "Cc", "Bcc", "Date"}
+
+// fetchWorkers bounds the number of concurrent Messages.Get calls, which
+// keeps a page load well under Gmail's per-user rate limits.
+const fetchWorkers = 8
+
+// rowResult is the list row for the ID at index in the requested page.
+// item is nil if it couldn't be fetched.
+type rowResult struct {
+	index int
+	item  list.Item
+}
+
+// rowFetcher builds the list row for one message or thread ID.
+type rowFetcher func(id string) list.Item
+
+func messageRow(b MailBackend, account string) rowFetcher {
+	return func(id string) list.Item {
+		item := createEmailItem(b, id, "metadata")
+		if item == nil {
+			return nil
+		}
+		item.account = account
+		return *item
+	}
+}
+
+// fetchRows runs fetch for every ID on a bounded pool of workers. Rows
+// are sent as they arrive, in no particular order, and the channel is
+// closed once every ID has been handled. The channel is buffered for the
+// whole page so abandoned fetches never block.
+func fetchRows(ids []string, fetch rowFetcher) <-chan rowResult {
+	out := make(chan rowResult, len(ids))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < min(fetchWorkers, len(ids)); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				out <- rowResult{index: i, item: fetch(ids[i])}
+			}
+		}()
+	}
+	go func() {
+		for i := range ids {
+			jobs <- i
+		}
+		close(jobs)
+		wg.Wait()
+		close(out)
+	}()
+	return out
+}
+
+// fetchItems is fetchRows for callers that need a whole page of messages
+// at once. Rows keep the order of ids; failed ones are dropped.
+func fetchItems(b MailBackend, account string, ids []string) []emailItem {
+	rows := make([]list.Item, len(ids))
+	for r := range fetchRows(ids, messageRow(b, account)) {
+		rows[r.index] = r.item
+	}
+	var items []emailItem
+	for _, item := range rows {
+		if item != nil {
+			items = append(items, item.(emailItem))
+		}
+	}
+	return items
+}
+
+// rowID returns the message or thread ID behind a list row.
+func rowID(it list.Item) string {
+	switch it := it.(type) {
+	case emailItem:
+		return it.id
+	case threadItem:
+		return it.id
+	}
+	return ""
+}
+
+// rowStream inserts the rows of one page into the visible list as they
+// arrive. base and placed are only touched from Update.
+type rowStream struct {
+	results <-chan rowResult
+	base    int    // list index of the page's first row
+	placed  []bool // rows of the page already in the list
+}
+
+type rowsArrivedMsg struct {
+	stream *rowStream
+	rows   []rowResult
+	done   bool
+}
+
+// next waits for at least one row and then takes whatever else is ready,
+// so a fast backend doesn't cost one Update per row.
+func (s *rowStream) next() tea.Cmd {
+	return func() tea.Msg {
+		r, ok := <-s.results
+		if !ok {
+			return rowsArrivedMsg{stream: s, done: true}
+		}
+		rows := []rowResult{r}
+		for {
+			select {
+			case r, ok := <-s.results:
+				if !ok {
+					return rowsArrivedMsg{stream: s, rows: rows, done: true}
+				}
+				rows = append(rows, r)
+			default:
+				return rowsArrivedMsg{stream: s, rows: rows}
+			}
+		}
+	}
+}
+
+// streamRows starts fetching rows for ids, messages or threads as m.pager
+// says, and appends them to m.list as they come in. It replaces any stream
+// still running for an older list.
+func (m *model) streamRows(ids []string) tea.Cmd {
+	if len(ids) == 0 {
+		m.rows = nil
+		return nil
+	}
+	account := m.pager.account
+	fetch := messageRow(m.backend(account), account)
+	if m.pager.threads {
+		tb, _ := capability[ThreadBackend](m.backend(account))
+		fetch = threadRow(tb, account)
+	}
+	m.rows = &rowStream{
+		results: fetchRows(ids, fetch),
+		base:    len(m.list.Items()),
+		placed:  make([]bool, len(ids)),
+	}
+	return m.rows.next()
+}
+
+func (m *model) insertRows(msg rowsArrivedMsg) tea.Cmd {
+	s := msg.stream
+	if s != m.rows {
+		return nil
+	}
+	var cmds []tea.Cmd
+	for _, r := range msg.rows {
+		if r.item == nil {
+			continue
+		}
+		pos := s.base
+		for _, p := range s.placed[:r.index] {
+			if p {
+				pos++
+			}
+		}
+		s.placed[r.index] = true
+		cmds = append(cmds, m.list.InsertItem(pos, r.item))
+	}
+	setListStatus(&m.list, m.pager)
+	if msg.done {
+		m.rows = nil
+		cmds = append(cmds, m.loadMoreIfNeeded())
+	} else {
+		cmds = append(cmds, s.next())
+	}
+	return tea.Batch(cmds...)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strings"
+
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
+)
+
+// gmailBackend is the MailBackend for the Gmail REST API.
+type gmailBackend struct {
+	srv *gmail.Service
+}
+
+func newGmailBackend(srv *gmail.Service) *gmailBackend {
+	return &gmailBackend{srv: srv}
+}
+
+func (g *gmailBackend) ListMessages(query string, labelIDs []string, pageToken string, max int64) (*gmail.ListMessagesResponse, error) {
+	call := g.srv.Users.Messages.List("me").MaxResults(max)
+	if query != "" {
+		call = call.Q(query)
+	}
+	if len(labelIDs) > 0 {
+		call = call.LabelIds(labelIDs...)
+	}
+	if pageToken != "" {
+		call = call.PageToken(pageToken)
+	}
+	return call.Do()
+}
+
+func (g *gmailBackend) GetMessage(id, format string, metadataHeaders ...string) (*gmail.Message, error) {
+	call := g.srv.Users.Messages.Get("me", id).Format(format)
+	if len(metadataHeaders) > 0 {
+		call = call.MetadataHeaders(metadataHeaders...)
+	}
+	return call.Do()
+}
+
+func (g *gmailBackend) SendMessage(msg *gmail.Message) (*gmail.Message, error) {
+	return g.srv.Users.Messages.Send("me", msg).Do()
+}
+
+func (g *gmailBackend) ModifyMessage(id string, addLabelIDs, removeLabelIDs []string) error {
+	_, err := g.srv.Users.Messages.Modify("me", id, &gmail.ModifyMessageRequest{
+		AddLabelIds:    addLabelIDs,
+		RemoveLabelIds: removeLabelIDs,
+	}).Do()
+	return err
+}
+
+func (g *gmailBackend) TrashMessage(id string) error {
+	_, err := g.srv.Users.Messages.Trash("me", id).Do()
+	return err
+}
+
+func (g *gmailBackend) ListLabels() ([]*gmail.Label, error) {
+	labels, err := g.srv.Users.Labels.List("me").Do()
+	if err != nil {
+		return nil, err
+	}
+	return labels.Labels, nil
+}
+
+func (g *gmailBackend) GetAttachment(msgID, attachmentID string) ([]byte, error) {
+	att, err := g.srv.Users.Messages.Attachments.Get("me", msgID, attachmentID).Do()
+	if err != nil {
+		return nil, err
+	}
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(att.Data, "="))
+}
+
+func (g *gmailBackend) ListThreads(query string, labelIDs []string, pageToken string, max int64) (*gmail.ListThreadsResponse, error) {
+	call := g.srv.Users.Threads.List("me").MaxResults(max)
+	if query != "" {
+		call = call.Q(query)
+	}
+	if len(labelIDs) > 0 {
+		call = call.LabelIds(labelIDs...)
+	}
+	if pageToken != "" {
+		call = call.PageToken(pageToken)
+	}
+	return call.Do()
+}
+
+func (g *gmailBackend) GetThread(id, format string, metadataHeaders ...string) (*gmail.Thread, error) {
+	call := g.srv.Users.Threads.Get("me", id).Format(format)
+	if len(metadataHeaders) > 0 {
+		call = call.MetadataHeaders(metadataHeaders...)
+	}
+	return call.Do()
+}
+
+func (g *gmailBackend) ModifyThread(id string, addLabelIDs, removeLabelIDs []string) error {
+	_, err := g.srv.Users.Threads.Modify("me", id, &gmail.ModifyThreadRequest{
+		AddLabelIds:    addLabelIDs,
+		RemoveLabelIds: removeLabelIDs,
+	}).Do()
+	return err
+}
+
+func (g *gmailBackend) TrashThread(id string) error {
+	_, err := g.srv.Users.Threads.Trash("me", id).Do()
+	return err
+}
+
+// Addresses returns the account's address along with its send-as aliases.
+func (g *gmailBackend) Addresses() ([]string, error) {
+	profile, err := g.srv.Users.GetProfile("me").Do()
+	if err != nil {
+		return nil, err
+	}
+	addrs := []string{profile.EmailAddress}
+	aliases, err := g.srv.Users.Settings.SendAs.List("me").Do()
+	if err != nil {
+		return addrs, nil
+	}
+	for _, a := range aliases.SendAs {
+		if !containsFold(addrs, a.SendAsEmail) {
+			addrs = append(addrs, a.SendAsEmail)
+		}
+	}
+	return addrs, nil
+}
+
+func (g *gmailBackend) HistoryID() (uint64, error) {
+	profile, err := g.srv.Users.GetProfile("me").Do()
+	if err != nil {
+		return 0, err
+	}
+	return profile.HistoryId, nil
+}
+
+// ListHistory maps Gmail's 404 for a start ID that is too old to
+// errHistoryExpired.
+func (g *gmailBackend) ListHistory(startHistoryID uint64, pageToken string) (*gmail.ListHistoryResponse, error) {
+	call := g.srv.Users.History.List("me").StartHistoryId(startHistoryID)
+	if pageToken != "" {
+		call = call.PageToken(pageToken)
+	}
+	resp, err := call.Do()
+	var gerr *googleapi.Error
+	if errors.As(err, &gerr) && gerr.Code == http.StatusNotFound {
+		return nil, errHistoryExpired
+	}
+	return resp, err
+}
+
+func (g *gmailBackend) ListDrafts() ([]*gmail.Draft, error) {
+	var drafts []*gmail.Draft
+	call := g.srv.Users.Drafts.List("me")
+	for {
+		resp, err := call.Do()
+		if err != nil {
+			return nil, err
+		}
+		drafts = append(drafts, resp.Drafts...)
+		if resp.NextPageToken == "" {
+			return drafts, nil
+		}
+		call = call.PageToken(resp.NextPageToken)
+	}
+}
+
+func (g *gmailBackend) SaveDraft(id string, msg *gmail.Message) (*gmail.Draft, error) {
+	if id == "" {
+		return g.srv.Users.Drafts.Create("me", &gmail.Draft{Message: msg}).Do()
+	}
+	return g.srv.Users.Drafts.Update("me", id, &gmail.Draft{Id: id, Message: msg}).Do()
+}
+
+func (g *gmailBackend) SendDraft(id string, msg *gmail.Message) (*gmail.Message, error) {
+	return g.srv.Users.Drafts.Send("me", &gmail.Draft{Id: id, Message: msg}).Do()
+}
+
+func (g *gmailBackend) DeleteDraft(id string) error {
+	return g.srv.Users.Drafts.Delete("me", id).Do()
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/charmbracelet/bubbles/list"
+	tea "github.com/charmbracelet/bubbletea"
+	"google.golang.org/api/gmail/v1"
+)
+
+// HistoryBackend is implemented by backends that can report what changed
+// in the mailbox since a given point, as Gmail's History API does.
+type HistoryBackend interface {
+	// HistoryID returns the ID of the mailbox's latest history record.
+	HistoryID() (uint64, error)
+	// ListHistory returns one page of changes after startHistoryID. It
+	// fails with errHistoryExpired once that ID is too old to replay.
+	ListHistory(startHistoryID uint64, pageToken string) (*gmail.ListHistoryResponse, error)
+}
+
+var errHistoryExpired = errors.New("history ID has expired")
+
+const (
+	// pollInterval is how often accounts are checked for new mail.
+	pollInterval = 30 * time.Second
+	// maxHistoryChanges is the most changed messages applied as deltas;
+	// beyond that a full resync is cheaper.
+	maxHistoryChanges = 200
+)
+
+type pollTickMsg struct{}
+
+func schedulePoll() tea.Cmd {
+	return tea.Tick(pollInterval, func(time.Time) tea.Msg { return pollTickMsg{} })
+}
+
+// mailboxDelta is the current state of every message touched since the
+// last poll. Rows are refetched rather than patched from the history
+// records, whose messages usually carry only IDs.
+type mailboxDelta struct {
+	rows        map[string]emailItem
+	deleted     map[string]bool
+	threads     map[string]threadItem // only in conversation mode
+	goneThreads map[string]bool
+}
+
+// historyMsg reports one poll of an account. A zero start ID only
+// establishes the baseline; resync means the deltas couldn't be replayed
+// and the account's lists must be reloaded.
+type historyMsg struct {
+	account   string
+	start     uint64
+	historyID uint64
+	delta     mailboxDelta
+	resync    bool
+	err       error
+}
+
+func fetchHistory(acct *account, start uint64, threads bool) tea.Cmd {
+	return func() tea.Msg {
+		hb, _ := capability[HistoryBackend](acct.backend)
+		msg := historyMsg{account: acct.name, start: start}
+		if start == 0 {
+			msg.historyID, msg.err = hb.HistoryID()
+			return msg
+		}
+
+		var records []*gmail.History
+		token := ""
+		for {
+			resp, err := hb.ListHistory(start, token)
+			if errors.Is(err, errHistoryExpired) {
+				msg.historyID, msg.err = hb.HistoryID()
+				msg.resync = true
+				return msg
+			}
+			if err != nil {
+				msg.err = err
+				return msg
+			}
+			records = append(records, resp.History...)
+			msg.historyID = resp.HistoryId
+			if token = resp.NextPageToken; token == "" {
+				break
+			}
+		}
+
+		changed := make(map[string]bool)
+		threadIDs := make(map[string]bool)
+		d := mailboxDelta{deleted: make(map[string]bool)}
+		touch := func(m *gmail.Message) {
+			if m == nil {
+				return
+			}
+			changed[m.Id] = true
+			delete(d.deleted, m.Id)
+			if m.ThreadId != "" {
+				threadIDs[m.ThreadId] = true
+			}
+		}
+		for _, h := range records {
+			for _, a := range h.MessagesAdded {
+				touch(a.Message)
+			}
+			for _, a := range h.LabelsAdded {
+				touch(a.Message)
+			}
+			for _, r := range h.LabelsRemoved {
+				touch(r.Message)
+			}
+			for _, del := range h.MessagesDeleted {
+				if del.Message != nil {
+					delete(changed, del.Message.Id)
+					d.deleted[del.Message.Id] = true
+					if del.Message.ThreadId != "" {
+						threadIDs[del.Message.ThreadId] = true
+					}
+				}
+			}
+		}
+		// Rows served from the cache may predate changes made while the
+		// app wasn't running, which no history record here covers.
+		if hc, ok := capability[historyCache](acct.backend); ok {
+			hc.applyHistory(records)
+			rechecked, gone := hc.recheck()
+			for _, m := range rechecked {
+				touch(m)
+			}
+			for _, id := range gone {
+				delete(changed, id)
+				d.deleted[id] = true
+			}
+		}
+		if len(changed)+len(d.deleted) > maxHistoryChanges {
+			msg.resync = true
+			return msg
+		}
+
+		var ids []string
+		for id := range changed {
+			ids = append(ids, id)
+		}
+		d.rows = make(map[string]emailItem)
+		for _, item := range fetchItems(acct.backend, acct.name, ids) {
+			d.rows[item.id] = item
+		}
+
+		if tb, ok := capability[ThreadBackend](acct.backend); ok && threads {
+			d.threads = make(map[string]threadItem)
+			d.goneThreads = make(map[string]bool)
+			fetch := threadRow(tb, acct.name)
+			for tid := range threadIDs {
+				if row := fetch(tid); row != nil {
+					d.threads[tid] = row.(threadItem)
+				} else {
+					d.goneThreads[tid] = true
+				}
+			}
+		}
+		msg.delta = d
+		return msg
+	}
+}
+
+// pollHistory starts a poll for every account that supports history and
+// isn't already being polled.
+func (m model) pollHistory() tea.Cmd {
+	var cmds []tea.Cmd
+	for _, a := range m.accounts {
+		if _, ok := capability[HistoryBackend](a.backend); !ok || a.polling {
+			continue
+		}
+		threads := a.pager.threads
+		if a == m.currentAccount() && !m.unified {
+			threads = m.pager.threads
+		}
+		a.polling = true
+		cmds = append(cmds, fetchHistory(a, a.historyID, threads))
+	}
+	return tea.Batch(cmds...)
+}
+
+// applyHistory merges a poll result into every list showing the account.
+func (m *model) applyHistory(msg historyMsg) tea.Cmd {
+	var acct *account
+	for _, a := range m.accounts {
+		if a.name == msg.account {
+			acct = a
+		}
+	}
+	if acct == nil {
+		return nil
+	}
+	acct.polling = false
+	if msg.err != nil || msg.start != acct.historyID {
+		return nil
+	}
+	visible := acct == m.currentAccount() || m.unified
+	if msg.start != 0 && visible && m.rows != nil {
+		// Rows are still streaming in at fixed positions; try again on
+		// the next tick.
+		return nil
+	}
+	acct.historyID = msg.historyID
+	if msg.start == 0 {
+		return nil
+	}
+	if msg.resync {
+		return m.resync(acct)
+	}
+
+	if acct != m.currentAccount() || m.unified {
+		applyDelta(&acct.list, acct.pager, false, acct.name, msg.delta)
+	}
+	if visible {
+		applyDelta(&m.list, m.pager, m.unified, acct.name, msg.delta)
+		setListStatus(&m.list, m.pager)
+		return m.loadMoreIfNeeded()
+	}
+	return nil
+}
+
+// resync reloads the account's visible list from scratch; a stored list
+// is reloaded the next time the account is opened.
+func (m *model) resync(acct *account) tea.Cmd {
+	switch {
+	case m.unified:
+		acct.loaded = false
+		return loadUnifiedInbox(m.accounts)
+	case acct == m.currentAccount():
+		p := m.pager
+		p.account = acct.name
+		return func() tea.Msg {
+			msg := loadFirstPage(acct.backend, p)()
+			if r, ok := msg.(searchResultMsg); ok {
+				r.refresh = true
+				return r
+			}
+			return msg
+		}
+	default:
+		acct.loaded = false
+		return nil
+	}
+}
+
+// accepts reports whether a message or thread with labels belongs in a
+// list loaded by p. known is false for searches, whose matches can only
+// be decided by the server; those lists are only updated in place.
+func (p listPager) accepts(unified bool, labels []string) (ok, known bool) {
+	switch {
+	case unified || (p.query == inboxQuery && len(p.labelIDs) == 0):
+		if !slices.Contains(labels, "INBOX") {
+			return false, true
+		}
+		for _, tab := range []string{"CATEGORY_SOCIAL", "CATEGORY_PROMOTIONS", "CATEGORY_UPDATES", "CATEGORY_FORUMS"} {
+			if slices.Contains(labels, tab) {
+				return false, true
+			}
+		}
+		return true, true
+	case p.query == "" && len(p.labelIDs) > 0:
+		return hasAllLabels(labels, p.labelIDs), true
+	}
+	return false, false
+}
+
+// applyDelta updates the rows of account in l: deleted messages and ones
+// that no longer match are dropped, changed ones are replaced, and new
+// matches are inserted by date. New matches older than every loaded row
+// are left to paging while there are pages to come, as they would end
+// up above them. The selected row stays selected.
+func applyDelta(l *list.Model, p listPager, unified bool, account string, d mailboxDelta) {
+	selected := ""
+	if it := l.SelectedItem(); it != nil {
+		selected = rowID(it)
+	}
+
+	var kept, moved []list.Item
+	present := make(map[string]bool)
+	for _, it := range l.Items() {
+		switch row := it.(type) {
+		case emailItem:
+			if row.account != account || p.threads {
+				break
+			}
+			if d.deleted[row.id] {
+				continue
+			}
+			if fresh, ok := d.rows[row.id]; ok {
+				if ok, known := p.accepts(unified, fresh.labels); known && !ok {
+					continue
+				}
+				fresh.showAccount = row.showAccount
+				it = fresh
+			}
+			present[row.id] = true
+
+		case threadItem:
+			if row.account != account || !p.threads {
+				break
+			}
+			if d.goneThreads[row.id] {
+				continue
+			}
+			if fresh, ok := d.threads[row.id]; ok {
+				if ok, known := p.accepts(unified, fresh.labels); known && !ok {
+					continue
+				}
+				present[row.id] = true
+				fresh.showAccount = row.showAccount
+				if fresh.timestamp != row.timestamp {
+					// New replies move the conversation up.
+					moved = append(moved, fresh)
+					continue
+				}
+				it = fresh
+			}
+			present[row.id] = true
+		}
+		kept = append(kept, it)
+	}
+
+	// unpaged tells whether a new match belongs to a page not yet loaded.
+	unpaged := func(list.Item) bool { return false }
+	if !unified && p.nextToken != "" && len(kept) > 0 {
+		oldest := rowTimestamp(kept[0])
+		for _, it := range kept {
+			oldest = min(oldest, rowTimestamp(it))
+		}
+		unpaged = func(it list.Item) bool { return rowTimestamp(it) < oldest }
+	}
+
+	if p.threads {
+		for id, row := range d.threads {
+			if ok, known := p.accepts(unified, row.labels); !present[id] && ok && known && !unpaged(row) {
+				row.showAccount = unified
+				moved = append(moved, row)
+			}
+		}
+	} else {
+		for id, row := range d.rows {
+			if ok, known := p.accepts(unified, row.labels); !present[id] && ok && known && !unpaged(row) {
+				row.showAccount = unified
+				moved = append(moved, row)
+			}
+		}
+	}
+
+	sort.Slice(moved, func(i, j int) bool { return rowTimestamp(moved[i]) > rowTimestamp(moved[j]) })
+	items := kept
+	for _, it := range moved {
+		at := sort.Search(len(items), func(i int) bool { return rowTimestamp(items[i]) < rowTimestamp(it) })
+		items = slices.Insert(items, at, it)
+	}
+	l.SetItems(items)
+	for i, it := range items {
+		if rowID(it) == selected {
+			l.Select(i)
+			break
+		}
+	}
+}
+
+func rowTimestamp(it list.Item) int64 {
+	switch it := it.(type) {
+	case emailItem:
+		return it.timestamp
+	case threadItem:
+		return it.timestamp
+	}
+	return 0
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/charmbracelet/bubbles/list"
+)
+
+func TestApplyDeltaLeavesOlderMatchesToPaging(t *testing.T) {
+	row := func(id string, ts int64) emailItem {
+		return emailItem{id: id, account: "test", subject: id, timestamp: ts, labels: []string{"INBOX"}}
+	}
+	ids := func(l list.Model) []string {
+		var ids []string
+		for _, it := range l.Items() {
+			ids = append(ids, rowID(it))
+		}
+		return ids
+	}
+	delta := mailboxDelta{rows: map[string]emailItem{
+		"new":     row("new", 300),
+		"between": row("between", 150),
+		"old":     row("old", 50),
+	}}
+
+	// With more pages to load, the old message is one of theirs.
+	l := newEmailList("Inbox", []list.Item{row("b", 200), row("a", 100)})
+	p := listPager{account: "test", query: inboxQuery, nextToken: "page-2"}
+	applyDelta(&l, p, false, "test", delta)
+	if got, want := ids(l), []string{"new", "b", "between", "a"}; !slices.Equal(got, want) {
+		t.Errorf("with pages to come, rows are %q, want %q", got, want)
+	}
+
+	// On the last page it goes at the end.
+	l = newEmailList("Inbox", []list.Item{row("b", 200), row("a", 100)})
+	p.nextToken = ""
+	applyDelta(&l, p, false, "test", delta)
+	if got, want := ids(l), []string{"new", "b", "between", "a", "old"}; !slices.Equal(got, want) {
+		t.Errorf("with every page loaded, rows are %q, want %q", got, want)
+	}
+}
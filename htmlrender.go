@@ -0,0 +1,518 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/charmbracelet/lipgloss"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// renderHTML lays out an HTML body as text for the terminal, wrapped to
+// width columns (not at all when width is zero). Paragraphs, headings,
+// lists, quotes and simple tables keep their shape; links are numbered
+// and listed at the end.
+func renderHTML(src string, width int) string {
+	doc, err := html.Parse(strings.NewReader(src))
+	if err != nil {
+		return src
+	}
+	r := &htmlRenderer{width: width}
+	r.walk(doc)
+	r.flush()
+	if len(r.links) > 0 {
+		r.gap = true
+		for i, link := range r.links {
+			r.emit([]string{fmt.Sprintf("[%d] %s", i+1, link.url)})
+		}
+	}
+	return strings.ReplaceAll(strings.Join(r.lines, "\n"), "\u00a0", " ")
+}
+
+// htmlLinks returns the links of an HTML body, numbered as renderHTML
+// numbers them.
+func htmlLinks(src string) []messageLink {
+	doc, err := html.Parse(strings.NewReader(src))
+	if err != nil {
+		return nil
+	}
+	r := &htmlRenderer{}
+	r.walk(doc)
+	return r.links
+}
+
+// htmlRenderer builds output one block at a time: inline text gathers in
+// inline until a block boundary flushes it as wrapped lines.
+type htmlRenderer struct {
+	width int
+	lines []string
+	links []messageLink
+
+	inline strings.Builder
+	// prefixes are the line prefixes of enclosing quotes and list items;
+	// bullet replaces the innermost one on the next line written.
+	prefixes []string
+	bullet   string
+	lists    []htmlList
+	pre      int
+	// gap asks for a blank line before the next block.
+	gap bool
+}
+
+type htmlList struct {
+	ordered bool
+	next    int
+}
+
+// skipped elements have nothing worth reading.
+var skipped = map[atom.Atom]bool{
+	atom.Head: true, atom.Script: true, atom.Style: true, atom.Title: true,
+	atom.Noscript: true, atom.Template: true, atom.Iframe: true, atom.Object: true,
+	atom.Svg: true, atom.Button: true, atom.Select: true,
+}
+
+// paragraphs are blocks set off by blank lines; lineBlocks just start on
+// a new line.
+var (
+	paragraphs = map[atom.Atom]bool{
+		atom.P: true, atom.Pre: true, atom.Table: true, atom.Blockquote: true,
+		atom.H1: true, atom.H2: true, atom.H3: true, atom.H4: true, atom.H5: true, atom.H6: true,
+		atom.Ul: true, atom.Ol: true, atom.Dl: true, atom.Hr: true, atom.Figure: true,
+	}
+	lineBlocks = map[atom.Atom]bool{
+		atom.Div: true, atom.Section: true, atom.Article: true, atom.Header: true,
+		atom.Footer: true, atom.Main: true, atom.Nav: true, atom.Aside: true,
+		atom.Center: true, atom.Address: true, atom.Tr: true, atom.Td: true, atom.Th: true,
+		atom.Tbody: true, atom.Thead: true, atom.Tfoot: true, atom.Dt: true, atom.Dd: true,
+		atom.Figcaption: true, atom.Form: true, atom.Fieldset: true, atom.Caption: true,
+	}
+)
+
+func (r *htmlRenderer) walk(n *html.Node) {
+	switch n.Type {
+	case html.TextNode:
+		r.text(n.Data)
+		return
+	case html.ElementNode:
+		if skipped[n.DataAtom] || hidden(n) {
+			return
+		}
+	case html.DocumentNode:
+	default:
+		return
+	}
+
+	switch n.DataAtom {
+	case atom.Br:
+		r.inline.WriteString("\n")
+		return
+	case atom.Hr:
+		r.block(true)
+		r.emit([]string{strings.Repeat("─", r.avail(40))})
+		r.gap = true
+		return
+	case atom.Img:
+		if alt := strings.TrimSpace(attr(n, "alt")); alt != "" {
+			r.text("[" + alt + "]")
+		}
+		return
+	case atom.A:
+		start := r.inline.Len()
+		r.walkChildren(n)
+		if href := attr(n, "href"); usableLink(href) {
+			var text string
+			if r.inline.Len() >= start {
+				text = strings.TrimSpace(r.inline.String()[start:])
+			}
+			r.text(fmt.Sprintf(" [%d]", r.link(strings.TrimSpace(href), text)))
+		}
+		return
+	case atom.Table:
+		if rows, ok := r.simpleTable(n); ok {
+			r.block(true)
+			r.emit(r.layoutTable(rows))
+			r.gap = true
+			return
+		}
+	case atom.Ul, atom.Ol:
+		r.block(len(r.lists) == 0)
+		start := 1
+		if s, err := strconv.Atoi(attr(n, "start")); err == nil {
+			start = s
+		}
+		r.lists = append(r.lists, htmlList{ordered: n.DataAtom == atom.Ol, next: start})
+		r.walkChildren(n)
+		r.flush()
+		r.lists = r.lists[:len(r.lists)-1]
+		r.gap = r.gap || len(r.lists) == 0
+		return
+	case atom.Li:
+		r.flush()
+		marker := "• "
+		if len(r.lists) > 0 {
+			if l := &r.lists[len(r.lists)-1]; l.ordered {
+				marker = fmt.Sprintf("%d. ", l.next)
+				l.next++
+			}
+		}
+		r.bullet = r.prefix() + marker
+		r.prefixes = append(r.prefixes, r.prefix()+strings.Repeat(" ", lipgloss.Width(marker)))
+		r.walkChildren(n)
+		r.flush()
+		r.bullet = ""
+		r.prefixes = r.prefixes[:len(r.prefixes)-1]
+		return
+	case atom.Blockquote:
+		r.block(true)
+		r.prefixes = append(r.prefixes, r.prefix()+"> ")
+		r.walkChildren(n)
+		r.flush()
+		r.prefixes = r.prefixes[:len(r.prefixes)-1]
+		r.gap = true
+		return
+	case atom.Pre:
+		r.block(true)
+		r.pre++
+		r.walkChildren(n)
+		r.flush()
+		r.pre--
+		r.gap = true
+		return
+	case atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6:
+		r.block(true)
+		level := int(n.Data[1] - '0')
+		if level > 2 {
+			r.inline.WriteString(strings.Repeat("#", level) + " ")
+		}
+		r.walkChildren(n)
+		text := r.inline.String()
+		r.flush()
+		if level <= 2 {
+			underline := "="
+			if level == 2 {
+				underline = "-"
+			}
+			r.emit([]string{strings.Repeat(underline, min(lipgloss.Width(strings.TrimSpace(text)), r.avail(80)))})
+		}
+		r.gap = true
+		return
+	}
+
+	if paragraphs[n.DataAtom] {
+		r.block(true)
+		r.walkChildren(n)
+		r.block(true)
+		return
+	}
+	if lineBlocks[n.DataAtom] {
+		r.block(false)
+		r.walkChildren(n)
+		r.block(false)
+		return
+	}
+	r.walkChildren(n)
+}
+
+func (r *htmlRenderer) walkChildren(n *html.Node) {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		r.walk(c)
+	}
+}
+
+// text adds inline text, collapsing whitespace outside <pre>. Non-breaking
+// spaces stay put until the end so that lines don't wrap at them.
+func (r *htmlRenderer) text(s string) {
+	s = strings.Map(func(c rune) rune {
+		switch c {
+		case '\u200b', '\u200c', '\u200d', '\u034f', '\u00ad', '\ufeff':
+			return -1
+		}
+		return c
+	}, s)
+	if r.pre > 0 {
+		r.inline.WriteString(s)
+		return
+	}
+	for _, c := range s {
+		if c != '\u00a0' && unicode.IsSpace(c) {
+			cur := r.inline.String()
+			if cur != "" && !strings.HasSuffix(cur, " ") && !strings.HasSuffix(cur, "\n") {
+				r.inline.WriteByte(' ')
+			}
+			continue
+		}
+		r.inline.WriteRune(c)
+	}
+}
+
+// block ends the current block; paragraph asks for a blank line before
+// the next one.
+func (r *htmlRenderer) block(paragraph bool) {
+	r.flush()
+	if paragraph {
+		r.gap = true
+	}
+}
+
+// flush writes out the inline text gathered so far.
+func (r *htmlRenderer) flush() {
+	text := r.inline.String()
+	r.inline.Reset()
+	if strings.TrimSpace(strings.ReplaceAll(text, "\u00a0", " ")) == "" {
+		return
+	}
+	var lines []string
+	if r.pre > 0 {
+		lines = strings.Split(strings.Trim(text, "\n"), "\n")
+	} else {
+		for _, seg := range strings.Split(strings.Trim(text, " \n"), "\n") {
+			lines = append(lines, wrapWords(strings.TrimSpace(seg), r.avail(0))...)
+		}
+	}
+	r.emit(lines)
+}
+
+// emit writes lines under the current prefixes. A blank line between
+// blocks keeps only the quote markers both sides share.
+func (r *htmlRenderer) emit(lines []string) {
+	if r.gap && len(r.lines) > 0 && r.lines[len(r.lines)-1] != "" {
+		last, p := r.lines[len(r.lines)-1], r.prefix()
+		n := 0
+		for n < len(last) && n < len(p) && last[n] == p[n] {
+			n++
+		}
+		r.lines = append(r.lines, strings.TrimRight(p[:n], " "))
+	}
+	r.gap = false
+	for i, line := range lines {
+		p := r.prefix()
+		if i == 0 && r.bullet != "" {
+			p, r.bullet = r.bullet, ""
+		}
+		r.lines = append(r.lines, strings.TrimRight(p+line, " "))
+	}
+}
+
+func (r *htmlRenderer) prefix() string {
+	if len(r.prefixes) == 0 {
+		return ""
+	}
+	return r.prefixes[len(r.prefixes)-1]
+}
+
+// avail is the width left after the prefix, or fallback when not
+// wrapping.
+func (r *htmlRenderer) avail(fallback int) int {
+	if r.width <= 0 {
+		return fallback
+	}
+	return max(r.width-lipgloss.Width(r.prefix()), 10)
+}
+
+// link numbers href, reusing the number of a link seen before.
+func (r *htmlRenderer) link(href, text string) int {
+	for i, l := range r.links {
+		if l.url == href {
+			if l.text == "" {
+				r.links[i].text = text
+			}
+			return i + 1
+		}
+	}
+	r.links = append(r.links, messageLink{url: href, text: text})
+	return len(r.links)
+}
+
+// simpleTable returns the cells of a data table: one with at least two
+// columns and nothing but inline content in its cells. Anything else is a
+// layout table, as newsletters use, and is read as a run of blocks.
+func (r *htmlRenderer) simpleTable(n *html.Node) ([][]string, bool) {
+	var rows [][]string
+	var header bool
+	cols := 0
+	var collect func(*html.Node) bool
+	collect = func(n *html.Node) bool {
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			if c.Type != html.ElementNode {
+				continue
+			}
+			switch c.DataAtom {
+			case atom.Thead, atom.Tbody, atom.Tfoot:
+				if !collect(c) {
+					return false
+				}
+			case atom.Tr:
+				var row []string
+				for cell := c.FirstChild; cell != nil; cell = cell.NextSibling {
+					if cell.DataAtom != atom.Td && cell.DataAtom != atom.Th {
+						continue
+					}
+					if hasBlocks(cell) {
+						return false
+					}
+					if len(rows) == 0 && cell.DataAtom == atom.Th {
+						header = true
+					}
+					sub := &htmlRenderer{links: r.links}
+					sub.walkChildren(cell)
+					sub.flush()
+					r.links = sub.links
+					row = append(row, strings.Join(sub.lines, " "))
+				}
+				cols = max(cols, len(row))
+				rows = append(rows, row)
+			}
+		}
+		return true
+	}
+	links := len(r.links)
+	if !collect(n) || cols < 2 {
+		r.links = r.links[:links]
+		return nil, false
+	}
+	if header {
+		rows = append([][]string{nil}, rows...) // marks the header row
+	}
+	return rows, true
+}
+
+func hasBlocks(n *html.Node) bool {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type == html.ElementNode && (paragraphs[c.DataAtom] || lineBlocks[c.DataAtom] || c.DataAtom == atom.Li || hasBlocks(c)) {
+			return true
+		}
+	}
+	return false
+}
+
+// layoutTable sets rows out in columns, narrowing the widest columns and
+// wrapping their cells to fit. A leading nil row marks a header.
+func (r *htmlRenderer) layoutTable(rows [][]string) []string {
+	header := len(rows) > 0 && rows[0] == nil
+	if header {
+		rows = rows[1:]
+	}
+	var widths []int
+	for _, row := range rows {
+		for i, cell := range row {
+			if i >= len(widths) {
+				widths = append(widths, 0)
+			}
+			widths[i] = max(widths[i], lipgloss.Width(cell))
+		}
+	}
+	const sep = " │ "
+	if r.width > 0 {
+		avail := r.avail(0) - lipgloss.Width(sep)*(len(widths)-1)
+		for sum(widths) > avail {
+			widest := 0
+			for i, w := range widths {
+				if w > widths[widest] {
+					widest = i
+				}
+			}
+			if widths[widest] <= 5 {
+				break
+			}
+			widths[widest]--
+		}
+	}
+
+	var out []string
+	for ri, row := range rows {
+		cells := make([][]string, len(widths))
+		height := 1
+		for i := range widths {
+			if i < len(row) {
+				cells[i] = wrapWords(row[i], widths[i])
+			}
+			height = max(height, len(cells[i]))
+		}
+		for l := 0; l < height; l++ {
+			parts := make([]string, len(widths))
+			for i, w := range widths {
+				var s string
+				if l < len(cells[i]) {
+					s = cells[i][l]
+				}
+				parts[i] = s + strings.Repeat(" ", max(w-lipgloss.Width(s), 0))
+			}
+			out = append(out, strings.Join(parts, sep))
+		}
+		if header && ri == 0 {
+			parts := make([]string, len(widths))
+			for i, w := range widths {
+				parts[i] = strings.Repeat("─", w)
+			}
+			out = append(out, strings.Join(parts, "─┼─"))
+		}
+	}
+	return out
+}
+
+func sum(xs []int) int {
+	total := 0
+	for _, x := range xs {
+		total += x
+	}
+	return total
+}
+
+// wrapWords breaks text into lines of at most width columns at spaces. A
+// word longer than that, such as a URL, gets a line to itself.
+func wrapWords(text string, width int) []string {
+	if width <= 0 {
+		return []string{text}
+	}
+	var lines []string
+	var line string
+	for _, word := range strings.Split(text, " ") {
+		if word == "" {
+			continue
+		}
+		switch {
+		case line == "":
+			line = word
+		case lipgloss.Width(line)+1+lipgloss.Width(word) <= width:
+			line += " " + word
+		default:
+			lines = append(lines, line)
+			line = word
+		}
+	}
+	return append(lines, line)
+}
+
+func attr(n *html.Node, name string) string {
+	for _, a := range n.Attr {
+		if a.Key == name {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+// hidden reports elements that mail clients don't show, such as the
+// preheader text many newsletters carry.
+func hidden(n *html.Node) bool {
+	for _, a := range n.Attr {
+		switch a.Key {
+		case "hidden":
+			return true
+		case "style":
+			style := strings.ReplaceAll(strings.ToLower(a.Val), " ", "")
+			if strings.Contains(style, "display:none") || strings.Contains(style, "visibility:hidden") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func usableLink(href string) bool {
+	href = strings.TrimSpace(href)
+	return href != "" && !strings.HasPrefix(href, "#") && !strings.HasPrefix(strings.ToLower(href), "javascript:")
+}
@@ -0,0 +1,642 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/zalando/go-keyring"
+	"google.golang.org/api/gmail/v1"
+)
+
+// imapConfig holds the server settings of an "imap" account. Port 993
+// uses implicit TLS, any other IMAP port upgrades with STARTTLS. SMTP
+// does the same with port 465 and the others, always before
+// authenticating.
+type imapConfig struct {
+	Host            string `json:"host"`
+	Port            int    `json:"port,omitempty"`
+	Username        string `json:"username"`
+	Password        string `json:"password,omitempty"`
+	PasswordCommand string `json:"password_command,omitempty"`
+	SMTPHost        string `json:"smtp_host,omitempty"`
+	SMTPPort        int    `json:"smtp_port,omitempty"`
+	From            string `json:"from,omitempty"`
+	TrashFolder     string `json:"trash_folder,omitempty"`
+	SentFolder      string `json:"sent_folder,omitempty"`
+	// InsecureSkipVerify disables certificate checks, for local test servers.
+	InsecureSkipVerify bool `json:"insecure_skip_verify,omitempty"`
+}
+
+func (c *imapConfig) validate() error {
+	if c == nil {
+		return errors.New(`missing "imap" settings`)
+	}
+	if c.Host == "" || c.Username == "" {
+		return errors.New("imap host and username are required")
+	}
+	if c.Port == 0 {
+		c.Port = 993
+	}
+	if c.SMTPHost == "" {
+		c.SMTPHost = c.Host
+	}
+	if c.SMTPPort == 0 {
+		c.SMTPPort = 587
+	}
+	if c.From == "" {
+		c.From = c.Username
+	}
+	return nil
+}
+
+// imapBackend is a MailBackend for IMAP4rev1 servers with SMTP for sending.
+// Folders are exposed as labels, UNREAD maps to the absence of \Seen,
+// STARRED to \Flagged, and trashing moves the message to the trash folder.
+//
+// Message IDs have the form "<uid>:<folder>".
+type imapBackend struct {
+	name string
+	cfg  imapConfig
+
+	mu       sync.Mutex
+	c        *client.Client
+	password string
+	trash    string
+	sent     string
+}
+
+func newIMAPBackend(ac accountConfig) (*imapBackend, error) {
+	b := &imapBackend{name: ac.Name, cfg: *ac.IMAP}
+	if err := b.connect(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (b *imapBackend) getPassword() (string, error) {
+	if b.password != "" {
+		return b.password, nil
+	}
+	switch {
+	case b.cfg.Password != "":
+		b.password = b.cfg.Password
+	case b.cfg.PasswordCommand != "":
+		out, err := exec.Command("sh", "-c", b.cfg.PasswordCommand).Output()
+		if err != nil {
+			return "", fmt.Errorf("password_command failed: %v", err)
+		}
+		b.password = strings.TrimRight(string(out), "\r\n")
+	default:
+		p, err := keyring.Get(keyringService, "imap:"+b.name)
+		if err != nil {
+			return "", fmt.Errorf("no password configured for %s (set password, password_command or keyring entry imap:%s): %v", b.name, b.name, err)
+		}
+		b.password = p
+	}
+	return b.password, nil
+}
+
+func (b *imapBackend) tlsConfig(host string) *tls.Config {
+	return &tls.Config{ServerName: host, InsecureSkipVerify: b.cfg.InsecureSkipVerify}
+}
+
+// connect dials and logs in. Callers must hold b.mu or be the constructor.
+func (b *imapBackend) connect() error {
+	addr := net.JoinHostPort(b.cfg.Host, strconv.Itoa(b.cfg.Port))
+	var (
+		c   *client.Client
+		err error
+	)
+	if b.cfg.Port == 993 {
+		c, err = client.DialTLS(addr, b.tlsConfig(b.cfg.Host))
+	} else {
+		c, err = client.Dial(addr)
+		if err == nil {
+			err = c.StartTLS(b.tlsConfig(b.cfg.Host))
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("unable to connect to %s: %w", addr, err)
+	}
+
+	password, err := b.getPassword()
+	if err != nil {
+		c.Logout()
+		return err
+	}
+	if err := c.Login(b.cfg.Username, password); err != nil {
+		c.Logout()
+		return fmt.Errorf("imap login failed: %v", err)
+	}
+	b.c = c
+	b.findSpecialFolders()
+	return nil
+}
+
+// findSpecialFolders resolves the trash and sent folders from config or the
+// SPECIAL-USE attributes the server advertises.
+func (b *imapBackend) findSpecialFolders() {
+	b.trash, b.sent = b.cfg.TrashFolder, b.cfg.SentFolder
+	if b.trash != "" && b.sent != "" {
+		return
+	}
+	for _, mb := range b.mailboxes() {
+		for _, attr := range mb.Attributes {
+			if attr == imap.TrashAttr && b.trash == "" {
+				b.trash = mb.Name
+			}
+			if attr == imap.SentAttr && b.sent == "" {
+				b.sent = mb.Name
+			}
+		}
+	}
+	if b.trash == "" {
+		b.trash = "Trash"
+	}
+}
+
+func (b *imapBackend) mailboxes() []*imap.MailboxInfo {
+	ch := make(chan *imap.MailboxInfo, 16)
+	done := make(chan error, 1)
+	go func() { done <- b.c.List("", "*", ch) }()
+	var boxes []*imap.MailboxInfo
+	for mb := range ch {
+		boxes = append(boxes, mb)
+	}
+	<-done
+	return boxes
+}
+
+// do runs fn with a live connection, reconnecting once if the server
+// dropped it.
+func (b *imapBackend) do(fn func(c *client.Client) error) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.c == nil || b.c.State() == imap.LogoutState {
+		if err := b.connect(); err != nil {
+			return err
+		}
+	}
+	err := fn(b.c)
+	if err != nil && b.c.State() == imap.LogoutState {
+		if cerr := b.connect(); cerr != nil {
+			return err
+		}
+		err = fn(b.c)
+	}
+	return err
+}
+
+func imapID(folder string, uid uint32) string {
+	return fmt.Sprintf("%d:%s", uid, folder)
+}
+
+func parseIMAPID(id string) (string, uint32, error) {
+	uidStr, folder, ok := strings.Cut(id, ":")
+	uid, err := strconv.ParseUint(uidStr, 10, 32)
+	if !ok || err != nil {
+		return "", 0, fmt.Errorf("invalid message id %q", id)
+	}
+	return folder, uint32(uid), nil
+}
+
+func uidSet(uid uint32) *imap.SeqSet {
+	s := new(imap.SeqSet)
+	s.AddNum(uid)
+	return s
+}
+
+// folderFor picks the folder to search: the first label ID, an in:/label:
+// term in the query, or INBOX.
+func folderFor(query string, labelIDs []string) string {
+	if len(labelIDs) > 0 {
+		return labelIDs[0]
+	}
+	for _, term := range strings.Fields(query) {
+		op, arg, ok := strings.Cut(term, ":")
+		if ok && (strings.EqualFold(op, "in") || strings.EqualFold(op, "label")) {
+			if strings.EqualFold(arg, "inbox") {
+				return "INBOX"
+			}
+			return strings.Trim(arg, `"`)
+		}
+	}
+	return "INBOX"
+}
+
+// searchCriteria translates the Gmail-style query into IMAP SEARCH keys.
+func searchCriteria(query string) *imap.SearchCriteria {
+	c := imap.NewSearchCriteria()
+	for _, term := range strings.Fields(query) {
+		op, arg, ok := strings.Cut(term, ":")
+		if !ok {
+			c.Text = append(c.Text, term)
+			continue
+		}
+		arg = strings.Trim(arg, `"`)
+		switch strings.ToLower(op) {
+		case "in", "label", "category":
+		case "is":
+			switch strings.ToLower(arg) {
+			case "unread":
+				c.WithoutFlags = append(c.WithoutFlags, imap.SeenFlag)
+			case "read":
+				c.WithFlags = append(c.WithFlags, imap.SeenFlag)
+			case "starred":
+				c.WithFlags = append(c.WithFlags, imap.FlaggedFlag)
+			}
+		case "from", "to", "cc", "subject":
+			c.Header.Add(op, arg)
+		default:
+			c.Text = append(c.Text, term)
+		}
+	}
+	c.WithoutFlags = append(c.WithoutFlags, imap.DeletedFlag)
+	return c
+}
+
+func (b *imapBackend) ListMessages(query string, labelIDs []string, pageToken string, max int64) (*gmail.ListMessagesResponse, error) {
+	folder := folderFor(query, labelIDs)
+	var uids []uint32
+	err := b.do(func(c *client.Client) error {
+		if _, err := c.Select(folder, true); err != nil {
+			return err
+		}
+		var err error
+		uids, err = c.UidSearch(searchCriteria(query))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Higher UIDs are newer.
+	sort.Slice(uids, func(i, j int) bool { return uids[i] > uids[j] })
+	msgs := make([]*gmail.Message, len(uids))
+	for i, uid := range uids {
+		id := imapID(folder, uid)
+		msgs[i] = &gmail.Message{Id: id, ThreadId: id}
+	}
+	return pageOf(msgs, pageToken, max)
+}
+
+func (b *imapBackend) GetMessage(id, format string, metadataHeaders ...string) (*gmail.Message, error) {
+	folder, uid, err := parseIMAPID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	section := &imap.BodySectionName{Peek: true}
+	if format == "metadata" || format == "minimal" {
+		section.Specifier = imap.HeaderSpecifier
+	}
+	items := []imap.FetchItem{imap.FetchUid, imap.FetchFlags, imap.FetchInternalDate, section.FetchItem()}
+
+	var fetched *imap.Message
+	err = b.do(func(c *client.Client) error {
+		if _, err := c.Select(folder, true); err != nil {
+			return err
+		}
+		ch := make(chan *imap.Message, 1)
+		done := make(chan error, 1)
+		go func() { done <- c.UidFetch(uidSet(uid), items, ch) }()
+		for m := range ch {
+			fetched = m
+		}
+		return <-done
+	})
+	if err != nil {
+		return nil, err
+	}
+	if fetched == nil {
+		return nil, fmt.Errorf("message %s: %w", id, errNotFound)
+	}
+
+	lit := fetched.GetBody(section)
+	if lit == nil {
+		return nil, fmt.Errorf("message %s: server returned no body", id)
+	}
+	raw, err := io.ReadAll(lit)
+	if err != nil {
+		return nil, err
+	}
+	msg, err := messageFromRaw(raw)
+	if err != nil {
+		return nil, err
+	}
+	msg.Id, msg.ThreadId = id, id
+	msg.InternalDate = fetched.InternalDate.UnixMilli()
+	msg.LabelIds = flagsToLabels(folder, fetched.Flags)
+	return formatMessage(msg, format, metadataHeaders), nil
+}
+
+func flagsToLabels(folder string, flags []string) []string {
+	labels := []string{folder}
+	seen := false
+	for _, f := range flags {
+		switch f {
+		case imap.SeenFlag:
+			seen = true
+		case imap.FlaggedFlag:
+			labels = append(labels, "STARRED")
+		}
+	}
+	if !seen {
+		labels = append(labels, "UNREAD")
+	}
+	return labels
+}
+
+// ModifyMessage maps UNREAD and STARRED onto flags. Adding TRASH or another
+// folder label moves the message there.
+func (b *imapBackend) ModifyMessage(id string, addLabelIDs, removeLabelIDs []string) error {
+	folder, uid, err := parseIMAPID(id)
+	if err != nil {
+		return err
+	}
+
+	var addFlags, removeFlags []interface{}
+	var moveTo string
+	for _, l := range addLabelIDs {
+		switch l {
+		case "UNREAD":
+			removeFlags = append(removeFlags, imap.SeenFlag)
+		case "STARRED":
+			addFlags = append(addFlags, imap.FlaggedFlag)
+		case "TRASH":
+			moveTo = b.trash
+		default:
+			moveTo = l
+		}
+	}
+	for _, l := range removeLabelIDs {
+		switch l {
+		case "UNREAD":
+			addFlags = append(addFlags, imap.SeenFlag)
+		case "STARRED":
+			removeFlags = append(removeFlags, imap.FlaggedFlag)
+		}
+	}
+
+	return b.do(func(c *client.Client) error {
+		if _, err := c.Select(folder, false); err != nil {
+			return err
+		}
+		set := uidSet(uid)
+		if len(addFlags) > 0 {
+			if err := c.UidStore(set, imap.FormatFlagsOp(imap.AddFlags, true), addFlags, nil); err != nil {
+				return err
+			}
+		}
+		if len(removeFlags) > 0 {
+			if err := c.UidStore(set, imap.FormatFlagsOp(imap.RemoveFlags, true), removeFlags, nil); err != nil {
+				return err
+			}
+		}
+		if moveTo != "" && moveTo != folder {
+			return c.UidMove(set, moveTo)
+		}
+		return nil
+	})
+}
+
+func (b *imapBackend) TrashMessage(id string) error {
+	return b.ModifyMessage(id, []string{"TRASH"}, nil)
+}
+
+// Addresses returns the From address, and the username when it is one.
+func (b *imapBackend) Addresses() ([]string, error) {
+	var addrs []string
+	if from, err := mail.ParseAddress(b.cfg.From); err == nil {
+		addrs = append(addrs, from.Address)
+	}
+	if strings.Contains(b.cfg.Username, "@") && !containsFold(addrs, b.cfg.Username) {
+		addrs = append(addrs, b.cfg.Username)
+	}
+	return addrs, nil
+}
+
+func (b *imapBackend) ListLabels() ([]*gmail.Label, error) {
+	var boxes []*imap.MailboxInfo
+	err := b.do(func(c *client.Client) error {
+		boxes = b.mailboxes()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var labels []*gmail.Label
+	for _, mb := range boxes {
+		noselect := false
+		for _, attr := range mb.Attributes {
+			if attr == imap.NoSelectAttr {
+				noselect = true
+			}
+		}
+		if noselect {
+			continue
+		}
+		typ := "user"
+		if strings.EqualFold(mb.Name, "INBOX") || mb.Name == b.trash || mb.Name == b.sent {
+			typ = "system"
+		}
+		labels = append(labels, &gmail.Label{Id: mb.Name, Name: mb.Name, Type: typ})
+	}
+	return labels, nil
+}
+
+func (b *imapBackend) GetAttachment(msgID, attachmentID string) ([]byte, error) {
+	msg, err := b.GetMessage(msgID, "full")
+	if err != nil {
+		return nil, err
+	}
+	part := findPartByAttachmentID(msg.Payload, attachmentID)
+	if part == nil {
+		return nil, fmt.Errorf("attachment %s: %w", attachmentID, errNotFound)
+	}
+	return base64.URLEncoding.DecodeString(part.Body.Data)
+}
+
+// SendMessage delivers msg.Raw over SMTP with STARTTLS and files a copy in
+// the sent folder, since IMAP servers don't do that on their own.
+func (b *imapBackend) SendMessage(msg *gmail.Message) (*gmail.Message, error) {
+	raw, err := base64.URLEncoding.DecodeString(msg.Raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid raw message: %w", err)
+	}
+	parsed, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return nil, fmt.Errorf("invalid raw message: %w", err)
+	}
+	if parsed.Header.Get("From") == "" {
+		raw = append([]byte("From: "+b.cfg.From+"\r\n"), raw...)
+	}
+
+	var rcpts []string
+	for _, field := range []string{"To", "Cc", "Bcc"} {
+		if v := parsed.Header.Get(field); v != "" {
+			addrs, err := mail.ParseAddressList(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s address: %w", field, err)
+			}
+			for _, a := range addrs {
+				rcpts = append(rcpts, a.Address)
+			}
+		}
+	}
+	if len(rcpts) == 0 {
+		return nil, errors.New("no recipients")
+	}
+	// Bcc recipients get the message, but must not see the header.
+	raw = stripHeader(raw, "Bcc")
+
+	if err := b.smtpSend(rcpts, raw); err != nil {
+		return nil, err
+	}
+
+	if b.sent != "" {
+		err := b.do(func(c *client.Client) error {
+			return c.Append(b.sent, []string{imap.SeenFlag}, time.Now(), bytes.NewBuffer(raw))
+		})
+		if err != nil {
+			return nil, &sentCopyError{folder: b.sent, err: err}
+		}
+	}
+	return &gmail.Message{}, nil
+}
+
+// smtpTimeout bounds connecting to the SMTP server and each wait on it
+// after, so that a server that never answers can't hold up the outbox.
+var smtpTimeout = time.Minute
+
+// idleTimeoutConn is a connection that fails a read or write once the
+// other end has been quiet for timeout.
+type idleTimeoutConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c idleTimeoutConn) Read(p []byte) (int, error) {
+	c.SetDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Read(p)
+}
+
+func (c idleTimeoutConn) Write(p []byte) (int, error) {
+	c.SetDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Write(p)
+}
+
+// dialSMTP connects to the SMTP server and secures the connection: with
+// TLS from the start on port 465, with STARTTLS on any other.
+func (b *imapBackend) dialSMTP(addr string, implicitTLS bool) (*smtp.Client, error) {
+	conn, err := net.DialTimeout("tcp", addr, smtpTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to %s: %w", addr, err)
+	}
+	conn = idleTimeoutConn{Conn: conn, timeout: smtpTimeout}
+	if implicitTLS {
+		conn = tls.Client(conn, b.tlsConfig(b.cfg.SMTPHost))
+	}
+	c, err := smtp.NewClient(conn, b.cfg.SMTPHost)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("unable to connect to %s: %w", addr, err)
+	}
+	if !implicitTLS {
+		if err := c.StartTLS(b.tlsConfig(b.cfg.SMTPHost)); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("smtp STARTTLS failed: %w", err)
+		}
+	}
+	return c, nil
+}
+
+func (b *imapBackend) smtpSend(rcpts []string, raw []byte) error {
+	addr := net.JoinHostPort(b.cfg.SMTPHost, strconv.Itoa(b.cfg.SMTPPort))
+	c, err := b.dialSMTP(addr, b.cfg.SMTPPort == 465)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	b.mu.Lock()
+	password, err := b.getPassword()
+	b.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := c.Auth(smtp.PlainAuth("", b.cfg.Username, password, b.cfg.SMTPHost)); err != nil {
+		return fmt.Errorf("smtp auth failed: %w", err)
+	}
+
+	from, err := mail.ParseAddress(b.cfg.From)
+	if err != nil {
+		return fmt.Errorf("invalid from address %q: %v", b.cfg.From, err)
+	}
+	if err := c.Mail(from.Address); err != nil {
+		return err
+	}
+	for _, r := range rcpts {
+		if err := c.Rcpt(r); err != nil {
+			return fmt.Errorf("recipient %s rejected: %w", r, err)
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(raw); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	// The message is accepted; a failed goodbye mustn't get it sent again.
+	c.Quit()
+	return nil
+}
+
+// stripHeader removes every occurrence of the named header, including
+// folded continuation lines, from the header block of raw.
+func stripHeader(raw []byte, name string) []byte {
+	end := bytes.Index(raw, []byte("\r\n\r\n"))
+	if end < 0 {
+		return raw
+	}
+	var out bytes.Buffer
+	skipping := false
+	for _, line := range strings.SplitAfter(string(raw[:end+2]), "\r\n") {
+		if line == "" {
+			continue
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			if !skipping {
+				out.WriteString(line)
+			}
+			continue
+		}
+		n, _, _ := strings.Cut(line, ":")
+		skipping = strings.EqualFold(strings.TrimSpace(n), name)
+		if !skipping {
+			out.WriteString(line)
+		}
+	}
+	out.Write(raw[end+2:])
+	return out.Bytes()
+}
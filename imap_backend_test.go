@@ -0,0 +1,475 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/emersion/go-imap/server"
+	"google.golang.org/api/gmail/v1"
+)
+
+// testTLSConfig is a server config with a throwaway self-signed
+// certificate; clients connect with InsecureSkipVerify.
+func testTLSConfig(t *testing.T) *tls.Config {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+}
+
+func listen(t *testing.T) (net.Listener, int) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ln, ln.Addr().(*net.TCPAddr).Port
+}
+
+// fakeSMTPServer accepts mail after STARTTLS and AUTH PLAIN, the way
+// imapBackend sends it, and records each delivery.
+type fakeSMTPServer struct {
+	tls *tls.Config
+	// reject maps recipients to the reply RCPT TO gets for them.
+	reject map[string]string
+	// implicitTLS starts TLS before the greeting, as on port 465.
+	implicitTLS atomic.Bool
+	// hangUpOnQuit drops the connection instead of answering QUIT.
+	hangUpOnQuit atomic.Bool
+
+	mu        sync.Mutex
+	delivered []smtpDelivery
+}
+
+type smtpDelivery struct {
+	from string
+	rcpt []string
+	data string
+}
+
+func (s *fakeSMTPServer) serve(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go s.session(conn)
+	}
+}
+
+func (s *fakeSMTPServer) session(conn net.Conn) {
+	defer func() { conn.Close() }()
+	secure, authed := false, false
+	if s.implicitTLS.Load() {
+		tc := tls.Server(conn, s.tls)
+		if tc.Handshake() != nil {
+			return
+		}
+		conn, secure = tc, true
+	}
+	tp := textproto.NewConn(conn)
+	tp.PrintfLine("220 localhost ESMTP")
+	var d smtpDelivery
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "EHLO", "HELO":
+			if secure {
+				tp.PrintfLine("250-localhost\r\n250 AUTH PLAIN")
+			} else {
+				tp.PrintfLine("250-localhost\r\n250 STARTTLS")
+			}
+		case "STARTTLS":
+			tp.PrintfLine("220 go ahead")
+			tc := tls.Server(conn, s.tls)
+			if tc.Handshake() != nil {
+				return
+			}
+			conn, secure = tc, true
+			tp = textproto.NewConn(conn)
+		case "AUTH":
+			creds, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(arg, "PLAIN "))
+			if !secure || string(creds) != "\x00user@example.com\x00secret" {
+				tp.PrintfLine("535 authentication failed")
+				continue
+			}
+			authed = true
+			tp.PrintfLine("235 ok")
+		case "MAIL":
+			if !authed {
+				tp.PrintfLine("530 authentication required")
+				continue
+			}
+			d = smtpDelivery{from: strings.Trim(strings.TrimPrefix(arg, "FROM:"), "<>")}
+			tp.PrintfLine("250 ok")
+		case "RCPT":
+			rcpt := strings.Trim(strings.TrimPrefix(arg, "TO:"), "<>")
+			if reply, ok := s.reject[rcpt]; ok {
+				tp.PrintfLine("%s", reply)
+				continue
+			}
+			d.rcpt = append(d.rcpt, rcpt)
+			tp.PrintfLine("250 ok")
+		case "DATA":
+			tp.PrintfLine("354 go ahead")
+			data, err := tp.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			d.data = string(data)
+			s.mu.Lock()
+			s.delivered = append(s.delivered, d)
+			s.mu.Unlock()
+			tp.PrintfLine("250 queued")
+		case "QUIT":
+			if !s.hangUpOnQuit.Load() {
+				tp.PrintfLine("221 bye")
+			}
+			return
+		default:
+			tp.PrintfLine("502 not implemented")
+		}
+	}
+}
+
+// imapTestServer runs an in-process IMAP server holding user@example.com's
+// mailbox, and an SMTP server beside it.
+type imapTestServer struct {
+	user backend.User
+	smtp *fakeSMTPServer
+	ac   accountConfig
+}
+
+func newIMAPTestServer(t *testing.T) *imapTestServer {
+	t.Helper()
+	tlsConfig := testTLSConfig(t)
+
+	be := memory.New()
+	user, err := be.Login(nil, "username", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"Sent", "Trash"} {
+		if err := user.CreateMailbox(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	imapSrv := server.New(&renamedUser{Backend: be, username: "user@example.com", password: "secret"})
+	imapSrv.TLSConfig = tlsConfig
+	imapSrv.ErrorLog = log.New(io.Discard, "", 0)
+	imapLn, imapPort := listen(t)
+	go imapSrv.Serve(imapLn)
+	t.Cleanup(func() { imapSrv.Close() })
+
+	smtpSrv := &fakeSMTPServer{tls: tlsConfig}
+	smtpLn, smtpPort := listen(t)
+	go smtpSrv.serve(smtpLn)
+	t.Cleanup(func() { smtpLn.Close() })
+
+	cfg := &imapConfig{
+		Host:               "127.0.0.1",
+		Port:               imapPort,
+		Username:           "user@example.com",
+		Password:           "secret",
+		SMTPPort:           smtpPort,
+		TrashFolder:        "Trash",
+		SentFolder:         "Sent",
+		InsecureSkipVerify: true,
+	}
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	return &imapTestServer{user: user, smtp: smtpSrv, ac: accountConfig{Name: "test", Type: "imap", IMAP: cfg}}
+}
+
+// renamedUser logs in to the memory backend's only user with the test
+// account's credentials.
+type renamedUser struct {
+	*memory.Backend
+	username, password string
+}
+
+func (b *renamedUser) Login(info *imap.ConnInfo, username, password string) (backend.User, error) {
+	if username != b.username || password != b.password {
+		return nil, fmt.Errorf("bad username or password")
+	}
+	u, err := b.Backend.Login(info, "username", "password")
+	if err != nil {
+		return nil, err
+	}
+	return movingUser{u}, nil
+}
+
+// movingUser gives the memory backend's mailboxes the MOVE command, which
+// the server advertises but leaves to the backend.
+type movingUser struct{ backend.User }
+
+func (u movingUser) GetMailbox(name string) (backend.Mailbox, error) {
+	mbox, err := u.User.GetMailbox(name)
+	if err != nil {
+		return nil, err
+	}
+	return movingMailbox{mbox.(*memory.Mailbox)}, nil
+}
+
+type movingMailbox struct{ *memory.Mailbox }
+
+func (m movingMailbox) MoveMessages(uid bool, seqset *imap.SeqSet, dest string) error {
+	if err := m.CopyMessages(uid, seqset, dest); err != nil {
+		return err
+	}
+	if err := m.UpdateMessagesFlags(uid, seqset, imap.AddFlags, []string{imap.DeletedFlag}); err != nil {
+		return err
+	}
+	return m.Expunge()
+}
+
+func (s *imapTestServer) deliver(t *testing.T, folder, raw string) {
+	t.Helper()
+	mbox, err := s.user.GetMailbox(folder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mbox.CreateMessage(nil, time.Now(), bytes.NewBufferString(raw)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (s *imapTestServer) count(t *testing.T, folder string) int {
+	t.Helper()
+	mbox, err := s.user.GetMailbox(folder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err := mbox.Status([]imap.StatusItem{imap.StatusMessages})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return int(status.Messages)
+}
+
+func rawMessage(s string) *gmail.Message {
+	return &gmail.Message{Raw: base64.URLEncoding.EncodeToString([]byte(s))}
+}
+
+func TestIMAPListAndRead(t *testing.T) {
+	srv := newIMAPTestServer(t)
+	srv.deliver(t, "INBOX", "From: Ann <ann@example.org>\r\nSubject: Minutes\r\nContent-Type: text/plain\r\n\r\nAttached are the minutes.\r\n")
+
+	b, err := newIMAPBackend(srv.ac)
+	if err != nil {
+		t.Fatalf("newIMAPBackend: %v", err)
+	}
+	list, err := b.ListMessages(inboxQuery, nil, "", pageSize)
+	if err != nil {
+		t.Fatalf("ListMessages: %v", err)
+	}
+	// The memory backend starts with a message of its own; newest first.
+	if len(list.Messages) != 2 {
+		t.Fatalf("listed %d messages, want 2", len(list.Messages))
+	}
+	msg, err := b.GetMessage(list.Messages[0].Id, "full")
+	if err != nil {
+		t.Fatalf("GetMessage: %v", err)
+	}
+	if got := headerValue(msg.Payload.Headers, "Subject"); got != "Minutes" {
+		t.Errorf("Subject = %q", got)
+	}
+	if body, _ := messageBody(msg.Payload); !strings.Contains(body, "Attached are the minutes.") {
+		t.Errorf("body = %q", body)
+	}
+	if !containsFold(msg.LabelIds, "UNREAD") {
+		t.Errorf("new message has labels %v, want UNREAD", msg.LabelIds)
+	}
+
+	hits, err := b.ListMessages("subject:minutes", nil, "", pageSize)
+	if err != nil || len(hits.Messages) != 1 || hits.Messages[0].Id != list.Messages[0].Id {
+		t.Errorf("search found %v, %v", hits, err)
+	}
+}
+
+func TestIMAPModifyAndTrash(t *testing.T) {
+	srv := newIMAPTestServer(t)
+	srv.deliver(t, "INBOX", "From: a@example.org\r\nSubject: Old news\r\n\r\nbody\r\n")
+
+	b, err := newIMAPBackend(srv.ac)
+	if err != nil {
+		t.Fatalf("newIMAPBackend: %v", err)
+	}
+	list, _ := b.ListMessages(inboxQuery, nil, "", pageSize)
+	id := list.Messages[0].Id
+
+	if err := b.ModifyMessage(id, []string{"STARRED"}, []string{"UNREAD"}); err != nil {
+		t.Fatalf("ModifyMessage: %v", err)
+	}
+	msg, _ := b.GetMessage(id, "minimal")
+	if containsFold(msg.LabelIds, "UNREAD") || !containsFold(msg.LabelIds, "STARRED") {
+		t.Errorf("labels after modify: %v", msg.LabelIds)
+	}
+
+	if err := b.TrashMessage(id); err != nil {
+		t.Fatalf("TrashMessage: %v", err)
+	}
+	if n := srv.count(t, "INBOX"); n != 1 {
+		t.Errorf("INBOX holds %d messages after trashing, want 1", n)
+	}
+	if n := srv.count(t, "Trash"); n != 1 {
+		t.Errorf("Trash holds %d messages, want 1", n)
+	}
+}
+
+func TestIMAPSend(t *testing.T) {
+	srv := newIMAPTestServer(t)
+	b, err := newIMAPBackend(srv.ac)
+	if err != nil {
+		t.Fatalf("newIMAPBackend: %v", err)
+	}
+
+	_, err = b.SendMessage(rawMessage("To: bob@example.org\r\nCc: carol@example.org\r\nBcc: dave@example.org\r\nSubject: Plans\r\n\r\nSee you there.\r\n"))
+	if err != nil {
+		t.Fatalf("SendMessage: %v", err)
+	}
+	srv.smtp.mu.Lock()
+	delivered := srv.smtp.delivered
+	srv.smtp.mu.Unlock()
+	if len(delivered) != 1 {
+		t.Fatalf("%d deliveries, want 1", len(delivered))
+	}
+	d := delivered[0]
+	if d.from != "user@example.com" {
+		t.Errorf("MAIL FROM %q", d.from)
+	}
+	if want := []string{"bob@example.org", "carol@example.org", "dave@example.org"}; strings.Join(d.rcpt, ",") != strings.Join(want, ",") {
+		t.Errorf("RCPT TO %v, want %v", d.rcpt, want)
+	}
+	if strings.Contains(d.data, "Bcc:") || !strings.Contains(d.data, "From: user@example.com") {
+		t.Errorf("delivered message:\n%s", d.data)
+	}
+	if n := srv.count(t, "Sent"); n != 1 {
+		t.Errorf("Sent holds %d messages, want the copy", n)
+	}
+}
+
+func TestIMAPSendRejected(t *testing.T) {
+	srv := newIMAPTestServer(t)
+	srv.smtp.reject = map[string]string{"nobody@example.org": "550 5.1.1 no such user"}
+	b, err := newIMAPBackend(srv.ac)
+	if err != nil {
+		t.Fatalf("newIMAPBackend: %v", err)
+	}
+
+	_, err = b.SendMessage(rawMessage("To: nobody@example.org\r\nSubject: Hello\r\n\r\nhi\r\n"))
+	if err == nil || !strings.Contains(err.Error(), "nobody@example.org rejected") {
+		t.Fatalf("got %v, want the recipient rejected", err)
+	}
+	if n := srv.count(t, "Sent"); n != 0 {
+		t.Errorf("Sent holds %d messages after a failed send", n)
+	}
+}
+
+func TestIMAPSendQuitFails(t *testing.T) {
+	srv := newIMAPTestServer(t)
+	srv.smtp.hangUpOnQuit.Store(true)
+	b, err := newIMAPBackend(srv.ac)
+	if err != nil {
+		t.Fatalf("newIMAPBackend: %v", err)
+	}
+
+	// The server took the message, so the outbox mustn't send it again.
+	if _, err := b.SendMessage(rawMessage("To: bob@example.org\r\nSubject: Plans\r\n\r\nSee you there.\r\n")); err != nil {
+		t.Errorf("SendMessage: %v; want success once DATA was accepted", err)
+	}
+}
+
+func TestIMAPSendSilentServer(t *testing.T) {
+	defer func(old time.Duration) { smtpTimeout = old }(smtpTimeout)
+	smtpTimeout = 100 * time.Millisecond
+
+	// A server that never greets, as one speaking TLS on port 465 does to
+	// a client waiting for a plaintext greeting.
+	ln, port := listen(t)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	srv := newIMAPTestServer(t)
+	srv.ac.IMAP.SMTPPort = port
+	b, err := newIMAPBackend(srv.ac)
+	if err != nil {
+		t.Fatalf("newIMAPBackend: %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := b.SendMessage(rawMessage("To: bob@example.org\r\nSubject: Plans\r\n\r\nhi\r\n"))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil || !isTransient(err) {
+			t.Errorf("got %v, want a timeout the outbox retries", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("SendMessage is still waiting for the greeting")
+	}
+}
+
+func TestSMTPImplicitTLS(t *testing.T) {
+	srv := newIMAPTestServer(t)
+	srv.smtp.implicitTLS.Store(true)
+	b, err := newIMAPBackend(srv.ac)
+	if err != nil {
+		t.Fatalf("newIMAPBackend: %v", err)
+	}
+
+	c, err := b.dialSMTP(net.JoinHostPort("127.0.0.1", strconv.Itoa(srv.ac.IMAP.SMTPPort)), true)
+	if err != nil {
+		t.Fatalf("dialSMTP: %v", err)
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("AUTH"); !ok {
+		t.Error("server doesn't offer AUTH; the connection isn't the TLS one")
+	}
+}
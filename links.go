@@ -0,0 +1,242 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/bubbles/key"
+	"github.com/charmbracelet/bubbles/list"
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/x/ansi"
+	"golang.org/x/net/publicsuffix"
+	"google.golang.org/api/gmail/v1"
+)
+
+// messageLink is a link in a message body with the text it is shown as,
+// if any.
+type messageLink struct {
+	url  string
+	text string
+}
+
+// plainURL matches URLs in plain text, up to the first space or angle
+// bracket; trailing punctuation is trimmed by plainLinks.
+var (
+	plainURL     = regexp.MustCompile(`(?i)\b(?:https?://|mailto:|www\.)[^\s<>"]+`)
+	bracketedURL = regexp.MustCompile(`<((?:https?|mailto):[^<>]*)>`)
+)
+
+// plainLinks returns the URLs in a plain text body. URLs in angle
+// brackets, as RFC 3986 suggests, may be broken across lines.
+func plainLinks(text string) []messageLink {
+	text = bracketedURL.ReplaceAllStringFunc(text, func(s string) string {
+		return strings.Join(strings.Fields(s), "")
+	})
+	var links []messageLink
+	for _, u := range plainURL.FindAllString(text, -1) {
+		u = strings.TrimRight(u, ".,;:!?'")
+		// Drop a closing parenthesis unless the URL opened one.
+		for strings.HasSuffix(u, ")") && strings.Count(u, "(") < strings.Count(u, ")") {
+			u = strings.TrimSuffix(u, ")")
+		}
+		if strings.HasPrefix(strings.ToLower(u), "www.") {
+			u = "http://" + u
+		}
+		links = append(links, messageLink{url: u})
+	}
+	return links
+}
+
+// messageLinks collects the links of both the plain text and the HTML
+// body of a message. HTML links come first, numbered as the reader shows
+// them, then URLs only the plain text has.
+func messageLinks(payload *gmail.MessagePart) []messageLink {
+	plain, html := textParts(payload)
+	var links []messageLink
+	seen := map[string]bool{}
+	if html != nil {
+		for _, l := range htmlLinks(partText(html)) {
+			links = append(links, l)
+			seen[l.url] = true
+		}
+	}
+	if plain != nil {
+		for _, l := range plainLinks(partText(plain)) {
+			if !seen[l.url] {
+				links = append(links, l)
+				seen[l.url] = true
+			}
+		}
+	}
+	return links
+}
+
+// textParts finds the first plain text and HTML body parts of a message,
+// leaving out attachments.
+func textParts(part *gmail.MessagePart) (plain, html *gmail.MessagePart) {
+	if part == nil {
+		return nil, nil
+	}
+	switch {
+	case part.Filename != "":
+	case strings.HasPrefix(part.MimeType, "text/") && (part.Body == nil || part.Body.Data == ""):
+	case part.MimeType == "text/plain":
+		return part, nil
+	case part.MimeType == "text/html":
+		return nil, part
+	case strings.HasPrefix(part.MimeType, "multipart/"):
+		for _, p := range part.Parts {
+			pp, ph := textParts(p)
+			if plain == nil {
+				plain = pp
+			}
+			if html == nil {
+				html = ph
+			}
+		}
+	}
+	return plain, html
+}
+
+// shownDomain is the host that link text displays, when the text looks
+// like an address rather than words.
+var shownDomain = regexp.MustCompile(`(?i)^(?:[a-z][a-z0-9+.-]*://)?(?:[^\s/@]+@)?((?:[a-z0-9-]+\.)+[a-z]{2,})(?:[:/?#]\S*)?$`)
+
+// mismatch reports a link whose text shows one domain while it leads to
+// another, a common phishing trick. It returns the shown domain.
+func (l messageLink) mismatch() (string, bool) {
+	m := shownDomain.FindStringSubmatch(strings.TrimSpace(l.text))
+	if m == nil {
+		return "", false
+	}
+	target, err := url.Parse(l.url)
+	if err != nil || target.Hostname() == "" {
+		return m[1], false
+	}
+	return m[1], registrableDomain(m[1]) != registrableDomain(target.Hostname())
+}
+
+func registrableDomain(host string) string {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if net.ParseIP(host) != nil {
+		return host
+	}
+	if d, err := publicsuffix.EffectiveTLDPlusOne(host); err == nil {
+		return d
+	}
+	return host
+}
+
+// linkItem is a row of the link picker.
+type linkItem struct {
+	n    int
+	link messageLink
+}
+
+func (l linkItem) Title() string {
+	title := fmt.Sprintf("[%d] %s", l.n, firstNonEmpty(l.link.text, l.link.url))
+	if shown, bad := l.link.mismatch(); bad {
+		title = fmt.Sprintf("⚠ %s — shows %s, goes elsewhere", title, shown)
+	}
+	return title
+}
+
+func (l linkItem) Description() string { return l.link.url }
+
+func (l linkItem) FilterValue() string { return l.link.text + " " + l.link.url }
+
+// openLinks shows the picker for the links in the message being read.
+func (m *model) openLinks() tea.Cmd {
+	if m.currentMsg == nil || len(m.currentMsg.links) == 0 {
+		return showNotification("No links in this message")
+	}
+	items := make([]list.Item, len(m.currentMsg.links))
+	for i, l := range m.currentMsg.links {
+		items[i] = linkItem{n: i + 1, link: l}
+	}
+	m.linksList = list.New(items, list.NewDefaultDelegate(), m.width, m.height-4)
+	m.linksList.Title = "Links"
+	m.linksList.SetShowHelp(false)
+	m.linksList.SetStatusBarItemName("link", "links")
+	m.linksList.DisableQuitKeybindings()
+	m.linksReturn = m.state
+	m.state = pickingLink
+	return nil
+}
+
+// openLink runs the configured opener on link, or the system's default
+// handler. The URL is passed as an argument, never through the shell's
+// parser.
+func openLink(opener, link string) tea.Cmd {
+	return func() tea.Msg {
+		var err error
+		if opener == "" {
+			err = openBrowser(link)
+		} else {
+			err = exec.Command("sh", "-c", opener+` "$1"`, "sh", link).Start()
+		}
+		if err != nil {
+			return notificationMsg{message: "Couldn't open the link: " + err.Error(), level: severityError}
+		}
+		return notificationMsg{message: "Opened " + link, level: severityInfo}
+	}
+}
+
+// clipboardHold is how long a clipboard sequence stays in the view: a few
+// frames, so the renderer writes it at least once whatever else changes.
+const clipboardHold = 100 * time.Millisecond
+
+// clipboardSentMsg takes a clipboard sequence back out of the view.
+type clipboardSentMsg struct{ seq string }
+
+// copyLink puts link on the clipboard through the terminal (OSC 52),
+// which also works over SSH. The sequence rides at the start of the view
+// rather than going out on its own, so that it can't land in the middle
+// of a frame, takes up no line, and is written in the alternate screen
+// too. The renderer redraws the line when it is taken out again.
+func (m *model) copyLink(link string) tea.Cmd {
+	seq := ansi.SetSystemClipboard(link)
+	m.clipboard = seq
+	return tea.Batch(
+		tea.Tick(clipboardHold, func(time.Time) tea.Msg { return clipboardSentMsg{seq: seq} }),
+		showNotification("Copied "+link),
+	)
+}
+
+func updateLinks(msg tea.Msg, m model) (tea.Model, tea.Cmd) {
+	if msg, ok := msg.(tea.KeyMsg); ok && m.linksList.FilterState() != list.Filtering {
+		selected, ok := m.linksList.SelectedItem().(linkItem)
+		switch {
+		case key.Matches(msg, keys.Back):
+			m.state = m.linksReturn
+			return m, nil
+
+		case key.Matches(msg, keys.Select):
+			if !ok {
+				return m, nil
+			}
+			return m, openLink(m.opener, selected.link.url)
+
+		case key.Matches(msg, keys.CopyLink):
+			if !ok {
+				return m, nil
+			}
+			return m, m.copyLink(selected.link.url)
+
+		case key.Matches(msg, keys.Quit):
+			return m, tea.Quit
+		}
+	}
+	var cmd tea.Cmd
+	m.linksList, cmd = m.linksList.Update(msg)
+	return m, cmd
+}
+
+func linksView(m model) string {
+	return m.linksList.View() + "\n[enter] open • [y] copy • [/] filter • [b] back\n"
+}
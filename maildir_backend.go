@@ -0,0 +1,470 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// maildirConfig holds the settings of a "maildir" account. Maildir has no
+// transport, so sending pipes the message to SendmailCommand (for example
+// "msmtp --read-envelope-from -t") and files a copy in the sent folder.
+type maildirConfig struct {
+	Path            string `json:"path"`
+	SendmailCommand string `json:"sendmail_command,omitempty"`
+	SentFolder      string `json:"sent_folder,omitempty"`
+}
+
+func (c *maildirConfig) validate() error {
+	if c == nil || c.Path == "" {
+		return errors.New(`missing "maildir" path`)
+	}
+	c.Path = expandHome(c.Path)
+	if c.SentFolder == "" {
+		c.SentFolder = "Sent"
+	}
+	return nil
+}
+
+// maildirBackend reads and writes a Maildir tree such as the ones mbsync
+// and offlineimap maintain. The top-level maildir is INBOX and every
+// subfolder (Maildir++ ".Folder" or nested "Folder/Sub") is a label.
+// Message flags map to labels: no S is UNREAD, F is STARRED and T is
+// TRASH.
+//
+// Message IDs have the form "<folder>/<unique name>".
+type maildirBackend struct {
+	cfg maildirConfig
+	mu  sync.Mutex
+	// listed holds the headers ListMessages read, by folder and file path,
+	// so that paging through a large folder doesn't parse every file
+	// again. A file whose mtime changed is read again.
+	listed map[string]map[string]listedMessage
+}
+
+type listedMessage struct {
+	mtime time.Time
+	msg   *gmail.Message
+}
+
+var maildirSeq atomic.Int64
+
+func newMaildirBackend(ac accountConfig) (*maildirBackend, error) {
+	b := &maildirBackend{cfg: *ac.Maildir}
+	if !isMaildir(b.cfg.Path) {
+		return nil, fmt.Errorf("%s is not a maildir (expected cur, new and tmp)", b.cfg.Path)
+	}
+	return b, nil
+}
+
+func isMaildir(dir string) bool {
+	for _, sub := range []string{"cur", "new", "tmp"} {
+		if fi, err := os.Stat(filepath.Join(dir, sub)); err != nil || !fi.IsDir() {
+			return false
+		}
+	}
+	return true
+}
+
+// folderDir maps a folder label to its directory.
+func (b *maildirBackend) folderDir(folder string) string {
+	if folder == "INBOX" {
+		return b.cfg.Path
+	}
+	if dir := filepath.Join(b.cfg.Path, "."+strings.ReplaceAll(folder, "/", ".")); isMaildir(dir) {
+		return dir
+	}
+	return filepath.Join(b.cfg.Path, filepath.FromSlash(folder))
+}
+
+func (b *maildirBackend) folders() ([]string, error) {
+	folders := []string{"INBOX"}
+	err := filepath.WalkDir(b.cfg.Path, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() || path == b.cfg.Path {
+			return nil
+		}
+		switch d.Name() {
+		case "cur", "new", "tmp":
+			return fs.SkipDir
+		}
+		if isMaildir(path) {
+			rel, _ := filepath.Rel(b.cfg.Path, path)
+			rel = filepath.ToSlash(rel)
+			if strings.HasPrefix(rel, ".") && !strings.Contains(rel, "/") {
+				rel = strings.ReplaceAll(strings.TrimPrefix(rel, "."), ".", "/")
+			}
+			folders = append(folders, rel)
+		}
+		return nil
+	})
+	sort.Strings(folders[1:])
+	return folders, err
+}
+
+// maildirFile is one message file in a folder.
+type maildirFile struct {
+	folder string
+	dir    string // "cur" or "new"
+	name   string // full file name, including the ":2," info
+}
+
+func (f maildirFile) unique() string {
+	u, _, _ := strings.Cut(f.name, ":")
+	return u
+}
+
+func (f maildirFile) flags() string {
+	_, info, ok := strings.Cut(f.name, ":2,")
+	if !ok {
+		return ""
+	}
+	return info
+}
+
+func (f maildirFile) id() string { return f.folder + "/" + f.unique() }
+
+func (b *maildirBackend) path(f maildirFile) string {
+	return filepath.Join(b.folderDir(f.folder), f.dir, f.name)
+}
+
+func (b *maildirBackend) files(folder string) ([]maildirFile, error) {
+	var files []maildirFile
+	for _, sub := range []string{"new", "cur"} {
+		entries, err := os.ReadDir(filepath.Join(b.folderDir(folder), sub))
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			if !e.IsDir() && !strings.HasPrefix(e.Name(), ".") {
+				files = append(files, maildirFile{folder: folder, dir: sub, name: e.Name()})
+			}
+		}
+	}
+	return files, nil
+}
+
+func (b *maildirBackend) lookup(id string) (maildirFile, error) {
+	i := strings.LastIndex(id, "/")
+	if i < 0 {
+		return maildirFile{}, fmt.Errorf("invalid message id %q", id)
+	}
+	folder, unique := id[:i], id[i+1:]
+	files, err := b.files(folder)
+	if err != nil {
+		return maildirFile{}, err
+	}
+	for _, f := range files {
+		if f.unique() == unique {
+			return f, nil
+		}
+	}
+	return maildirFile{}, fmt.Errorf("message %s: %w", id, errNotFound)
+}
+
+func flagsToMaildirLabels(folder, flags string) []string {
+	labels := []string{folder}
+	if !strings.Contains(flags, "S") {
+		labels = append(labels, "UNREAD")
+	}
+	if strings.Contains(flags, "F") {
+		labels = append(labels, "STARRED")
+	}
+	if strings.Contains(flags, "T") {
+		labels = append(labels, "TRASH")
+	}
+	return labels
+}
+
+// readMessage parses a message file. With headersOnly, only the header
+// block is read, which is enough for listing and metadata.
+func (b *maildirBackend) readMessage(f maildirFile, headersOnly bool) (*gmail.Message, error) {
+	var raw []byte
+	var err error
+	if headersOnly {
+		raw, err = readHeaderBlock(b.path(f))
+	} else {
+		raw, err = os.ReadFile(b.path(f))
+	}
+	if err != nil {
+		return nil, err
+	}
+	msg, err := messageFromRaw(raw)
+	if err != nil {
+		return nil, err
+	}
+	msg.Id, msg.ThreadId = f.id(), f.id()
+	msg.LabelIds = flagsToMaildirLabels(f.folder, f.flags())
+	if msg.InternalDate == 0 {
+		if fi, err := os.Stat(b.path(f)); err == nil {
+			msg.InternalDate = fi.ModTime().UnixMilli()
+		}
+	}
+	return msg, nil
+}
+
+func readHeaderBlock(path string) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var buf bytes.Buffer
+	r := bufio.NewReader(file)
+	for {
+		line, err := r.ReadString('\n')
+		buf.WriteString(line)
+		if strings.TrimRight(line, "\r\n") == "" || err != nil {
+			break
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+func (b *maildirBackend) ListMessages(query string, labelIDs []string, pageToken string, max int64) (*gmail.ListMessagesResponse, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	folder := folderFor(query, labelIDs)
+	switch strings.ToUpper(folder) {
+	case "UNREAD", "STARRED", "TRASH":
+		// Flag labels, not folders; trashed mail stays where it is, flagged T.
+		folder = "INBOX"
+	}
+	if containsFold(labelIDs, "TRASH") {
+		query += " in:trash"
+	}
+	query = stripFolderTerms(query)
+
+	files, err := b.files(folder)
+	if err != nil {
+		return nil, err
+	}
+
+	dir := b.folderDir(folder)
+	prev := b.listed[folder]
+	seen := make(map[string]listedMessage, len(files))
+	var msgs []*gmail.Message
+	for _, f := range files {
+		path := filepath.Join(dir, f.dir, f.name)
+		fi, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		l, ok := prev[path]
+		if !ok || !l.mtime.Equal(fi.ModTime()) {
+			msg, err := b.readMessage(f, true)
+			if err != nil {
+				continue
+			}
+			l = listedMessage{mtime: fi.ModTime(), msg: msg}
+		}
+		seen[path] = l
+		if !hasAllLabels(l.msg.LabelIds, labelIDs) || !matchesQuery(l.msg, query) {
+			continue
+		}
+		msgs = append(msgs, l.msg)
+	}
+	if b.listed == nil {
+		b.listed = map[string]map[string]listedMessage{}
+	}
+	b.listed[folder] = seen
+
+	sort.Slice(msgs, func(i, j int) bool {
+		if msgs[i].InternalDate != msgs[j].InternalDate {
+			return msgs[i].InternalDate > msgs[j].InternalDate
+		}
+		return msgs[i].Id < msgs[j].Id
+	})
+	ids := make([]*gmail.Message, len(msgs))
+	for i, msg := range msgs {
+		ids[i] = &gmail.Message{Id: msg.Id, ThreadId: msg.ThreadId}
+	}
+	return pageOf(ids, pageToken, max)
+}
+
+// stripFolderTerms drops in:/label: terms other than in:trash, which
+// folderFor has already turned into a directory.
+func stripFolderTerms(query string) string {
+	var kept []string
+	for _, term := range strings.Fields(query) {
+		op, arg, ok := strings.Cut(term, ":")
+		if ok && (strings.EqualFold(op, "in") || strings.EqualFold(op, "label")) && !strings.EqualFold(arg, "trash") {
+			continue
+		}
+		kept = append(kept, term)
+	}
+	return strings.Join(kept, " ")
+}
+
+func (b *maildirBackend) GetMessage(id, format string, metadataHeaders ...string) (*gmail.Message, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	f, err := b.lookup(id)
+	if err != nil {
+		return nil, err
+	}
+	msg, err := b.readMessage(f, format == "metadata" || format == "minimal")
+	if err != nil {
+		return nil, err
+	}
+	return formatMessage(msg, format, metadataHeaders), nil
+}
+
+// ModifyMessage rewrites the flags in the file name, moving the file from
+// new/ to cur/ as the Maildir spec requires once a message has been seen.
+func (b *maildirBackend) ModifyMessage(id string, addLabelIDs, removeLabelIDs []string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	f, err := b.lookup(id)
+	if err != nil {
+		return err
+	}
+
+	flags := f.flags()
+	set := func(flag string, on bool) {
+		flags = strings.ReplaceAll(flags, flag, "")
+		if on {
+			flags += flag
+		}
+	}
+	for _, l := range addLabelIDs {
+		switch l {
+		case "UNREAD":
+			set("S", false)
+		case "STARRED":
+			set("F", true)
+		case "TRASH":
+			set("T", true)
+		}
+	}
+	for _, l := range removeLabelIDs {
+		switch l {
+		case "UNREAD":
+			set("S", true)
+		case "STARRED":
+			set("F", false)
+		case "TRASH":
+			set("T", false)
+		}
+	}
+	// Flags must be in ASCII order.
+	sorted := []byte(flags)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	to := maildirFile{folder: f.folder, dir: "cur", name: f.unique() + ":2," + string(sorted)}
+	if to == f {
+		return nil
+	}
+	return os.Rename(b.path(f), b.path(to))
+}
+
+func (b *maildirBackend) TrashMessage(id string) error {
+	return b.ModifyMessage(id, []string{"TRASH"}, nil)
+}
+
+func (b *maildirBackend) ListLabels() ([]*gmail.Label, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	folders, err := b.folders()
+	if err != nil {
+		return nil, err
+	}
+	labels := make([]*gmail.Label, 0, len(folders)+3)
+	for _, f := range folders {
+		typ := "user"
+		if f == "INBOX" {
+			typ = "system"
+		}
+		labels = append(labels, &gmail.Label{Id: f, Name: f, Type: typ})
+	}
+	for _, id := range []string{"UNREAD", "STARRED", "TRASH"} {
+		labels = append(labels, &gmail.Label{Id: id, Name: id, Type: "system"})
+	}
+	return labels, nil
+}
+
+func (b *maildirBackend) GetAttachment(msgID, attachmentID string) ([]byte, error) {
+	msg, err := b.GetMessage(msgID, "full")
+	if err != nil {
+		return nil, err
+	}
+	part := findPartByAttachmentID(msg.Payload, attachmentID)
+	if part == nil {
+		return nil, fmt.Errorf("attachment %s: %w", attachmentID, errNotFound)
+	}
+	return base64.URLEncoding.DecodeString(part.Body.Data)
+}
+
+// SendMessage pipes the message to the sendmail command and delivers a
+// seen copy into the sent folder.
+func (b *maildirBackend) SendMessage(msg *gmail.Message) (*gmail.Message, error) {
+	raw, err := base64.URLEncoding.DecodeString(msg.Raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid raw message: %w", err)
+	}
+	if b.cfg.SendmailCommand == "" {
+		return nil, errors.New("sending is not configured for this maildir (set sendmail_command)")
+	}
+
+	cmd := exec.Command("sh", "-c", b.cfg.SendmailCommand)
+	cmd.Stdin = bytes.NewReader(raw)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("sendmail failed: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	f, err := b.deliver(b.cfg.SentFolder, stripHeader(raw, "Bcc"), "S")
+	if err != nil {
+		return nil, &sentCopyError{folder: b.cfg.SentFolder, err: err}
+	}
+	return &gmail.Message{Id: f.id(), ThreadId: f.id()}, nil
+}
+
+// deliver writes raw into folder via tmp/, creating the folder as a
+// Maildir++ subfolder if needed.
+func (b *maildirBackend) deliver(folder string, raw []byte, flags string) (maildirFile, error) {
+	dir := b.folderDir(folder)
+	if !isMaildir(dir) {
+		dir = filepath.Join(b.cfg.Path, "."+strings.ReplaceAll(folder, "/", "."))
+		for _, sub := range []string{"cur", "new", "tmp"} {
+			if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+				return maildirFile{}, err
+			}
+		}
+	}
+
+	host, _ := os.Hostname()
+	host = strings.NewReplacer("/", `\057`, ":", `\072`).Replace(host)
+	unique := fmt.Sprintf("%d.P%dQ%d.%s", time.Now().UnixNano(), os.Getpid(), maildirSeq.Add(1), host)
+
+	tmp := filepath.Join(dir, "tmp", unique)
+	if err := os.WriteFile(tmp, raw, 0600); err != nil {
+		return maildirFile{}, err
+	}
+	f := maildirFile{folder: folder, dir: "new", name: unique}
+	if flags != "" {
+		f = maildirFile{folder: folder, dir: "cur", name: unique + ":2," + flags}
+	}
+	if err := os.Rename(tmp, b.path(f)); err != nil {
+		os.Remove(tmp)
+		return maildirFile{}, err
+	}
+	return f, nil
+}
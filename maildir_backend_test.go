@@ -0,0 +1,221 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeMaildir creates the cur, new and tmp directories of a maildir.
+func writeMaildir(t *testing.T, dir string) {
+	t.Helper()
+	for _, sub := range []string{"cur", "new", "tmp"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func writeMessage(t *testing.T, path, raw string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(raw), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newTestMaildir lays out a tree like mbsync's: an unread and a read
+// message in INBOX, a Maildir++ ".Archive" folder and a nested "Lists/go".
+func newTestMaildir(t *testing.T) (*maildirBackend, string) {
+	t.Helper()
+	root := t.TempDir()
+	for _, dir := range []string{root, filepath.Join(root, ".Archive"), filepath.Join(root, "Lists", "go")} {
+		writeMaildir(t, dir)
+	}
+	writeMessage(t, filepath.Join(root, "new", "1700000002.M1.host"),
+		"From: Ann <ann@example.org>\r\nSubject: New hire\r\nDate: Tue, 14 Nov 2023 22:13:22 +0000\r\n\r\nPlease welcome Bo.\r\n")
+	writeMessage(t, filepath.Join(root, "cur", "1700000001.M2.host:2,S"),
+		"From: bob@example.org\r\nSubject: Parking\r\nDate: Tue, 14 Nov 2023 22:13:21 +0000\r\n\r\nThe garage is closed.\r\n")
+	writeMessage(t, filepath.Join(root, ".Archive", "cur", "1600000000.M3.host:2,FS"),
+		"From: carol@example.org\r\nSubject: Old plans\r\nDate: Sun, 13 Sep 2020 12:26:40 +0000\r\n\r\nFiled.\r\n")
+	writeMessage(t, filepath.Join(root, "Lists", "go", "new", "1700000003.M4.host"),
+		"From: golang-nuts@example.org\r\nSubject: Generics\r\nDate: Tue, 14 Nov 2023 22:13:23 +0000\r\n\r\nA question.\r\n")
+
+	cfg := &maildirConfig{Path: root, SendmailCommand: "cat > " + filepath.Join(root, "outgoing")}
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	b, err := newMaildirBackend(accountConfig{Name: "test", Type: "maildir", Maildir: cfg})
+	if err != nil {
+		t.Fatalf("newMaildirBackend: %v", err)
+	}
+	return b, root
+}
+
+func subjects(t *testing.T, b MailBackend, query string, labelIDs ...string) []string {
+	t.Helper()
+	list, err := b.ListMessages(query, labelIDs, "", pageSize)
+	if err != nil {
+		t.Fatalf("ListMessages(%q, %v): %v", query, labelIDs, err)
+	}
+	var subjects []string
+	for _, m := range list.Messages {
+		msg, err := b.GetMessage(m.Id, "metadata", "Subject")
+		if err != nil {
+			t.Fatalf("GetMessage(%s): %v", m.Id, err)
+		}
+		subjects = append(subjects, headerValue(msg.Payload.Headers, "Subject"))
+	}
+	return subjects
+}
+
+func TestMaildirListAndRead(t *testing.T) {
+	b, _ := newTestMaildir(t)
+
+	if got, want := subjects(t, b, inboxQuery), []string{"New hire", "Parking"}; !slices.Equal(got, want) {
+		t.Fatalf("INBOX lists %q, want %q", got, want)
+	}
+	if got := subjects(t, b, "is:unread"); !slices.Equal(got, []string{"New hire"}) {
+		t.Errorf("is:unread lists %q", got)
+	}
+
+	list, _ := b.ListMessages(inboxQuery, nil, "", pageSize)
+	msg, err := b.GetMessage(list.Messages[0].Id, "full")
+	if err != nil {
+		t.Fatalf("GetMessage: %v", err)
+	}
+	if body, _ := messageBody(msg.Payload); !strings.Contains(body, "Please welcome Bo.") {
+		t.Errorf("body = %q", body)
+	}
+	if !slices.Contains(msg.LabelIds, "UNREAD") {
+		t.Errorf("message in new/ has labels %v, want UNREAD", msg.LabelIds)
+	}
+}
+
+func TestMaildirFolders(t *testing.T) {
+	b, _ := newTestMaildir(t)
+
+	labels, err := b.ListLabels()
+	if err != nil {
+		t.Fatalf("ListLabels: %v", err)
+	}
+	var names []string
+	for _, l := range labels {
+		names = append(names, l.Name)
+	}
+	if want := []string{"INBOX", "Archive", "Lists/go", "UNREAD", "STARRED", "TRASH"}; !slices.Equal(names, want) {
+		t.Errorf("labels %q, want %q", names, want)
+	}
+	if got := subjects(t, b, "", "Archive"); !slices.Equal(got, []string{"Old plans"}) {
+		t.Errorf("Archive lists %q", got)
+	}
+	if got := subjects(t, b, "in:Lists/go"); !slices.Equal(got, []string{"Generics"}) {
+		t.Errorf("in:Lists/go lists %q", got)
+	}
+	if got := subjects(t, b, "", "STARRED"); !slices.Equal(got, nil) {
+		// Flag labels search INBOX, where nothing is starred.
+		t.Errorf("STARRED lists %q", got)
+	}
+}
+
+func TestMaildirModifyAndTrash(t *testing.T) {
+	b, root := newTestMaildir(t)
+	list, _ := b.ListMessages("is:unread", nil, "", pageSize)
+	id := list.Messages[0].Id
+
+	if err := b.ModifyMessage(id, []string{"STARRED"}, []string{"UNREAD"}); err != nil {
+		t.Fatalf("ModifyMessage: %v", err)
+	}
+	// Seen mail moves from new/ to cur/, with flags in ASCII order.
+	if _, err := os.Stat(filepath.Join(root, "cur", "1700000002.M1.host:2,FS")); err != nil {
+		t.Errorf("marked message not renamed: %v", err)
+	}
+	if got := subjects(t, b, "is:unread"); len(got) != 0 {
+		t.Errorf("is:unread lists %q after marking read", got)
+	}
+
+	if err := b.TrashMessage(id); err != nil {
+		t.Fatalf("TrashMessage: %v", err)
+	}
+	if got := subjects(t, b, inboxQuery); !slices.Equal(got, []string{"Parking"}) {
+		t.Errorf("INBOX lists %q after trashing", got)
+	}
+	if got := subjects(t, b, "", "TRASH"); !slices.Equal(got, []string{"New hire"}) {
+		t.Errorf("TRASH lists %q", got)
+	}
+	if _, err := os.Stat(filepath.Join(root, "cur", "1700000002.M1.host:2,FST")); err != nil {
+		t.Errorf("trashed message not flagged T: %v", err)
+	}
+}
+
+func TestMaildirSend(t *testing.T) {
+	b, root := newTestMaildir(t)
+
+	raw := "From: me@example.org\r\nTo: bob@example.org\r\nBcc: boss@example.org\r\nSubject: Lunch\r\n\r\nNoon?\r\n"
+	if _, err := b.SendMessage(rawMessage(raw)); err != nil {
+		t.Fatalf("SendMessage: %v", err)
+	}
+	out, err := os.ReadFile(filepath.Join(root, "outgoing"))
+	if err != nil || string(out) != raw {
+		t.Errorf("sendmail got %q, %v; want the message with its Bcc", out, err)
+	}
+
+	// The copy in Sent is read and keeps Bcc recipients private.
+	list, err := b.ListMessages("", []string{"Sent"}, "", pageSize)
+	if err != nil || len(list.Messages) != 1 {
+		t.Fatalf("Sent lists %v, %v", list, err)
+	}
+	msg, _ := b.GetMessage(list.Messages[0].Id, "full")
+	if headerValue(msg.Payload.Headers, "Bcc") != "" || slices.Contains(msg.LabelIds, "UNREAD") {
+		t.Errorf("sent copy has Bcc %q and labels %v", headerValue(msg.Payload.Headers, "Bcc"), msg.LabelIds)
+	}
+	if !isMaildir(filepath.Join(root, ".Sent")) {
+		t.Error("Sent was not created as a Maildir++ folder")
+	}
+}
+
+func TestMaildirSendFails(t *testing.T) {
+	b, root := newTestMaildir(t)
+	b.cfg.SendmailCommand = "echo 'no route to host' >&2; exit 75"
+
+	_, err := b.SendMessage(rawMessage("To: bob@example.org\r\nSubject: Lunch\r\n\r\nNoon?\r\n"))
+	if err == nil || !strings.Contains(err.Error(), "no route to host") {
+		t.Fatalf("got %v, want sendmail's error", err)
+	}
+	if isMaildir(filepath.Join(root, ".Sent")) {
+		t.Error("a copy was filed in Sent for mail that wasn't sent")
+	}
+}
+
+func TestMaildirListReusesHeaders(t *testing.T) {
+	b, root := newTestMaildir(t)
+	path := filepath.Join(root, "cur", "1700000001.M2.host:2,S")
+	count := func(query string) int {
+		t.Helper()
+		list, err := b.ListMessages(query, nil, "", pageSize)
+		if err != nil {
+			t.Fatalf("ListMessages(%q): %v", query, err)
+		}
+		return len(list.Messages)
+	}
+	if n := count("subject:parking"); n != 1 {
+		t.Fatalf("subject:parking lists %d", n)
+	}
+
+	// A file with the mtime it was listed with isn't read again.
+	fi, _ := os.Stat(path)
+	writeMessage(t, path, "From: bob@example.org\r\nSubject: Zoning\r\nDate: Tue, 14 Nov 2023 22:13:21 +0000\r\n\r\nNew text.\r\n")
+	os.Chtimes(path, fi.ModTime(), fi.ModTime())
+	if n := count("subject:parking"); n != 1 {
+		t.Errorf("subject:parking lists %d; the unchanged file was read again", n)
+	}
+
+	// One with a new mtime is.
+	later := fi.ModTime().Add(time.Second)
+	os.Chtimes(path, later, later)
+	if n, m := count("subject:parking"), count("subject:zoning"); n != 0 || m != 1 {
+		t.Errorf("after the file changed, subject:parking lists %d and subject:zoning %d", n, m)
+	}
+}
@@ -1,43 +1,110 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
+	"path/filepath"
 
 	tea "github.com/charmbracelet/bubbletea"
 	"google.golang.org/api/gmail/v1"
 )
 
 func main() {
-    // Initialize Gmail service
-    srv, err := getGmailService()
+    accountName := flag.String("account", "", "name of the account to open at startup")
+    configFlag := flag.String("config", "", "path to the config file (env GMAIL_TUI_CONFIG)")
+    credentialsFlag := flag.String("credentials", "", "path to the OAuth client credentials (env GMAIL_TUI_CREDENTIALS)")
+    flag.Parse()
+
+    configFile := resolveConfigFile(*configFlag)
+    cfg, err := loadConfig(configFile)
     if err != nil {
-        log.Fatalf("Failed to initialize Gmail service: %v", err)
+        log.Fatalf("Failed to load config: %v", err)
+    }
+    paths := resolvePaths(configFile, cfg, *credentialsFlag)
+    if err := cfg.applyDefaults(paths); err != nil {
+        log.Fatalf("Invalid config: %v", err)
     }
 
-    // Retrieve messages in the primary inbox
-    msgs, err := srv.Users.Messages.List("me").Q("in:inbox category:primary").MaxResults(10).Do()
+    active, err := cfg.accountIndex(*accountName)
     if err != nil {
-        log.Fatalf("Unable to retrieve messages: %v", err)
+        log.Fatalf("Failed to select account: %v", err)
+    }
+
+    switch flag.Arg(0) {
+    case "":
+    case "doctor":
+        fmt.Print(doctorReport(paths, cfg.Accounts))
+        return
+    case "login":
+        ac := cfg.Accounts[active]
+        if err := login(ac); err != nil {
+            log.Fatalf("Login failed: %v", err)
+        }
+        fmt.Printf("Logged in to %s.\n", ac.Name)
+        return
+    case "logout":
+        ac := cfg.Accounts[active]
+        if err := logout(ac); err != nil {
+            log.Fatalf("Logout failed: %v", err)
+        }
+        fmt.Printf("Logged out of %s.\n", ac.Name)
+        return
+    default:
+        log.Fatalf("Unknown command %q", flag.Arg(0))
+    }
+
+    // Connect a backend per account. Only the startup account is required
+    // to work; the others are skipped with a warning.
+    var accounts []*account
+    for i, ac := range cfg.Accounts {
+        backend, err := openBackend(ac)
+        if err != nil {
+            if i == active {
+                log.Fatalf("Failed to connect account %s: %v", ac.Name, err)
+            }
+            log.Printf("Warning: skipping account %s: %v", ac.Name, err)
+            continue
+        }
+        if ac.Type != "maildir" {
+            backend = withCache(backend, ac, paths, cfg.CacheSizeMB)
+        }
+        if i == active {
+            active = len(accounts)
+        }
+        accounts = append(accounts, &account{name: ac.Name, cfg: ac, backend: backend})
     }
+    backend := accounts[active].backend
 
-    var emailItems []*gmail.Message
-    if msgs != nil && len(msgs.Messages) > 0 {
-        emailItems = msgs.Messages
-    } else {
+    // Retrieve the first page of the primary inbox
+    inbox, err := backend.ListMessages(inboxQuery, nil, "", pageSize)
+    if err != nil {
+        log.Fatalf("Unable to retrieve messages: %v", err)
+    }
+    if len(inbox.Messages) == 0 {
         fmt.Println("No messages found in primary inbox.")
     }
 
     // Get labels
-    labels, err := srv.Users.Labels.List("me").Do()
+    labels, err := backend.ListLabels()
     if err != nil {
         log.Printf("Warning: couldn't fetch labels: %v", err)
-        labels = &gmail.ListLabelsResponse{} // Empty labels
+        labels = []*gmail.Label{} // Empty labels
+    }
+
+    // Changes queued while offline are replayed once the TUI starts.
+    ob, err := openOutbox(filepath.Join(paths.DataDir, "outbox.json"))
+    if err != nil {
+        log.Fatalf("Unable to read outbox: %v", err)
     }
 
     // Initialize the TUI program
-    p := tea.NewProgram(initialModel(emailItems, srv, labels.Labels))
+    m := initialModel(paths, accounts, active, inbox, labels, ob)
+    m.markdown = cfg.Markdown
+    m.opener = cfg.Opener
+    p := tea.NewProgram(m)
+    terminalBusy.Store(true)
     if _, err := p.Run(); err != nil {
         log.Fatalf("Error running TUI: %v", err)
     }
-}
\ No newline at end of file
+}
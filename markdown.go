@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"github.com/charmbracelet/bubbles/key"
+	"github.com/charmbracelet/bubbles/viewport"
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/glamour"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/renderer/html"
+)
+
+// markdown turns Markdown bodies into HTML. Line breaks are kept, as
+// people writing mail expect, and raw HTML in the source is dropped.
+var markdown = goldmark.New(
+	goldmark.WithExtensions(extension.GFM),
+	goldmark.WithRendererOptions(html.WithHardWraps()),
+)
+
+// markdownHTML renders a Markdown body as an HTML document.
+func markdownHTML(body string) (string, error) {
+	var b bytes.Buffer
+	b.WriteString("<!DOCTYPE html>\n<html>\n<head><meta charset=\"utf-8\"></head>\n<body>\n")
+	if err := markdown.Convert([]byte(body), &b); err != nil {
+		return "", fmt.Errorf("failed to render Markdown: %w", err)
+	}
+	b.WriteString("</body>\n</html>\n")
+	return b.String(), nil
+}
+
+// previewMarkdown renders body for the terminal in the style named by
+// GLAMOUR_STYLE, dark by default. The style isn't detected from the
+// terminal, since that would mean reading from it under Bubble Tea.
+func previewMarkdown(body string, width int) (string, error) {
+	style := os.Getenv("GLAMOUR_STYLE")
+	if style == "" {
+		style = "dark"
+	}
+	r, err := glamour.NewTermRenderer(
+		glamour.WithStylePath(style),
+		glamour.WithWordWrap(max(width-4, 20)),
+		glamour.WithPreservedNewLines(),
+	)
+	if err != nil {
+		return "", err
+	}
+	return r.Render(body)
+}
+
+// openPreview shows the body being composed or replied as the recipient
+// will see it.
+func (m *model) openPreview() tea.Cmd {
+	if !m.markdown {
+		return showStatus(severityWarning, "Markdown is off; [ctrl+t] turns it on")
+	}
+	body := m.composeBody.Value()
+	if m.state == replying {
+		body = m.replyBody.Value()
+	}
+	out, err := previewMarkdown(body, m.width)
+	if err != nil {
+		return showStatus(severityError, "Couldn't render the preview: "+err.Error())
+	}
+	m.previewViewport = viewport.New(m.width, max(m.height-5, 1))
+	m.previewViewport.SetContent(out)
+	m.previewReturn = m.state
+	m.state = previewing
+	return nil
+}
+
+func updatePreview(msg tea.Msg, m model) (tea.Model, tea.Cmd) {
+	if msg, ok := msg.(tea.KeyMsg); ok {
+		switch {
+		case key.Matches(msg, keys.Back), key.Matches(msg, keys.Preview):
+			m.state = m.previewReturn
+			return m, nil
+		case key.Matches(msg, keys.Quit):
+			return m, tea.Quit
+		}
+	}
+	var cmd tea.Cmd
+	m.previewViewport, cmd = m.previewViewport.Update(msg)
+	return m, cmd
+}
+
+func previewView(m model) string {
+	return "\n  Preview\n\n" + m.previewViewport.View() + "\n[↑/↓] scroll • [b] back\n"
+}
+
+// markdownStatus is the compose and reply screens' note on the mode.
+func (m model) markdownStatus() string {
+	if m.markdown {
+		return "Markdown on · [ctrl+r] preview • [ctrl+t] plain text\n"
+	}
+	return "Plain text · [ctrl+t] Markdown\n"
+}
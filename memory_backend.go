@@ -0,0 +1,510 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// memoryBackend is a MailBackend that keeps everything in memory. It lets
+// the Bubble Tea model be driven without network access, e.g. in tests:
+//
+//	b := newMemoryBackend()
+//	b.AddRaw([]byte("From: a@example.com\r\nSubject: hi\r\n\r\nbody"), "INBOX", "UNREAD")
+//	m := initialModel(paths, []*account{{name: "test", backend: b}}, 0, nil, nil, nil)
+type memoryBackend struct {
+	mu       sync.Mutex
+	messages []*gmail.Message // newest first
+	labels   []*gmail.Label
+	nextID   int
+
+	history   []*gmail.History
+	historyID uint64
+
+	drafts map[string]string // draft ID to message ID
+}
+
+func newMemoryBackend() *memoryBackend {
+	b := &memoryBackend{historyID: 1, drafts: make(map[string]string)}
+	for _, id := range []string{"INBOX", "SENT", "DRAFT", "TRASH", "UNREAD", "STARRED", "IMPORTANT"} {
+		b.labels = append(b.labels, &gmail.Label{Id: id, Name: id, Type: "system"})
+	}
+	return b
+}
+
+// AddRaw parses raw as an RFC 822 message and stores it with labelIDs.
+func (b *memoryBackend) AddRaw(raw []byte, labelIDs ...string) (*gmail.Message, error) {
+	msg, err := messageFromRaw(raw)
+	if err != nil {
+		return nil, err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.nextID++
+	msg.Id = fmt.Sprintf("%016x", b.nextID)
+	msg.ThreadId = msg.Id
+	msg.LabelIds = append([]string(nil), labelIDs...)
+	b.messages = append([]*gmail.Message{msg}, b.messages...)
+	b.record(&gmail.History{MessagesAdded: []*gmail.HistoryMessageAdded{{Message: historyRef(msg)}}})
+	return cloneMessage(msg), nil
+}
+
+// record appends a history entry; callers hold b.mu.
+func (b *memoryBackend) record(h *gmail.History) {
+	b.historyID++
+	h.Id = b.historyID
+	b.history = append(b.history, h)
+}
+
+func historyRef(msg *gmail.Message) *gmail.Message {
+	return &gmail.Message{Id: msg.Id, ThreadId: msg.ThreadId, LabelIds: append([]string(nil), msg.LabelIds...)}
+}
+
+// relabel applies a label change to msg and records it; callers hold b.mu.
+func (b *memoryBackend) relabel(msg *gmail.Message, add, remove []string) {
+	before := msg.LabelIds
+	msg.LabelIds = modifyLabels(before, add, remove)
+	h := &gmail.History{}
+	var added, removed []string
+	for _, l := range msg.LabelIds {
+		if !slices.Contains(before, l) {
+			added = append(added, l)
+		}
+	}
+	for _, l := range before {
+		if !slices.Contains(msg.LabelIds, l) {
+			removed = append(removed, l)
+		}
+	}
+	if len(added) > 0 {
+		h.LabelsAdded = []*gmail.HistoryLabelAdded{{Message: historyRef(msg), LabelIds: added}}
+	}
+	if len(removed) > 0 {
+		h.LabelsRemoved = []*gmail.HistoryLabelRemoved{{Message: historyRef(msg), LabelIds: removed}}
+	}
+	if h.LabelsAdded != nil || h.LabelsRemoved != nil {
+		b.record(h)
+	}
+}
+
+// AddLabel creates a user label.
+func (b *memoryBackend) AddLabel(name string) *gmail.Label {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	l := &gmail.Label{Id: "Label_" + strconv.Itoa(len(b.labels)+1), Name: name, Type: "user"}
+	b.labels = append(b.labels, l)
+	return l
+}
+
+func (b *memoryBackend) ListMessages(query string, labelIDs []string, pageToken string, max int64) (*gmail.ListMessagesResponse, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// Like Gmail, listing the TRASH label shows trashed mail.
+	if containsFold(labelIDs, "TRASH") {
+		query += " in:trash"
+	}
+	var matched []*gmail.Message
+	for _, msg := range b.messages {
+		if hasAllLabels(msg.LabelIds, labelIDs) && matchesQuery(msg, query) {
+			matched = append(matched, &gmail.Message{Id: msg.Id, ThreadId: msg.ThreadId})
+		}
+	}
+	return pageOf(matched, pageToken, max)
+}
+
+func (b *memoryBackend) find(id string) (*gmail.Message, error) {
+	for _, msg := range b.messages {
+		if msg.Id == id {
+			return msg, nil
+		}
+	}
+	return nil, fmt.Errorf("message %s: %w", id, errNotFound)
+}
+
+func (b *memoryBackend) GetMessage(id, format string, metadataHeaders ...string) (*gmail.Message, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	msg, err := b.find(id)
+	if err != nil {
+		return nil, err
+	}
+	return formatMessage(msg, format, metadataHeaders), nil
+}
+
+func (b *memoryBackend) SendMessage(msg *gmail.Message) (*gmail.Message, error) {
+	raw, err := base64.URLEncoding.DecodeString(msg.Raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid raw message: %w", err)
+	}
+	sent, err := b.AddRaw(raw, "SENT")
+	if err != nil {
+		return nil, err
+	}
+	if msg.ThreadId != "" {
+		b.mu.Lock()
+		if stored, err := b.find(sent.Id); err == nil {
+			stored.ThreadId = msg.ThreadId
+			sent.ThreadId = msg.ThreadId
+		}
+		b.mu.Unlock()
+	}
+	return sent, nil
+}
+
+func (b *memoryBackend) ModifyMessage(id string, addLabelIDs, removeLabelIDs []string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	msg, err := b.find(id)
+	if err != nil {
+		return err
+	}
+	b.relabel(msg, addLabelIDs, removeLabelIDs)
+	return nil
+}
+
+func (b *memoryBackend) TrashMessage(id string) error {
+	return b.ModifyMessage(id, []string{"TRASH"}, []string{"INBOX"})
+}
+
+func (b *memoryBackend) ListLabels() ([]*gmail.Label, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	labels := make([]*gmail.Label, len(b.labels))
+	for i, l := range b.labels {
+		c := *l
+		labels[i] = &c
+	}
+	return labels, nil
+}
+
+func (b *memoryBackend) GetAttachment(msgID, attachmentID string) ([]byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	msg, err := b.find(msgID)
+	if err != nil {
+		return nil, err
+	}
+	part := findPartByAttachmentID(msg.Payload, attachmentID)
+	if part == nil {
+		return nil, fmt.Errorf("attachment %s: %w", attachmentID, errNotFound)
+	}
+	return base64.URLEncoding.DecodeString(part.Body.Data)
+}
+
+// ListThreads lists the threads with at least one matching message, most
+// recently active first.
+func (b *memoryBackend) ListThreads(query string, labelIDs []string, pageToken string, max int64) (*gmail.ListThreadsResponse, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	seen := make(map[string]bool)
+	var ids []*gmail.Message
+	for _, msg := range b.messages {
+		if !seen[msg.ThreadId] && hasAllLabels(msg.LabelIds, labelIDs) && matchesQuery(msg, query) {
+			seen[msg.ThreadId] = true
+			ids = append(ids, &gmail.Message{Id: msg.ThreadId})
+		}
+	}
+	page, err := pageOf(ids, pageToken, max)
+	if err != nil {
+		return nil, err
+	}
+	resp := &gmail.ListThreadsResponse{NextPageToken: page.NextPageToken, ResultSizeEstimate: page.ResultSizeEstimate}
+	for _, m := range page.Messages {
+		resp.Threads = append(resp.Threads, &gmail.Thread{Id: m.Id})
+	}
+	return resp, nil
+}
+
+func (b *memoryBackend) GetThread(id, format string, metadataHeaders ...string) (*gmail.Thread, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	t := &gmail.Thread{Id: id}
+	for i := len(b.messages) - 1; i >= 0; i-- {
+		if msg := b.messages[i]; msg.ThreadId == id {
+			t.Messages = append(t.Messages, formatMessage(msg, format, metadataHeaders))
+		}
+	}
+	if len(t.Messages) == 0 {
+		return nil, fmt.Errorf("thread %s: %w", id, errNotFound)
+	}
+	t.Snippet = t.Messages[len(t.Messages)-1].Snippet
+	return t, nil
+}
+
+func (b *memoryBackend) ModifyThread(id string, addLabelIDs, removeLabelIDs []string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	found := false
+	for _, msg := range b.messages {
+		if msg.ThreadId == id {
+			b.relabel(msg, addLabelIDs, removeLabelIDs)
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("thread %s: %w", id, errNotFound)
+	}
+	return nil
+}
+
+func (b *memoryBackend) TrashThread(id string) error {
+	return b.ModifyThread(id, []string{"TRASH"}, []string{"INBOX"})
+}
+
+// remove deletes message id for good; callers hold b.mu.
+func (b *memoryBackend) remove(id string) {
+	for i, msg := range b.messages {
+		if msg.Id == id {
+			b.messages = slices.Delete(b.messages, i, i+1)
+			b.record(&gmail.History{MessagesDeleted: []*gmail.HistoryMessageDeleted{{Message: historyRef(msg)}}})
+			return
+		}
+	}
+}
+
+func (b *memoryBackend) ListDrafts() ([]*gmail.Draft, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var drafts []*gmail.Draft
+	for _, msg := range b.messages {
+		for id, msgID := range b.drafts {
+			if msgID == msg.Id {
+				drafts = append(drafts, &gmail.Draft{Id: id, Message: &gmail.Message{Id: msg.Id, ThreadId: msg.ThreadId}})
+			}
+		}
+	}
+	return drafts, nil
+}
+
+// SaveDraft replaces the message of an existing draft, as Gmail does.
+func (b *memoryBackend) SaveDraft(id string, msg *gmail.Message) (*gmail.Draft, error) {
+	raw, err := base64.URLEncoding.DecodeString(msg.Raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid raw message: %w", err)
+	}
+	b.mu.Lock()
+	old, ok := b.drafts[id]
+	b.mu.Unlock()
+	if id != "" && !ok {
+		return nil, fmt.Errorf("draft %s: %w", id, errNotFound)
+	}
+	saved, err := b.AddRaw(raw, "DRAFT")
+	if err != nil {
+		return nil, err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if id == "" {
+		id = "r" + saved.Id
+	} else {
+		b.remove(old)
+	}
+	b.drafts[id] = saved.Id
+	return &gmail.Draft{Id: id, Message: saved}, nil
+}
+
+func (b *memoryBackend) SendDraft(id string, msg *gmail.Message) (*gmail.Message, error) {
+	if err := b.DeleteDraft(id); err != nil {
+		return nil, err
+	}
+	return b.SendMessage(msg)
+}
+
+func (b *memoryBackend) DeleteDraft(id string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	msgID, ok := b.drafts[id]
+	if !ok {
+		return fmt.Errorf("draft %s: %w", id, errNotFound)
+	}
+	delete(b.drafts, id)
+	b.remove(msgID)
+	return nil
+}
+
+func (b *memoryBackend) HistoryID() (uint64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.historyID, nil
+}
+
+// ListHistory returns every change after startHistoryID in one page; the
+// in-memory log is never truncated, so IDs don't expire.
+func (b *memoryBackend) ListHistory(startHistoryID uint64, pageToken string) (*gmail.ListHistoryResponse, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	resp := &gmail.ListHistoryResponse{HistoryId: b.historyID}
+	for _, h := range b.history {
+		if h.Id > startHistoryID {
+			resp.History = append(resp.History, h)
+		}
+	}
+	return resp, nil
+}
+
+// cloneMessage deep-copies msg so callers can't mutate backend state.
+func cloneMessage(msg *gmail.Message) *gmail.Message {
+	b, _ := json.Marshal(msg)
+	c := &gmail.Message{}
+	json.Unmarshal(b, c)
+	return c
+}
+
+// formatMessage trims a fully populated message down to what the Gmail API
+// would return for format.
+func formatMessage(msg *gmail.Message, format string, metadataHeaders []string) *gmail.Message {
+	c := cloneMessage(msg)
+	switch format {
+	case "minimal":
+		c.Payload = nil
+		c.Raw = ""
+	case "metadata":
+		c.Raw = ""
+		if c.Payload != nil {
+			var headers []*gmail.MessagePartHeader
+			for _, h := range c.Payload.Headers {
+				if len(metadataHeaders) == 0 || containsFold(metadataHeaders, h.Name) {
+					headers = append(headers, h)
+				}
+			}
+			c.Payload = &gmail.MessagePart{MimeType: c.Payload.MimeType, Headers: headers}
+		}
+	case "raw":
+		c.Payload = nil
+	default:
+		c.Raw = ""
+	}
+	return c
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasAllLabels(have, want []string) bool {
+	for _, w := range want {
+		found := false
+		for _, h := range have {
+			if h == w {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func modifyLabels(labels, add, remove []string) []string {
+	var out []string
+	for _, l := range labels {
+		if !containsFold(remove, l) {
+			out = append(out, l)
+		}
+	}
+	for _, a := range add {
+		if !hasAllLabels(out, []string{a}) {
+			out = append(out, a)
+		}
+	}
+	return out
+}
+
+// pageOf slices a result list for backends without server-side paging;
+// page tokens are plain offsets.
+func pageOf(all []*gmail.Message, pageToken string, max int64) (*gmail.ListMessagesResponse, error) {
+	start := 0
+	if pageToken != "" {
+		n, err := strconv.Atoi(pageToken)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid page token %q", pageToken)
+		}
+		start = n
+	}
+	if start > len(all) {
+		start = len(all)
+	}
+	end := len(all)
+	if max > 0 && start+int(max) < end {
+		end = start + int(max)
+	}
+	resp := &gmail.ListMessagesResponse{
+		Messages:           all[start:end],
+		ResultSizeEstimate: int64(len(all)),
+	}
+	if end < len(all) {
+		resp.NextPageToken = strconv.Itoa(end)
+	}
+	return resp, nil
+}
+
+// matchesQuery implements a small subset of Gmail search for local
+// backends: in:, label:, is:unread/read/starred, from:, to:, subject: and
+// free text, all case-insensitive. Trashed mail only matches in:trash.
+func matchesQuery(msg *gmail.Message, query string) bool {
+	var headers []*gmail.MessagePartHeader
+	if msg.Payload != nil {
+		headers = msg.Payload.Headers
+	}
+	has := func(label string) bool { return containsFold(msg.LabelIds, label) }
+
+	wantTrash := false
+	for _, term := range strings.Fields(query) {
+		op, arg, ok := strings.Cut(term, ":")
+		if !ok {
+			op, arg = "", term
+		}
+		arg = strings.ToLower(strings.Trim(arg, `"`))
+		switch strings.ToLower(op) {
+		case "in", "label":
+			if arg == "trash" {
+				wantTrash = true
+			}
+			if !has(arg) && !has(strings.ToUpper(arg)) {
+				return false
+			}
+		case "is":
+			switch arg {
+			case "unread":
+				if !has("UNREAD") {
+					return false
+				}
+			case "read":
+				if has("UNREAD") {
+					return false
+				}
+			case "starred":
+				if !has("STARRED") {
+					return false
+				}
+			}
+		case "category":
+			// Local mailboxes have no tabs; treat every message as primary.
+		case "from", "to", "subject":
+			if !strings.Contains(strings.ToLower(decodeHeader(headerValue(headers, op))), arg) {
+				return false
+			}
+		default:
+			text := strings.ToLower(decodeHeader(headerValue(headers, "Subject")) + " " + decodeHeader(headerValue(headers, "From")) + " " + msg.Snippet)
+			if !strings.Contains(text, strings.ToLower(term)) {
+				return false
+			}
+		}
+	}
+	return wantTrash || !has("TRASH")
+}
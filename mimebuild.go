@@ -0,0 +1,385 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// maxAttachmentSize is Gmail's limit on a message's attachments, taken
+// together and as encoded for sending.
+const maxAttachmentSize = 25 * 1024 * 1024
+
+// encodedSize is the size of n bytes in base64, without line breaks.
+func encodedSize(n int64) int64 { return (n + 2) / 3 * 4 }
+
+// checkAttachmentSize fails if files, with other parts of extra encoded
+// bytes, come to more than maxAttachmentSize once encoded.
+func checkAttachmentSize(files []string, extra int64) error {
+	total := extra
+	for _, path := range files {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return fmt.Errorf("failed to read attachment: %w", err)
+		}
+		total += encodedSize(fi.Size())
+	}
+	if total > maxAttachmentSize {
+		return fmt.Errorf("attachments too large: %dMB together once encoded (max %dMB)", (total+1<<20-1)>>20, maxAttachmentSize/1024/1024)
+	}
+	return nil
+}
+
+// partsSize is the encoded size of parts.
+func partsSize(parts []mimePart) int64 {
+	var n int64
+	for _, p := range parts {
+		n += encodedSize(int64(len(p.data)))
+	}
+	return n
+}
+
+// mailMessage is an outgoing message as the builder takes it. Headers are
+// plain UTF-8; the builder does the RFC 2047 encoding and folding.
+type mailMessage struct {
+	from, to, cc, bcc string
+	subject           string
+	date              time.Time
+	messageID         string
+	inReplyTo         string
+	references        string
+
+	text string
+	// html, when set, is sent as an alternative to text, together with
+	// the inline parts it refers to by Content-ID.
+	html        string
+	inline      []mimePart
+	attachments []mimePart
+}
+
+// mimeEntity is one node of the MIME tree: a leaf with an encoded body or
+// a multipart with a boundary chosen up front, so that the parent can
+// write the child's header before the child's writer exists.
+type mimeEntity struct {
+	header   textproto.MIMEHeader
+	body     []byte
+	boundary string
+	parts    []*mimeEntity
+}
+
+// buildMessage renders out as an RFC 822 message.
+func buildMessage(b MailBackend, out outgoing) ([]byte, error) {
+	var attachments []mimePart
+	for _, path := range out.attachments {
+		part, err := fileAttachment(path)
+		if err != nil {
+			return nil, err
+		}
+		attachments = append(attachments, part)
+	}
+	forwarded, err := out.forward.parts(b)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkAttachmentSize(nil, partsSize(slices.Concat(attachments, out.kept, forwarded))); err != nil {
+		return nil, err
+	}
+	msg := &mailMessage{
+		from:        out.from,
+		to:          out.to,
+		cc:          out.cc,
+		bcc:         out.bcc,
+		subject:     out.subject,
+		date:        time.Now(),
+		messageID:   newMessageID(out.from),
+		inReplyTo:   out.inReplyTo,
+		references:  out.references,
+		text:        out.body,
+		attachments: slices.Concat(attachments, out.kept, forwarded),
+	}
+	if out.markdown {
+		if msg.html, err = markdownHTML(out.body); err != nil {
+			return nil, err
+		}
+		if msg.html, msg.inline, err = inlineImages(msg.html, msg.messageID); err != nil {
+			return nil, err
+		}
+	}
+	return msg.bytes()
+}
+
+// imageSource matches the images in HTML rendered from Markdown.
+var imageSource = regexp.MustCompile(`<img src="([^"]*)"`)
+
+// inlineImages embeds the local files that body shows as images, so that
+// ![chart](~/chart.png) in a Markdown body arrives with the message. Each
+// file becomes an inline part, with a Content-ID made from messageID, and
+// its src a cid: URL. Web and data URLs are left as they are.
+func inlineImages(body, messageID string) (string, []mimePart, error) {
+	var parts []mimePart
+	var err error
+	body = imageSource.ReplaceAllStringFunc(body, func(tag string) string {
+		src := imageSource.FindStringSubmatch(tag)[1]
+		u, perr := url.Parse(html.UnescapeString(src))
+		if err != nil || perr != nil || u.Scheme != "" || u.Path == "" {
+			return tag
+		}
+		part, ferr := fileAttachment(expandHome(u.Path))
+		if ferr != nil {
+			err = ferr
+			return tag
+		}
+		cid := fmt.Sprintf("image%d.%s", len(parts)+1, strings.Trim(messageID, "<>"))
+		_, params, _ := mime.ParseMediaType(part.header.Get("Content-Disposition"))
+		part.header.Set("Content-Disposition", mime.FormatMediaType("inline", params))
+		part.header.Set("Content-ID", "<"+cid+">")
+		parts = append(parts, part)
+		return `<img src="cid:` + html.EscapeString(cid) + `"`
+	})
+	return body, parts, err
+}
+
+func (msg *mailMessage) bytes() ([]byte, error) {
+	var b bytes.Buffer
+	if err := msg.writeTo(&b); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func (msg *mailMessage) writeTo(w io.Writer) error {
+	var h bytes.Buffer
+	writeField(&h, "From", formatAddresses(msg.from))
+	writeField(&h, "To", formatAddresses(msg.to))
+	writeField(&h, "Cc", formatAddresses(msg.cc))
+	writeField(&h, "Bcc", formatAddresses(msg.bcc))
+	writeField(&h, "Subject", mime.QEncoding.Encode("utf-8", msg.subject))
+	if !msg.date.IsZero() {
+		writeField(&h, "Date", msg.date.Format(time.RFC1123Z))
+	}
+	writeField(&h, "Message-ID", msg.messageID)
+	writeField(&h, "In-Reply-To", msg.inReplyTo)
+	writeField(&h, "References", msg.references)
+	writeField(&h, "MIME-Version", "1.0")
+
+	e := msg.entity()
+	for _, k := range sortedKeys(e.header) {
+		writeField(&h, k, e.header.Get(k))
+	}
+	h.WriteString("\r\n")
+	if _, err := w.Write(h.Bytes()); err != nil {
+		return err
+	}
+	return e.writeBody(w)
+}
+
+// entity lays the message out as
+//
+//	multipart/mixed            (only with attachments)
+//	  multipart/alternative    (only with html)
+//	    text/plain
+//	    multipart/related      (only with inline parts)
+//	      text/html
+//	      inline parts
+//	  attachments
+func (msg *mailMessage) entity() *mimeEntity {
+	body := textEntity("plain", msg.text)
+	if msg.html != "" {
+		html := textEntity("html", msg.html)
+		if len(msg.inline) > 0 {
+			html = multipartEntity("related", map[string]string{"type": "text/html"},
+				append([]*mimeEntity{html}, partEntities(msg.inline)...))
+		}
+		body = multipartEntity("alternative", nil, []*mimeEntity{body, html})
+	}
+	if len(msg.attachments) == 0 {
+		return body
+	}
+	return multipartEntity("mixed", nil, append([]*mimeEntity{body}, partEntities(msg.attachments)...))
+}
+
+func textEntity(subtype, text string) *mimeEntity {
+	var b bytes.Buffer
+	qp := quotedprintable.NewWriter(&b)
+	qp.Write([]byte(text))
+	qp.Close()
+	h := textproto.MIMEHeader{}
+	h.Set("Content-Type", mime.FormatMediaType("text/"+subtype, map[string]string{"charset": "utf-8"}))
+	h.Set("Content-Transfer-Encoding", "quoted-printable")
+	return &mimeEntity{header: h, body: b.Bytes()}
+}
+
+// newBoundary picks a random multipart boundary. Tests replace it to get
+// the same message every time.
+var newBoundary = func() string {
+	return multipart.NewWriter(io.Discard).Boundary()
+}
+
+func multipartEntity(subtype string, params map[string]string, parts []*mimeEntity) *mimeEntity {
+	boundary := newBoundary()
+	all := map[string]string{"boundary": boundary}
+	for k, v := range params {
+		all[k] = v
+	}
+	h := textproto.MIMEHeader{}
+	h.Set("Content-Type", mime.FormatMediaType("multipart/"+subtype, all))
+	return &mimeEntity{header: h, boundary: boundary, parts: parts}
+}
+
+// partEntities encodes parts as their headers ask: base64 in lines of 76,
+// or as is.
+func partEntities(parts []mimePart) []*mimeEntity {
+	entities := make([]*mimeEntity, len(parts))
+	for i, p := range parts {
+		body := p.data
+		if strings.EqualFold(p.header.Get("Content-Transfer-Encoding"), "base64") {
+			body = wrapBase64(p.data)
+		}
+		entities[i] = &mimeEntity{header: p.header, body: body}
+	}
+	return entities
+}
+
+func (e *mimeEntity) writeBody(w io.Writer) error {
+	if e.parts == nil {
+		_, err := w.Write(e.body)
+		return err
+	}
+	mw := multipart.NewWriter(w)
+	if err := mw.SetBoundary(e.boundary); err != nil {
+		return err
+	}
+	for _, p := range e.parts {
+		pw, err := mw.CreatePart(p.header)
+		if err != nil {
+			return err
+		}
+		if err := p.writeBody(pw); err != nil {
+			return err
+		}
+	}
+	return mw.Close()
+}
+
+// fileAttachment reads a local file as an attachment part.
+func fileAttachment(path string) (mimePart, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return mimePart{}, fmt.Errorf("failed to read attachment: %w", err)
+	}
+	if len(data) > maxAttachmentSize {
+		return mimePart{}, fmt.Errorf("attachment too large: %s (max %dMB)", filepath.Base(path), maxAttachmentSize/1024/1024)
+	}
+	name := filepath.Base(path)
+	mimeType := mime.TypeByExtension(filepath.Ext(path))
+	if mimeType == "" {
+		mimeType = "application/octet-stream"
+	}
+	return attachmentPart(mimeType, name, data), nil
+}
+
+// attachmentPart is data attached as name, base64 encoded.
+func attachmentPart(mimeType, name string, data []byte) mimePart {
+	h := textproto.MIMEHeader{}
+	if mt, params, err := mime.ParseMediaType(mimeType); err == nil {
+		params["name"] = name
+		h.Set("Content-Type", mime.FormatMediaType(mt, params))
+	} else {
+		h.Set("Content-Type", "application/octet-stream")
+	}
+	h.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+	h.Set("Content-Transfer-Encoding", "base64")
+	return mimePart{header: h, data: data}
+}
+
+func wrapBase64(data []byte) []byte {
+	enc := base64.StdEncoding.EncodeToString(data)
+	var b bytes.Buffer
+	for len(enc) > 76 {
+		b.WriteString(enc[:76] + "\r\n")
+		enc = enc[76:]
+	}
+	b.WriteString(enc)
+	return b.Bytes()
+}
+
+// formatAddresses re-renders an address list with encoded display names.
+// A list that doesn't parse, as in a draft being written, is kept as
+// typed.
+func formatAddresses(s string) string {
+	if strings.TrimSpace(s) == "" {
+		return ""
+	}
+	list, err := mail.ParseAddressList(s)
+	if err != nil {
+		return mime.QEncoding.Encode("utf-8", s)
+	}
+	out := make([]string, len(list))
+	for i, a := range list {
+		if a.Name == "" {
+			out[i] = a.Address
+		} else {
+			out[i] = a.String()
+		}
+	}
+	return strings.Join(out, ", ")
+}
+
+// writeField writes a header field, folded at spaces to keep lines under
+// 78 characters where it can. Empty fields are left out.
+func writeField(b *bytes.Buffer, name, value string) {
+	if value == "" {
+		return
+	}
+	if len(name)+2+len(value) <= 78 {
+		b.WriteString(name + ": " + value + "\r\n")
+		return
+	}
+	line := name + ":"
+	for _, word := range strings.Fields(value) {
+		if len(line)+1+len(word) > 76 && strings.Contains(line, " ") {
+			b.WriteString(line + "\r\n")
+			line = ""
+		}
+		line += " " + word
+	}
+	b.WriteString(line + "\r\n")
+}
+
+func sortedKeys(h textproto.MIMEHeader) []string {
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// newMessageID makes a Message-ID in the domain of from.
+func newMessageID(from string) string {
+	domain := "localhost"
+	if list := parseAddresses(from); len(list) > 0 {
+		if _, d, ok := strings.Cut(list[0].Address, "@"); ok {
+			domain = d
+		}
+	}
+	var id [16]byte
+	rand.Read(id[:])
+	return fmt.Sprintf("<%s@%s>", hex.EncodeToString(id[:]), domain)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// fixedBoundaries makes multipart boundaries predictable for the length
+// of the test.
+func fixedBoundaries(t *testing.T) {
+	t.Helper()
+	saved, n := newBoundary, 0
+	newBoundary = func() string {
+		n++
+		return fmt.Sprintf("boundary%d", n)
+	}
+	t.Cleanup(func() { newBoundary = saved })
+}
+
+// checkGolden compares got with testdata/name.golden.
+func checkGolden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", name+".golden")
+	if *update {
+		if err := os.WriteFile(path, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v (run go test -update to create it)", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s differs from %s:\n%s", name, path, got)
+	}
+}
+
+func TestBuildMessage(t *testing.T) {
+	dir := t.TempDir()
+	chart := filepath.Join(dir, "chart.png")
+	if err := os.WriteFile(chart, []byte("\x89PNG\r\n\x1a\nnot really a chart"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	base := func() *mailMessage {
+		return &mailMessage{
+			from:       "Zoë Müller <zoe@example.org>",
+			to:         "bob@example.org, \"Smith, Ann\" <ann@example.org>",
+			subject:    "Café menu for Friday's offsite — please vote before noon so we can order",
+			date:       time.Date(2024, 3, 1, 9, 30, 0, 0, time.UTC),
+			messageID:  "<0123456789abcdef@example.org>",
+			inReplyTo:  "<parent@example.org>",
+			references: "<root@example.org> <parent@example.org>",
+			text:       "Soup: €4,50\nA line long enough to need a soft line break in quoted-printable, which wraps at 76.\n",
+		}
+	}
+	for _, tc := range []struct {
+		name  string
+		build func(*mailMessage) error
+	}{
+		{"plain", func(*mailMessage) error { return nil }},
+		{"alternative", func(msg *mailMessage) error {
+			msg.html = "<p>Soup: <b>€4,50</b></p>\n"
+			return nil
+		}},
+		{"attachments", func(msg *mailMessage) error {
+			msg.attachments = []mimePart{
+				attachmentPart("text/csv", "votes.csv", []byte("dish,votes\nsoup,3\n")),
+				attachmentPart("application/octet-stream", "menü.bin", bytes.Repeat([]byte{0, 1, 2, 3}, 30)),
+			}
+			return nil
+		}},
+		{"related", func(msg *mailMessage) (err error) {
+			body := fmt.Sprintf("<p><img src=%q alt=\"chart\"> <img src=\"https://example.org/logo.png\" alt=\"logo\"></p>\n", chart)
+			msg.html, msg.inline, err = inlineImages(body, msg.messageID)
+			msg.attachments = []mimePart{attachmentPart("text/csv", "votes.csv", []byte("dish,votes\n"))}
+			return err
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fixedBoundaries(t)
+			msg := base()
+			if err := tc.build(msg); err != nil {
+				t.Fatal(err)
+			}
+			raw, err := msg.bytes()
+			if err != nil {
+				t.Fatalf("bytes: %v", err)
+			}
+			checkGolden(t, tc.name, raw)
+		})
+	}
+}
+
+func TestInlineImagesMissingFile(t *testing.T) {
+	_, _, err := inlineImages(`<p><img src="`+filepath.Join(t.TempDir(), "gone.png")+`" alt=""></p>`, "<id@example.org>")
+	if err == nil {
+		t.Error("an image that can't be read was left out silently")
+	}
+}
+
+func TestAttachmentsTooLargeTogether(t *testing.T) {
+	dir := t.TempDir()
+	var files []string
+	for _, name := range []string{"a.bin", "b.bin"} {
+		path := filepath.Join(dir, name)
+		// Each is under the limit, and so are both before encoding.
+		if err := os.WriteFile(path, make([]byte, 10<<20), 0600); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, path)
+	}
+	if err := checkAttachmentSize(files[:1], 0); err != nil {
+		t.Errorf("one file: %v", err)
+	}
+	if err := checkAttachmentSize(files, 0); err == nil {
+		t.Error("two files of 10MB, 26.7MB encoded, were let through")
+	}
+	out := outgoing{to: "bob@example.org", attachments: files}
+	if _, err := buildMessage(newMemoryBackend(), out); err == nil {
+		t.Error("buildMessage built a message over the limit")
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"sort"
+	"strings"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// messageFromRaw parses an RFC 822 message into the same shape the Gmail
+// API returns for Format("full"), with Raw also filled in. Backends that
+// store plain MIME use it so the rest of the app only deals with
+// gmail.Message.
+func messageFromRaw(raw []byte) (*gmail.Message, error) {
+	br := bufio.NewReader(bytes.NewReader(raw))
+	headers, mh, err := readHeaders(br)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse message headers: %w", err)
+	}
+
+	payload, err := parsePart("", headers, mh, br)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := &gmail.Message{
+		Payload:      payload,
+		Raw:          base64.URLEncoding.EncodeToString(raw),
+		SizeEstimate: int64(len(raw)),
+		Snippet:      makeSnippet(extractPlainText(payload)),
+	}
+	if d, err := mail.ParseDate(mh.Get("Date")); err == nil {
+		msg.InternalDate = d.UnixMilli()
+	}
+	return msg, nil
+}
+
+// readHeaders reads a header block, keeping the original order, which
+// textproto.MIMEHeader does not.
+func readHeaders(br *bufio.Reader) ([]*gmail.MessagePartHeader, textproto.MIMEHeader, error) {
+	var headers []*gmail.MessagePartHeader
+	mh := textproto.MIMEHeader{}
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, nil, err
+		}
+		trimmed := strings.TrimRight(line, "\r\n")
+		if trimmed == "" {
+			break
+		}
+		if (trimmed[0] == ' ' || trimmed[0] == '\t') && len(headers) > 0 {
+			// Folded continuation of the previous header.
+			h := headers[len(headers)-1]
+			h.Value += " " + strings.TrimSpace(trimmed)
+			vals := mh[textproto.CanonicalMIMEHeaderKey(h.Name)]
+			vals[len(vals)-1] = h.Value
+		} else if name, value, ok := strings.Cut(trimmed, ":"); ok {
+			h := &gmail.MessagePartHeader{Name: strings.TrimSpace(name), Value: strings.TrimSpace(value)}
+			headers = append(headers, h)
+			mh.Add(h.Name, h.Value)
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	return headers, mh, nil
+}
+
+func parsePart(partID string, headers []*gmail.MessagePartHeader, mh textproto.MIMEHeader, body io.Reader) (*gmail.MessagePart, error) {
+	part := &gmail.MessagePart{
+		PartId:  partID,
+		Headers: headers,
+		Body:    &gmail.MessagePartBody{},
+	}
+
+	mediaType, params, err := mime.ParseMediaType(mh.Get("Content-Type"))
+	if err != nil {
+		mediaType, params = "text/plain", map[string]string{}
+	}
+	part.MimeType = mediaType
+	if _, dparams, err := mime.ParseMediaType(mh.Get("Content-Disposition")); err == nil {
+		part.Filename = dparams["filename"]
+	}
+	if part.Filename == "" {
+		part.Filename = params["name"]
+	}
+	// Some mailers put encoded words in quoted parameters too.
+	part.Filename = decodeHeader(part.Filename)
+
+	if strings.HasPrefix(mediaType, "multipart/") && params["boundary"] != "" {
+		mr := multipart.NewReader(body, params["boundary"])
+		for i := 0; ; i++ {
+			p, err := mr.NextRawPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("failed to read MIME part: %w", err)
+			}
+			childID := fmt.Sprint(i)
+			if partID != "" {
+				childID = partID + "." + childID
+			}
+			child, err := parsePart(childID, partHeaders(p.Header), p.Header, p)
+			if err != nil {
+				return nil, err
+			}
+			part.Parts = append(part.Parts, child)
+		}
+		return part, nil
+	}
+
+	data, err := io.ReadAll(transferDecoder(mh.Get("Content-Transfer-Encoding"), body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode MIME part: %w", err)
+	}
+	part.Body.Size = int64(len(data))
+	part.Body.Data = base64.URLEncoding.EncodeToString(data)
+	if part.Filename != "" {
+		part.Body.AttachmentId = "part-" + partID
+	}
+	return part, nil
+}
+
+// partHeaders converts a multipart header map. Order within a part is not
+// preserved by mime/multipart, so headers are sorted by name.
+func partHeaders(h textproto.MIMEHeader) []*gmail.MessagePartHeader {
+	var headers []*gmail.MessagePartHeader
+	for name, values := range h {
+		for _, v := range values {
+			headers = append(headers, &gmail.MessagePartHeader{Name: name, Value: v})
+		}
+	}
+	sort.SliceStable(headers, func(i, j int) bool { return headers[i].Name < headers[j].Name })
+	return headers
+}
+
+func transferDecoder(encoding string, r io.Reader) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, &base64Cleaner{r: r})
+	case "quoted-printable":
+		return quotedprintable.NewReader(r)
+	default:
+		return r
+	}
+}
+
+// base64Cleaner drops line breaks and whitespace so base64.NewDecoder can
+// read MIME-wrapped base64.
+type base64Cleaner struct {
+	r io.Reader
+}
+
+func (c *base64Cleaner) Read(p []byte) (int, error) {
+	for {
+		n, err := c.r.Read(p)
+		j := 0
+		for _, b := range p[:n] {
+			if b != '\r' && b != '\n' && b != ' ' && b != '\t' {
+				p[j] = b
+				j++
+			}
+		}
+		if j > 0 || err != nil {
+			return j, err
+		}
+	}
+}
+
+// findPartByAttachmentID returns the part of payload carrying attachmentID.
+func findPartByAttachmentID(part *gmail.MessagePart, attachmentID string) *gmail.MessagePart {
+	if part == nil {
+		return nil
+	}
+	if part.Body != nil && part.Body.AttachmentId == attachmentID {
+		return part
+	}
+	for _, p := range part.Parts {
+		if found := findPartByAttachmentID(p, attachmentID); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+func makeSnippet(text string) string {
+	text = strings.Join(strings.Fields(text), " ")
+	if r := []rune(text); len(r) > 200 {
+		text = string(r[:200])
+	}
+	return text
+}
+
+// headerValue returns the first header called name, case-insensitively.
+func headerValue(headers []*gmail.MessagePartHeader, name string) string {
+	for _, h := range headers {
+		if strings.EqualFold(h.Name, name) {
+			return h.Value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"mime"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/charmbracelet/bubbles/key"
+	"github.com/charmbracelet/bubbles/viewport"
+	tea "github.com/charmbracelet/bubbletea"
+	"google.golang.org/api/gmail/v1"
+)
+
+// originalLoadedMsg carries a message's RFC 822 source, and its parsed
+// payload for the part tree.
+type originalLoadedMsg struct {
+	id      string
+	subject string
+	raw     []byte
+	payload *gmail.MessagePart
+}
+
+type emlSavedMsg struct{ filename string }
+
+// loadOriginal fetches msg as sent, headers and all.
+func loadOriginal(b MailBackend, msg *emailItem) tea.Cmd {
+	return func() tea.Msg {
+		rawMsg, err := b.GetMessage(msg.id, "raw")
+		if err != nil {
+			return emailLoadErrorMsg{err: fmt.Errorf("failed to fetch the original: %w", err)}
+		}
+		raw, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(rawMsg.Raw, "="))
+		if err != nil {
+			return emailLoadErrorMsg{err: fmt.Errorf("failed to decode the original: %w", err)}
+		}
+		full, err := b.GetMessage(msg.id, "full")
+		if err != nil {
+			return emailLoadErrorMsg{err: fmt.Errorf("failed to fetch message: %w", err)}
+		}
+		return originalLoadedMsg{id: msg.id, subject: msg.subject, raw: raw, payload: full.Payload}
+	}
+}
+
+// openOriginal shows the source of a loaded message; the part tree is a
+// key away.
+func (m *model) openOriginal(msg originalLoadedMsg) {
+	m.original = &msg
+	m.originalTree = false
+	m.sourceViewport = viewport.New(m.width, max(m.height-5, 1))
+	m.sourceViewport.SetContent(printableSource(msg.raw))
+	m.state = viewingSource
+}
+
+// printableSource is raw as text that is safe to print: line endings
+// normalised and control characters, which a hostile message could use to
+// drive the terminal, shown as �.
+func printableSource(raw []byte) string {
+	s := strings.ToValidUTF8(string(bytes.ReplaceAll(raw, []byte("\r\n"), []byte("\n"))), "�")
+	return strings.Map(func(r rune) rune {
+		if isControl(r) && r != '\n' && r != '\t' {
+			return '�'
+		}
+		return r
+	}, s)
+}
+
+// isControl reports C0 and C1 control characters and DEL.
+func isControl(r rune) bool {
+	return r < 0x20 || r == 0x7f || r >= 0x80 && r < 0xa0
+}
+
+// partTree lists the top-level headers of a message, decoded, followed by
+// its MIME structure.
+func partTree(payload *gmail.MessagePart) string {
+	var b strings.Builder
+	b.WriteString("Headers\n\n")
+	for _, h := range payload.Headers {
+		b.WriteString(printableSource([]byte(h.Name + ": " + decodeHeader(h.Value))))
+		b.WriteString("\n")
+	}
+	b.WriteString("\nMIME structure\n\n")
+	writePart(&b, payload, "", "")
+	return b.String()
+}
+
+// writePart writes part on a line starting with lead, and its children
+// under it with indent in front.
+func writePart(b *strings.Builder, part *gmail.MessagePart, lead, indent string) {
+	line := part.MimeType
+	if _, params, err := mime.ParseMediaType(headerValue(part.Headers, "Content-Type")); err == nil && params["charset"] != "" {
+		line += "; charset=" + params["charset"]
+	}
+	if part.PartId != "" {
+		line = "[" + part.PartId + "] " + line
+	}
+	var notes []string
+	if part.Filename != "" {
+		notes = append(notes, fmt.Sprintf("%q", part.Filename))
+	}
+	if d, _, err := mime.ParseMediaType(headerValue(part.Headers, "Content-Disposition")); err == nil {
+		notes = append(notes, d)
+	}
+	if id := headerValue(part.Headers, "Content-ID"); id != "" {
+		notes = append(notes, "cid "+strings.Trim(id, "<>"))
+	}
+	if enc := headerValue(part.Headers, "Content-Transfer-Encoding"); enc != "" {
+		notes = append(notes, strings.ToLower(enc))
+	}
+	if len(part.Parts) == 0 && part.Body != nil {
+		notes = append(notes, humanSize(part.Body.Size))
+	}
+	if len(notes) > 0 {
+		line += " · " + strings.Join(notes, " · ")
+	}
+	b.WriteString(printableSource([]byte(lead + line)))
+	b.WriteString("\n")
+	for i, p := range part.Parts {
+		if i == len(part.Parts)-1 {
+			writePart(b, p, indent+"└─ ", indent+"   ")
+		} else {
+			writePart(b, p, indent+"├─ ", indent+"│  ")
+		}
+	}
+}
+
+// saveEML writes raw to dir as an .eml file named after the subject.
+func saveEML(dir string, msg originalLoadedMsg) tea.Cmd {
+	return func() tea.Msg {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return notificationMsg{message: fmt.Sprintf("Couldn't create downloads directory: %v", err), level: severityError}
+		}
+		name := sanitizeFilename(firstNonEmpty(msg.subject, "message"))
+		filename := filepath.Join(dir, fmt.Sprintf("%s-%s.eml", name, msg.id))
+		if err := os.WriteFile(filename, msg.raw, 0644); err != nil {
+			return notificationMsg{message: fmt.Sprintf("Save failed: %v", err), level: severityError}
+		}
+		return emlSavedMsg{filename: filename}
+	}
+}
+
+func updateSource(msg tea.Msg, m model) (tea.Model, tea.Cmd) {
+	if msg, ok := msg.(tea.KeyMsg); ok {
+		switch {
+		case key.Matches(msg, keys.Back):
+			m.state = viewing
+			return m, nil
+
+		case key.Matches(msg, keys.PartTree):
+			m.originalTree = !m.originalTree
+			if m.originalTree && m.original.payload != nil {
+				m.sourceViewport.SetContent(partTree(m.original.payload))
+			} else {
+				m.sourceViewport.SetContent(printableSource(m.original.raw))
+			}
+			m.sourceViewport.GotoTop()
+			return m, nil
+
+		case key.Matches(msg, keys.SaveEML):
+			return m, saveEML(m.paths.DownloadDir, *m.original)
+
+		case key.Matches(msg, keys.Quit):
+			return m, tea.Quit
+		}
+	}
+	var cmd tea.Cmd
+	m.sourceViewport, cmd = m.sourceViewport.Update(msg)
+	return m, cmd
+}
+
+func sourceView(m model) string {
+	title, other := "Original message", "MIME tree"
+	if m.originalTree {
+		title, other = "Headers and MIME tree", "source"
+	}
+	return fmt.Sprintf("\n  %s\n\n%s\n[↑/↓] scroll • [T] %s • [s] save as .eml • [b] back\n", title, m.sourceViewport.View(), other)
+}
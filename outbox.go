@@ -0,0 +1,561 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/bubbles/key"
+	"github.com/charmbracelet/bubbles/list"
+	tea "github.com/charmbracelet/bubbletea"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
+)
+
+type opKind string
+
+const (
+	opSend         opKind = "send"
+	opTrash        opKind = "trash"
+	opModify       opKind = "modify"
+	opTrashThread  opKind = "trash_thread"
+	opModifyThread opKind = "modify_thread"
+)
+
+// outboxOp is a mailbox change waiting to reach the server. The UI shows
+// its effect as soon as it is queued.
+type outboxOp struct {
+	ID       string    `json:"id"`
+	Account  string    `json:"account"`
+	Kind     opKind    `json:"kind"`
+	Target   string    `json:"target,omitempty"` // message or thread ID, or the draft a send sends
+	Add      []string  `json:"add,omitempty"`
+	Remove   []string  `json:"remove,omitempty"`
+	Raw      string    `json:"raw,omitempty"` // RFC 822 in base64url, for sends
+	ThreadID string    `json:"thread_id,omitempty"`
+	Summary  string    `json:"summary"`
+	Queued   time.Time `json:"queued"`
+
+	Attempts  int    `json:"attempts,omitempty"`
+	LastError string `json:"last_error,omitempty"`
+	// Failed ops were rejected by the server and wait for the user to
+	// retry or discard them.
+	Failed bool `json:"failed,omitempty"`
+}
+
+func newOp(account string, kind opKind, target, summary string) *outboxOp {
+	return &outboxOp{
+		ID:      strconv.FormatInt(time.Now().UnixNano(), 36),
+		Account: account,
+		Kind:    kind,
+		Target:  target,
+		Summary: summary,
+		Queued:  time.Now(),
+	}
+}
+
+func sendOp(account string, raw []byte, threadID, to, subject string) *outboxOp {
+	op := newOp(account, opSend, "", fmt.Sprintf("Send %q to %s", subject, to))
+	op.Raw = base64.URLEncoding.EncodeToString(raw)
+	op.ThreadID = threadID
+	return op
+}
+
+func trashOp(account, id, subject string, thread bool) *outboxOp {
+	if thread {
+		return newOp(account, opTrashThread, id, fmt.Sprintf("Move conversation %q to trash", subject))
+	}
+	return newOp(account, opTrash, id, fmt.Sprintf("Move %q to trash", subject))
+}
+
+// readOp marks a message or thread read when it is unread, and unread
+// otherwise.
+func readOp(account, id, subject string, thread, isUnread bool) *outboxOp {
+	kind, what := opModify, fmt.Sprintf("%q", subject)
+	if thread {
+		kind, what = opModifyThread, fmt.Sprintf("conversation %q", subject)
+	}
+	if isUnread {
+		op := newOp(account, kind, id, "Mark "+what+" as read")
+		op.Remove = []string{"UNREAD"}
+		return op
+	}
+	op := newOp(account, kind, id, "Mark "+what+" as unread")
+	op.Add = []string{"UNREAD"}
+	return op
+}
+
+func (op *outboxOp) run(b MailBackend) error {
+	switch op.Kind {
+	case opSend:
+		msg := &gmail.Message{Raw: op.Raw, ThreadId: op.ThreadID}
+		if db, ok := capability[DraftBackend](b); ok && op.Target != "" {
+			_, err := db.SendDraft(op.Target, msg)
+			if !isNotFound(err) {
+				return err
+			}
+			// The draft was deleted elsewhere; send the message anyway.
+		}
+		_, err := b.SendMessage(msg)
+		return err
+	case opTrash:
+		if err := b.TrashMessage(op.Target); !isNotFound(err) {
+			return err
+		}
+		return nil
+	case opModify:
+		return b.ModifyMessage(op.Target, op.Add, op.Remove)
+	}
+	tb, ok := capability[ThreadBackend](b)
+	if !ok {
+		return errNoThreads
+	}
+	switch op.Kind {
+	case opTrashThread:
+		if err := tb.TrashThread(op.Target); !isNotFound(err) {
+			return err
+		}
+		return nil
+	case opModifyThread:
+		return tb.ModifyThread(op.Target, op.Add, op.Remove)
+	}
+	return fmt.Errorf("unknown outbox operation %q", op.Kind)
+}
+
+// doneMessage is the notification for op having taken effect.
+func (op *outboxOp) doneMessage() string {
+	noun := "Email"
+	if op.Kind == opTrashThread || op.Kind == opModifyThread {
+		noun = "Conversation"
+	}
+	switch {
+	case op.Kind == opSend:
+		return "Email sent successfully!"
+	case op.Kind == opTrash || op.Kind == opTrashThread:
+		return noun + " moved to trash"
+	case slices.Contains(op.Remove, "UNREAD"):
+		return noun + " marked as read"
+	case slices.Contains(op.Add, "UNREAD"):
+		return noun + " marked as unread"
+	}
+	return noun + " updated"
+}
+
+// isTransient reports whether a failed operation is worth retrying later:
+// network errors, timeouts, rate limits, server errors, SMTP 4xx replies
+// and sendmail's EX_TEMPFAIL are. Anything else, such as a rejected
+// recipient or a revoked sign-in, fails the same way every time.
+func isTransient(err error) bool {
+	var gerr *googleapi.Error
+	if errors.As(err, &gerr) {
+		return gerr.Code >= 500 || gerr.Code == http.StatusTooManyRequests || gerr.Code == http.StatusRequestTimeout
+	}
+	var rerr *oauth2.RetrieveError
+	if errors.As(err, &rerr) {
+		return rerr.Response != nil && rerr.Response.StatusCode >= 500
+	}
+	var terr *textproto.Error
+	if errors.As(err, &terr) {
+		return terr.Code >= 400 && terr.Code < 500
+	}
+	var xerr *exec.ExitError
+	if errors.As(err, &xerr) {
+		return xerr.ExitCode() == 75
+	}
+	// HTTP clients wrap every failure in a url.Error, which passes for a
+	// network error; judge what it wraps instead.
+	var uerr *url.Error
+	if errors.As(err, &uerr) {
+		err = uerr.Err
+	}
+	var nerr net.Error
+	return errors.As(err, &nerr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, context.DeadlineExceeded)
+}
+
+// outbox is the durable queue of pending operations, kept in the data
+// directory so that nothing queued offline is lost on exit. Operations run
+// oldest first; an account whose operation hits a transient error holds
+// its later ones back until the next flush, so they replay in order.
+type outbox struct {
+	path string // empty keeps the queue in memory only
+
+	mu       sync.Mutex
+	ops      []*outboxOp
+	flushing bool
+	added    bool // an op was queued while flushing
+}
+
+func openOutbox(path string) (*outbox, error) {
+	o := &outbox{path: path}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return o, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &o.ops); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return o, nil
+}
+
+func (o *outbox) saveLocked() error {
+	if o.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(o.ops, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(o.path, data, 0600)
+}
+
+func (o *outbox) add(op *outboxOp) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.ops = append(o.ops, op)
+	o.added = o.added || o.flushing
+	return o.saveLocked()
+}
+
+func (o *outbox) discard(id string) (*outboxOp, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	i := slices.IndexFunc(o.ops, func(op *outboxOp) bool { return op.ID == id })
+	if i < 0 {
+		return nil, nil
+	}
+	op := o.ops[i]
+	o.ops = slices.Delete(o.ops, i, i+1)
+	return op, o.saveLocked()
+}
+
+// retry queues a failed operation again.
+func (o *outbox) retry(id string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for _, op := range o.ops {
+		if op.ID == id {
+			op.Failed = false
+		}
+	}
+	return o.saveLocked()
+}
+
+// list returns copies of the queued operations, oldest first.
+func (o *outbox) list() []outboxOp {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	ops := make([]outboxOp, len(o.ops))
+	for i, op := range o.ops {
+		ops[i] = *op
+	}
+	return ops
+}
+
+type opResult struct {
+	op  outboxOp
+	err error
+}
+
+// outboxFlushedMsg reports the operations attempted by one flush; again
+// is set when more were queued in the meantime.
+type outboxFlushedMsg struct {
+	results []opResult
+	again   bool
+}
+
+// flush replays pending operations against their accounts' backends,
+// unless a flush is already running.
+func (o *outbox) flush(accounts []*account) tea.Cmd {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.flushing || !slices.ContainsFunc(o.ops, func(op *outboxOp) bool { return !op.Failed }) {
+		return nil
+	}
+	o.flushing = true
+	queued := slices.Clone(o.ops)
+	backends := make(map[string]MailBackend)
+	for _, a := range accounts {
+		backends[a.name] = a.backend
+	}
+
+	return func() tea.Msg {
+		var results []opResult
+		held := make(map[string]bool)
+		for _, op := range queued {
+			o.mu.Lock()
+			skip := op.Failed || held[op.Account] || !slices.Contains(o.ops, op)
+			o.mu.Unlock()
+			if skip {
+				continue
+			}
+			var err error
+			if b, ok := backends[op.Account]; ok {
+				err = op.run(b)
+			} else {
+				err = fmt.Errorf("account %s is not configured", op.Account)
+			}
+
+			o.mu.Lock()
+			var sentCopy *sentCopyError
+			if err == nil || errors.As(err, &sentCopy) {
+				o.ops = slices.DeleteFunc(o.ops, func(q *outboxOp) bool { return q == op })
+			} else {
+				op.Attempts++
+				op.LastError = err.Error()
+				if isTransient(err) {
+					held[op.Account] = true
+				} else {
+					op.Failed = true
+				}
+			}
+			results = append(results, opResult{op: *op, err: err})
+			if serr := o.saveLocked(); serr != nil && err == nil {
+				results[len(results)-1].err = fmt.Errorf("sent, but couldn't update the outbox: %w", serr)
+			}
+			o.mu.Unlock()
+		}
+
+		o.mu.Lock()
+		defer o.mu.Unlock()
+		again := o.added
+		o.flushing, o.added = false, false
+		return outboxFlushedMsg{results: results, again: again}
+	}
+}
+
+// queue records op in the outbox, shows its effect in the lists right away
+// and starts replaying the queue.
+func (m *model) queue(op *outboxOp) tea.Cmd {
+	if op.Account == "" {
+		op.Account = m.currentAccount().name
+	}
+	if err := m.outbox.add(op); err != nil {
+		return showStatus(severityError, "Couldn't save to the outbox: "+err.Error())
+	}
+	m.applyLocally(op)
+	note := op.doneMessage()
+	if op.Kind == opSend {
+		note = "Sending…"
+	}
+	return tea.Batch(showNotification(note), m.outbox.flush(m.accounts))
+}
+
+// applyLocally updates every list showing op's account as if op had
+// already reached the server.
+func (m *model) applyLocally(op *outboxOp) {
+	if op.Kind == opSend {
+		return
+	}
+	apply := func(l *list.Model) {
+		var items []list.Item
+		for _, it := range l.Items() {
+			switch row := it.(type) {
+			case emailItem:
+				hit := row.account == op.Account && (row.id == op.Target ||
+					(op.Kind == opTrashThread || op.Kind == opModifyThread) && row.threadId == op.Target)
+				if hit && (op.Kind == opModify || op.Kind == opModifyThread) {
+					row.labels = modifyLabels(row.labels, op.Add, op.Remove)
+					row.isUnread = slices.Contains(row.labels, "UNREAD")
+					it = row
+				} else if hit {
+					continue
+				}
+			case threadItem:
+				if row.account == op.Account && row.id == op.Target {
+					if op.Kind == opTrashThread {
+						continue
+					}
+					row.labels = modifyLabels(row.labels, op.Add, op.Remove)
+					row.isUnread = slices.Contains(row.labels, "UNREAD")
+					it = row
+				}
+			}
+			items = append(items, it)
+		}
+		if len(items) != len(l.Items()) {
+			// Keep the cursor on the row after a removed one.
+			i := l.Index()
+			l.SetItems(items)
+			l.Select(min(i, max(len(items)-1, 0)))
+		} else {
+			l.SetItems(items)
+		}
+	}
+
+	apply(&m.list)
+	for _, a := range m.accounts {
+		if a.name == op.Account && (a != m.currentAccount() || m.unified) {
+			apply(&a.list)
+		}
+	}
+	if op.Kind == opModify && m.currentMsg != nil && m.currentMsg.id == op.Target {
+		m.currentMsg.isUnread = slices.Contains(op.Add, "UNREAD")
+	}
+	if op.Kind == opModifyThread && m.thread != nil && m.thread.id == op.Target {
+		for _, msg := range m.thread.messages {
+			msg.isUnread = slices.Contains(op.Add, "UNREAD")
+		}
+		m.refreshThread()
+	}
+}
+
+// flushDone reports the outcome of a flush and starts another one if
+// operations were queued while it ran.
+func (m *model) flushDone(msg outboxFlushedMsg) tea.Cmd {
+	var cmds []tea.Cmd
+	for _, r := range msg.results {
+		switch {
+		case r.err == nil && r.op.Kind == opSend:
+			cmds = append(cmds, showNotification(r.op.doneMessage()))
+		case r.err == nil:
+		case errors.As(r.err, new(*sentCopyError)):
+			cmds = append(cmds, showStatus(severityWarning, "Email "+r.err.Error()))
+		case r.op.Failed:
+			cmds = append(cmds, showStatus(severityError, fmt.Sprintf("%s failed: %s ([o] outbox)", r.op.Summary, errorText(r.err))))
+		case r.op.Attempts == 1:
+			cmds = append(cmds, showStatus(severityWarning, "Offline: queued to retry. "+r.op.Summary))
+		}
+	}
+	if msg.again {
+		cmds = append(cmds, m.outbox.flush(m.accounts))
+	}
+	if m.state == reviewingOutbox {
+		m.refreshOutbox()
+	}
+	return tea.Batch(cmds...)
+}
+
+// outboxItem is a row on the outbox screen.
+type outboxItem struct{ op outboxOp }
+
+func (o outboxItem) Title() string { return o.op.Summary }
+
+func (o outboxItem) Description() string {
+	status := "pending"
+	if o.op.Failed {
+		status = "failed"
+	}
+	desc := fmt.Sprintf("[%s] %s · queued %s", o.op.Account, status, o.op.Queued.Format("Jan 02 15:04"))
+	if o.op.Attempts > 0 {
+		desc += fmt.Sprintf(" · %d attempts · %s", o.op.Attempts, o.op.LastError)
+	}
+	return desc
+}
+
+func (o outboxItem) FilterValue() string { return o.op.Summary }
+
+func (m *model) refreshOutbox() {
+	var items []list.Item
+	for _, op := range m.outbox.list() {
+		items = append(items, outboxItem{op: op})
+	}
+	m.outboxList.SetItems(items)
+}
+
+func (m *model) openOutbox() {
+	m.outboxList = list.New(nil, list.NewDefaultDelegate(), m.width, m.height-4)
+	m.outboxList.Title = "Outbox"
+	m.outboxList.SetShowHelp(false)
+	m.outboxList.SetFilteringEnabled(false)
+	m.outboxList.SetStatusBarItemName("operation", "operations")
+	m.outboxList.DisableQuitKeybindings()
+	m.refreshOutbox()
+	m.state = reviewingOutbox
+}
+
+func updateOutbox(msg tea.Msg, m model) (tea.Model, tea.Cmd) {
+	if msg, ok := msg.(tea.KeyMsg); ok {
+		selected, _ := m.outboxList.SelectedItem().(outboxItem)
+		switch {
+		case key.Matches(msg, keys.Back):
+			m.state = inbox
+			return m, nil
+
+		case key.Matches(msg, keys.Retry):
+			if selected.op.ID == "" {
+				return m, nil
+			}
+			if err := m.outbox.retry(selected.op.ID); err != nil {
+				return m, showStatus(severityError, "Couldn't update the outbox: "+err.Error())
+			}
+			m.refreshOutbox()
+			return m, m.outbox.flush(m.accounts)
+
+		case key.Matches(msg, keys.Discard):
+			if selected.op.ID == "" {
+				return m, nil
+			}
+			op, err := m.outbox.discard(selected.op.ID)
+			if err != nil {
+				return m, showStatus(severityError, "Couldn't update the outbox: "+err.Error())
+			}
+			m.refreshOutbox()
+			if op == nil || op.Kind == opSend {
+				return m, nil
+			}
+			// The list shows the discarded change; reload it.
+			for _, a := range m.accounts {
+				if a.name == op.Account {
+					return m, m.resync(a)
+				}
+			}
+			return m, nil
+
+		case key.Matches(msg, keys.Quit):
+			return m, tea.Quit
+		}
+	}
+	var cmd tea.Cmd
+	m.outboxList, cmd = m.outboxList.Update(msg)
+	return m, cmd
+}
+
+func outboxView(m model) string {
+	if len(m.outboxList.Items()) == 0 {
+		return "\n  Outbox\n\n  Nothing waiting to be sent.\n\n[b] back\n"
+	}
+	return m.outboxList.View() + "\n[r] retry • [d] discard • [b] back\n"
+}
+
+// outboxStatus is the inbox footer note for queued operations.
+func outboxStatus(o *outbox) string {
+	var pending, failed int
+	for _, op := range o.list() {
+		if op.Failed {
+			failed++
+		} else {
+			pending++
+		}
+	}
+	var parts []string
+	if pending > 0 {
+		parts = append(parts, fmt.Sprintf("%d pending", pending))
+	}
+	if failed > 0 {
+		parts = append(parts, fmt.Sprintf("%d failed", failed))
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return "Outbox: " + strings.Join(parts, ", ") + " ([o] review)\n"
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"os/exec"
+	"strings"
+	"testing"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
+)
+
+func TestIsTransient(t *testing.T) {
+	dial := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	revoked := &oauth2.RetrieveError{Response: &http.Response{StatusCode: http.StatusBadRequest}, ErrorCode: "invalid_grant"}
+	tempfail := exec.Command("sh", "-c", "exit 75").Run()
+	unavailable := exec.Command("sh", "-c", "exit 69").Run()
+
+	for _, tc := range []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"network", fmt.Errorf("unable to connect to smtp.example.org:587: %w", dial), true},
+		{"HTTP request", &url.Error{Op: "Get", URL: "https://gmail.googleapis.com/", Err: dial}, true},
+		{"timeout", context.DeadlineExceeded, true},
+		{"rate limited", &googleapi.Error{Code: http.StatusTooManyRequests}, true},
+		{"server error", &googleapi.Error{Code: http.StatusServiceUnavailable}, true},
+		{"bad request", &googleapi.Error{Code: http.StatusBadRequest}, false},
+		{"greylisted", fmt.Errorf("recipient bob@example.org rejected: %w", &textproto.Error{Code: 451, Msg: "try again later"}), true},
+		{"no such user", fmt.Errorf("recipient bob@example.org rejected: %w", &textproto.Error{Code: 550, Msg: "no such user"}), false},
+		{"SMTP auth", fmt.Errorf("smtp auth failed: %w", &textproto.Error{Code: 535, Msg: "bad credentials"}), false},
+		{"invalid_grant", &url.Error{Op: "Post", URL: "https://gmail.googleapis.com/", Err: revoked}, false},
+		{"signed out", &url.Error{Op: "Post", URL: "https://gmail.googleapis.com/", Err: &reauthError{account: "work", err: revoked}}, false},
+		{"sendmail EX_TEMPFAIL", fmt.Errorf("sendmail failed: %w: deferred", tempfail), true},
+		{"sendmail EX_UNAVAILABLE", fmt.Errorf("sendmail failed: %w: no such user", unavailable), false},
+		{"gone", fmt.Errorf("message 1: %w", errNotFound), false},
+		{"no conversations", errNoThreads, false},
+		{"unknown", errors.New("account work is not configured"), false},
+	} {
+		if got := isTransient(tc.err); got != tc.want {
+			t.Errorf("%s: isTransient(%v) = %v, want %v", tc.name, tc.err, got, tc.want)
+		}
+	}
+}
+
+// sendFailBackend is a memoryBackend whose SendMessage fails with err.
+type sendFailBackend struct {
+	*memoryBackend
+	err error
+}
+
+func (b *sendFailBackend) SendMessage(msg *gmail.Message) (*gmail.Message, error) {
+	return nil, b.err
+}
+
+// flushOnce queues a send against a backend failing with err, flushes
+// the outbox and drives the result through the model.
+func flushOnce(t *testing.T, err error) (*outbox, model) {
+	t.Helper()
+	mb := newMemoryBackend()
+	b := &sendFailBackend{memoryBackend: mb, err: err}
+	first, _ := mb.ListMessages(inboxQuery, nil, "", pageSize)
+	acct := &account{name: "test", backend: b}
+	ob := &outbox{}
+	var m tea.Model = initialModel(appPaths{}, []*account{acct}, 0, first, nil, ob)
+	m, _ = m.Update(tea.WindowSizeMsg{Width: 100, Height: 40})
+
+	ob.add(sendOp("test", []byte("To: bob@example.org\r\nSubject: Hi\r\n\r\nhi\r\n"), "", "bob@example.org", "Hi"))
+	m = drive(t, m, ob.flush([]*account{acct}))
+	return ob, m.(model)
+}
+
+func TestOutboxSentCopyFailureIsDone(t *testing.T) {
+	ob, m := flushOnce(t, &sentCopyError{folder: "Sent", err: errors.New("quota exceeded")})
+	if ops := ob.list(); len(ops) != 0 {
+		t.Fatalf("outbox keeps %d ops after the message went out; it would be sent twice", len(ops))
+	}
+	if m.toast == nil || m.toast.level != severityWarning || !strings.Contains(m.toast.text, "couldn't save to Sent") {
+		t.Errorf("toast %+v, want a warning about the sent copy", m.toast)
+	}
+}
+
+func TestOutboxRetriesOnlyTransientErrors(t *testing.T) {
+	ob, _ := flushOnce(t, fmt.Errorf("recipient bob@example.org rejected: %w", &textproto.Error{Code: 451, Msg: "greylisted"}))
+	ops := ob.list()
+	if len(ops) != 1 || ops[0].Failed {
+		t.Errorf("after a 451, outbox holds %+v; want the send waiting to retry", ops)
+	}
+
+	ob, m := flushOnce(t, fmt.Errorf("recipient bob@example.org rejected: %w", &textproto.Error{Code: 550, Msg: "no such user"}))
+	ops = ob.list()
+	if len(ops) != 1 || !ops[0].Failed {
+		t.Errorf("after a 550, outbox holds %+v; want the send marked failed", ops)
+	}
+	if m.toast == nil || m.toast.level != severityError {
+		t.Errorf("toast %+v, want an error", m.toast)
+	}
+}
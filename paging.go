@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/charmbracelet/bubbles/list"
+	tea "github.com/charmbracelet/bubbletea"
+	"google.golang.org/api/gmail/v1"
+)
+
+const (
+	// pageSize is how many messages each list request asks for.
+	pageSize = 25
+	// loadMoreThreshold is how close the cursor has to get to the last row
+	// before the next page is requested.
+	loadMoreThreshold = 5
+)
+
+// listPager remembers the request behind the visible list so that further
+// pages can be fetched as the user scrolls. With threads set the list
+// holds conversations instead of messages.
+type listPager struct {
+	account   string
+	query     string
+	labelIDs  []string
+	threads   bool
+	nextToken string
+	estimate  int64
+	fetching  bool
+}
+
+func newListPager(account, query string, labelIDs []string, resp *gmail.ListMessagesResponse) listPager {
+	p := listPager{account: account, query: query, labelIDs: labelIDs}
+	if resp != nil {
+		p.nextToken, p.estimate = resp.NextPageToken, resp.ResultSizeEstimate
+	}
+	return p
+}
+
+func (p listPager) sameSource(o listPager) bool {
+	return p.account == o.account && p.query == o.query && p.threads == o.threads && slices.Equal(p.labelIDs, o.labelIDs)
+}
+
+// listPage fetches the page of p that starts at p.nextToken and returns
+// its message or thread IDs along with the pager for the page after it.
+func listPage(b MailBackend, p listPager) ([]string, listPager, error) {
+	var ids []string
+	next := p
+	next.fetching = false
+	if p.threads {
+		tb, ok := capability[ThreadBackend](b)
+		if !ok {
+			return nil, p, errNoThreads
+		}
+		resp, err := tb.ListThreads(p.query, p.labelIDs, p.nextToken, pageSize)
+		if err != nil {
+			return nil, p, err
+		}
+		for _, t := range resp.Threads {
+			ids = append(ids, t.Id)
+		}
+		next.nextToken, next.estimate = resp.NextPageToken, resp.ResultSizeEstimate
+		return ids, next, nil
+	}
+	resp, err := b.ListMessages(p.query, p.labelIDs, p.nextToken, pageSize)
+	if err != nil {
+		return nil, p, err
+	}
+	for _, msg := range resp.Messages {
+		ids = append(ids, msg.Id)
+	}
+	next.nextToken, next.estimate = resp.NextPageToken, resp.ResultSizeEstimate
+	return ids, next, nil
+}
+
+// loadFirstPage lists the first page of p and replaces the visible list
+// with it.
+func loadFirstPage(b MailBackend, p listPager) tea.Cmd {
+	return func() tea.Msg {
+		p.nextToken = ""
+		ids, next, err := listPage(b, p)
+		if err != nil {
+			return emailLoadErrorMsg{err: err}
+		}
+		return searchResultMsg{account: p.account, ids: ids, pager: next}
+	}
+}
+
+// pageLoadedMsg carries the IDs of a page fetched for pager. from is the
+// page token the request was made with, so stale pages can be dropped.
+type pageLoadedMsg struct {
+	from  string
+	pager listPager
+	ids   []string
+	err   error
+}
+
+func loadNextPage(b MailBackend, p listPager) tea.Cmd {
+	return func() tea.Msg {
+		ids, next, err := listPage(b, p)
+		return pageLoadedMsg{from: p.nextToken, pager: next, ids: ids, err: err}
+	}
+}
+
+// loadMoreIfNeeded requests the next page once the cursor is near the end
+// of the list. Filtering only sees loaded rows, so paging pauses meanwhile,
+// as it does while the rows of the previous page are still arriving.
+func (m *model) loadMoreIfNeeded() tea.Cmd {
+	if m.unified || m.rows != nil || m.pager.nextToken == "" || m.pager.fetching || m.list.FilterState() != list.Unfiltered {
+		return nil
+	}
+	if len(m.list.Items())-m.list.Index() > loadMoreThreshold {
+		return nil
+	}
+	m.pager.fetching = true
+	setListStatus(&m.list, m.pager)
+	return loadNextPage(m.backend(m.pager.account), m.pager)
+}
+
+// appendPage starts streaming the rows of a loaded page onto the list,
+// skipping messages that moved between pages while new mail arrived.
+func (m *model) appendPage(msg pageLoadedMsg) tea.Cmd {
+	if !m.pager.fetching || !m.pager.sameSource(msg.pager) || m.pager.nextToken != msg.from {
+		return nil
+	}
+	m.pager.fetching = false
+	if msg.err != nil {
+		setListStatus(&m.list, m.pager)
+		return showNotification(fmt.Sprintf("Couldn't load more emails: %v", msg.err))
+	}
+
+	seen := make(map[string]bool)
+	for _, it := range m.list.Items() {
+		seen[rowID(it)] = true
+	}
+	var fresh []string
+	for _, id := range msg.ids {
+		if !seen[id] {
+			fresh = append(fresh, id)
+		}
+	}
+	m.pager = msg.pager
+	setListStatus(&m.list, m.pager)
+	if len(fresh) == 0 {
+		return m.loadMoreIfNeeded()
+	}
+	return m.streamRows(fresh)
+}
+
+// setListStatus shows the server's result size estimate in the list's
+// status bar, e.g. "25 of ~1,204 emails". An empty list keeps the plain
+// "No emails".
+func setListStatus(l *list.Model, p listPager) {
+	singular, plural := "email", "emails"
+	if p.threads {
+		singular, plural = "conversation", "conversations"
+	}
+	if n := len(l.Items()); n > 0 && p.nextToken != "" && p.estimate > int64(n) {
+		plural = fmt.Sprintf("of ~%s %s", groupThousands(p.estimate), plural)
+	}
+	if p.fetching {
+		plural += " · loading more…"
+	}
+	l.SetStatusBarItemName(singular, plural)
+}
+
+func groupThousands(n int64) string {
+	s := fmt.Sprint(n)
+	for i := len(s) - 3; i > 0; i -= 3 {
+		s = s[:i] + "," + s[i:]
+	}
+	return s
+}
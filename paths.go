@@ -0,0 +1,219 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+const appName = "gmail-tui"
+
+// appPaths holds every location the app reads from or writes to. Each one
+// is resolved from, in order: a command-line flag, a GMAIL_TUI_* environment
+// variable, the config file, and the XDG base directory default.
+type appPaths struct {
+	ConfigFile  string
+	ConfigDir   string
+	DataDir     string
+	CacheDir    string
+	DownloadDir string
+	Credentials string
+}
+
+func homeDir() string {
+	if h, err := os.UserHomeDir(); err == nil {
+		return h
+	}
+	usr, _ := user.Current()
+	return usr.HomeDir
+}
+
+// xdgDir returns $env when it holds an absolute path, else fallback joined
+// to the home directory.
+func xdgDir(env string, fallback ...string) string {
+	if dir := os.Getenv(env); filepath.IsAbs(dir) {
+		return dir
+	}
+	return filepath.Join(append([]string{homeDir()}, fallback...)...)
+}
+
+func defaultConfigDir() string {
+	if runtime.GOOS != "linux" && os.Getenv("XDG_CONFIG_HOME") == "" {
+		if dir, err := os.UserConfigDir(); err == nil {
+			return filepath.Join(dir, appName)
+		}
+	}
+	return filepath.Join(xdgDir("XDG_CONFIG_HOME", ".config"), appName)
+}
+
+func defaultDataDir() string {
+	if runtime.GOOS == "windows" && os.Getenv("XDG_DATA_HOME") == "" {
+		if dir := os.Getenv("LocalAppData"); dir != "" {
+			return filepath.Join(dir, appName)
+		}
+	}
+	return filepath.Join(xdgDir("XDG_DATA_HOME", ".local", "share"), appName)
+}
+
+func defaultCacheDir() string {
+	if runtime.GOOS != "linux" && os.Getenv("XDG_CACHE_HOME") == "" {
+		if dir, err := os.UserCacheDir(); err == nil {
+			return filepath.Join(dir, appName)
+		}
+	}
+	return filepath.Join(xdgDir("XDG_CACHE_HOME", ".cache"), appName)
+}
+
+func defaultDownloadDir() string {
+	return xdgDir("XDG_DOWNLOAD_DIR", "Downloads")
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// resolveConfigFile picks the config file: flag, then $GMAIL_TUI_CONFIG,
+// then the XDG location, falling back to the legacy ~/.gmail-tui.json when
+// only that one exists.
+func resolveConfigFile(flagValue string) string {
+	if p := firstNonEmpty(flagValue, os.Getenv("GMAIL_TUI_CONFIG")); p != "" {
+		return expandHome(p)
+	}
+	p := filepath.Join(defaultConfigDir(), "config.json")
+	legacy := filepath.Join(homeDir(), ".gmail-tui.json")
+	if !fileExists(p) && fileExists(legacy) {
+		return legacy
+	}
+	return p
+}
+
+// resolvePaths fills in the remaining locations once the config file has
+// been read. credentialsFlag is the --credentials value, if any.
+func resolvePaths(configFile string, cfg *config, credentialsFlag string) appPaths {
+	p := appPaths{
+		ConfigFile: configFile,
+		ConfigDir:  filepath.Dir(configFile),
+		DataDir:    expandHome(firstNonEmpty(os.Getenv("GMAIL_TUI_DATA_DIR"), cfg.DataDir, defaultDataDir())),
+		CacheDir:   expandHome(firstNonEmpty(os.Getenv("GMAIL_TUI_CACHE_DIR"), cfg.CacheDir, defaultCacheDir())),
+		DownloadDir: expandHome(firstNonEmpty(os.Getenv("GMAIL_TUI_DOWNLOAD_DIR"), cfg.DownloadDir,
+			defaultDownloadDir())),
+	}
+
+	switch {
+	case credentialsFlag != "" || os.Getenv("GMAIL_TUI_CREDENTIALS") != "":
+		// Paths given on the command line are relative to the working directory.
+		p.Credentials, _ = filepath.Abs(expandHome(firstNonEmpty(credentialsFlag, os.Getenv("GMAIL_TUI_CREDENTIALS"))))
+	case cfg.Credentials != "":
+		p.Credentials = p.resolve(cfg.Credentials)
+	default:
+		p.Credentials = filepath.Join(defaultConfigDir(), "credentials.json")
+		// Older versions only looked in the working directory.
+		if !fileExists(p.Credentials) && fileExists("credentials.json") {
+			p.Credentials, _ = filepath.Abs("credentials.json")
+		}
+	}
+	return p
+}
+
+// resolve makes a path from the config file absolute, relative to the
+// directory the config file lives in.
+func (p appPaths) resolve(path string) string {
+	path = expandHome(path)
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(p.ConfigDir, path)
+}
+
+func expandHome(path string) string {
+	if path == "~" {
+		return homeDir()
+	}
+	if strings.HasPrefix(path, "~/") {
+		return filepath.Join(homeDir(), path[2:])
+	}
+	return path
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// doctorReport describes the resolved paths and per-account auth setup so
+// users can see where the app is looking for things.
+func doctorReport(p appPaths, accounts []accountConfig) string {
+	var b strings.Builder
+	status := func(path string) string {
+		fi, err := os.Stat(path)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			return "missing"
+		case err != nil:
+			return err.Error()
+		case fi.IsDir():
+			return "ok (dir)"
+		default:
+			return fmt.Sprintf("ok (%s)", fi.Mode().Perm())
+		}
+	}
+	row := func(indent, name, path string) {
+		fmt.Fprintf(&b, "%s%-12s %s [%s]\n", indent, name, path, status(path))
+	}
+
+	b.WriteString("Paths\n")
+	row("  ", "config", p.ConfigFile)
+	row("  ", "data", p.DataDir)
+	row("  ", "cache", p.CacheDir)
+	row("  ", "downloads", p.DownloadDir)
+	row("  ", "credentials", p.Credentials)
+
+	b.WriteString("\nAccounts\n")
+	for _, ac := range accounts {
+		fmt.Fprintf(&b, "  %s\n", ac.Name)
+		if ac.Type == "imap" {
+			fmt.Fprintf(&b, "    %-12s %s:%d as %s\n", "imap", ac.IMAP.Host, ac.IMAP.Port, ac.IMAP.Username)
+			fmt.Fprintf(&b, "    %-12s %s:%d (STARTTLS)\n", "smtp", ac.IMAP.SMTPHost, ac.IMAP.SMTPPort)
+			continue
+		}
+		if ac.Type == "maildir" {
+			row("    ", "maildir", ac.Maildir.Path)
+			fmt.Fprintf(&b, "    %-12s %s\n", "sendmail", firstNonEmpty(ac.Maildir.SendmailCommand, "(not configured)"))
+			continue
+		}
+		row("    ", "credentials", ac.Credentials)
+		store, err := openTokenStore(ac)
+		if err != nil {
+			fmt.Fprintf(&b, "    %-12s %v\n", "token", err)
+			continue
+		}
+		fmt.Fprintf(&b, "    %-12s %s\n", "token", store.Describe())
+	}
+
+	b.WriteString("\nEnvironment overrides\n")
+	n := 0
+	for _, env := range []string{
+		"GMAIL_TUI_CONFIG", "GMAIL_TUI_CREDENTIALS", "GMAIL_TUI_DATA_DIR",
+		"GMAIL_TUI_CACHE_DIR", "GMAIL_TUI_DOWNLOAD_DIR",
+		"XDG_CONFIG_HOME", "XDG_DATA_HOME", "XDG_CACHE_HOME", "XDG_DOWNLOAD_DIR",
+	} {
+		if v := os.Getenv(env); v != "" {
+			fmt.Fprintf(&b, "  %s=%s\n", env, v)
+			n++
+		}
+	}
+	if n == 0 {
+		b.WriteString("  (none)\n")
+	}
+	return b.String()
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"mime"
+	"net/mail"
+	"net/textproto"
+	"strings"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// IdentityBackend is implemented by backends that know the account's own
+// addresses, which reply-all leaves out.
+type IdentityBackend interface {
+	Addresses() ([]string, error)
+}
+
+type identityMsg struct {
+	account   string
+	addresses []string
+}
+
+// loadIdentities asks each account that can tell for its addresses.
+func loadIdentities(accounts []*account) tea.Cmd {
+	var cmds []tea.Cmd
+	for _, a := range accounts {
+		ib, ok := capability[IdentityBackend](a.backend)
+		if !ok {
+			continue
+		}
+		name := a.name
+		cmds = append(cmds, func() tea.Msg {
+			addrs, err := ib.Addresses()
+			if err != nil {
+				return notificationMsg{message: fmt.Sprintf("Couldn't look up the addresses of %s: %v", name, err), level: severityWarning}
+			}
+			return identityMsg{account: name, addresses: addrs}
+		})
+	}
+	return tea.Batch(cmds...)
+}
+
+// ownAddresses are the configured and discovered addresses of a.
+func (a *account) ownAddresses() []string {
+	return append(append([]string(nil), a.cfg.Addresses...), a.addresses...)
+}
+
+// ownAddresses are the addresses of the named account.
+func (m model) ownAddresses(account string) []string {
+	for _, a := range m.accounts {
+		if a.name == account {
+			return a.ownAddresses()
+		}
+	}
+	return nil
+}
+
+// fromAddress is what goes in the From header of mail sent from the named
+// account: its first known address, or nothing, which leaves it to the
+// server.
+func (m model) fromAddress(account string) string {
+	if own := m.ownAddresses(account); len(own) > 0 {
+		return own[0]
+	}
+	return ""
+}
+
+// senderAddress checks the From field of the compose screen. Empty means
+// the account's default; anything else must be one of its own addresses,
+// since servers reject or rewrite mail from others.
+func (m model) senderAddress(account, value string) (string, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return m.fromAddress(account), nil
+	}
+	addr, err := mail.ParseAddress(value)
+	if err != nil {
+		return "", fmt.Errorf("invalid From address %q", value)
+	}
+	if !containsFold(m.ownAddresses(account), addr.Address) {
+		return "", fmt.Errorf("%s is not an address of %s; add it to the account's \"addresses\" to send from it", addr.Address, account)
+	}
+	return value, nil
+}
+
+// outgoing is a message ready to be built and handed to the outbox.
+type outgoing struct {
+	account     string
+	from        string
+	to, cc, bcc string
+	subject     string
+	body        string
+	markdown    bool     // send body as Markdown with a rendered HTML alternative
+	attachments []string // local files
+
+	// Threading, set on replies.
+	inReplyTo  string
+	references string
+	threadID   string
+
+	forward *forwardSource
+	kept    []mimePart // attachments of a resumed draft
+	draft   *draftSession
+}
+
+// forwardSource is a message being forwarded, either with its attachments
+// re-attached or whole as a message/rfc822 attachment.
+type forwardSource struct {
+	msg          *emailItem
+	asAttachment bool
+}
+
+// mimePart is an extra part for an outgoing message. Data is written
+// base64 encoded when the header asks for it and as is otherwise.
+type mimePart struct {
+	header textproto.MIMEHeader
+	data   []byte
+}
+
+// parts fetches what f re-attaches.
+func (f *forwardSource) parts(b MailBackend) ([]mimePart, error) {
+	if f == nil {
+		return nil, nil
+	}
+	if f.asAttachment {
+		msg, err := b.GetMessage(f.msg.id, "raw")
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch the forwarded message: %w", err)
+		}
+		raw, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(msg.Raw, "="))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode the forwarded message: %w", err)
+		}
+		h := textproto.MIMEHeader{}
+		h.Set("Content-Type", "message/rfc822")
+		h.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{
+			"filename": sanitizeFilename(firstNonEmpty(f.msg.subject, "message")) + ".eml",
+		}))
+		return []mimePart{{header: h, data: raw}}, nil
+	}
+	return attachmentParts(b, f.msg)
+}
+
+// attachmentParts fetches the attachments of msg for sending them on.
+func attachmentParts(b MailBackend, msg *emailItem) ([]mimePart, error) {
+	var parts []mimePart
+	for _, att := range msg.attachments {
+		var data []byte
+		var err error
+		if att.Body.AttachmentId != "" {
+			data, err = b.GetAttachment(msg.id, att.Body.AttachmentId)
+		} else {
+			data, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(att.Body.Data, "="))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch attachment %s: %w", att.Filename, err)
+		}
+		parts = append(parts, attachmentPart(firstNonEmpty(att.MimeType, "application/octet-stream"), att.Filename, data))
+	}
+	return parts, nil
+}
+
+// replyRecipients works out who a reply to msg goes to: its Reply-To, or
+// From when there is none, or the original recipients when I sent msg.
+// Reply-all adds everyone else on To and Cc. My own addresses are left
+// out unless nobody else is left.
+func replyRecipients(msg *emailItem, all bool, own []string) (to, cc string) {
+	isOwn := func(a *mail.Address) bool { return containsFold(own, a.Address) }
+	from := parseAddresses(msg.from)
+	fromMe := len(from) > 0 && isOwn(from[0])
+
+	var primary, others []*mail.Address
+	switch {
+	case fromMe:
+		primary = parseAddresses(msg.recipient)
+	case msg.replyTo != "":
+		primary = parseAddresses(msg.replyTo)
+	default:
+		primary = from
+	}
+	if all {
+		if !fromMe {
+			others = parseAddresses(msg.recipient)
+		}
+		others = append(others, parseAddresses(msg.cc)...)
+	}
+
+	seen := make(map[string]bool)
+	keep := func(list []*mail.Address) []string {
+		var out []string
+		for _, a := range list {
+			addr := strings.ToLower(a.Address)
+			if seen[addr] || isOwn(a) {
+				continue
+			}
+			seen[addr] = true
+			if a.Name == "" {
+				out = append(out, a.Address)
+			} else {
+				out = append(out, a.String())
+			}
+		}
+		return out
+	}
+	toList := keep(primary)
+	if len(toList) == 0 {
+		// A note to self.
+		toList = []string{msg.from}
+	}
+	return strings.Join(toList, ", "), strings.Join(keep(others), ", ")
+}
+
+func parseAddresses(s string) []*mail.Address {
+	if strings.TrimSpace(s) == "" {
+		return nil
+	}
+	list, err := mail.ParseAddressList(s)
+	if err != nil {
+		return nil
+	}
+	return list
+}
+
+// prefixSubject adds prefix ("Re:" or "Fwd:") unless subject already has it.
+func prefixSubject(prefix, subject string) string {
+	if len(subject) >= len(prefix) && strings.EqualFold(subject[:len(prefix)], prefix) {
+		return subject
+	}
+	return prefix + " " + subject
+}
+
+// references extends msg's References with its Message-ID, as RFC 5322
+// asks of replies.
+func references(msg *emailItem) string {
+	return strings.TrimSpace(msg.references + " " + msg.messageID)
+}
+
+// startReply opens the reply screen for msg, to its sender or with all
+// to everyone on it.
+func (m *model) startReply(msg *emailItem, all bool) tea.Cmd {
+	var own []string
+	for _, a := range m.accounts {
+		if a.name == msg.account || msg.account == "" && a == m.currentAccount() {
+			own = a.ownAddresses()
+		}
+	}
+	to, cc := replyRecipients(msg, all, own)
+	m.replyToMsg = msg
+	m.reply = outgoing{
+		account:    msg.account,
+		from:       m.fromAddress(msg.account),
+		to:         to,
+		cc:         cc,
+		subject:    prefixSubject("Re:", msg.subject),
+		inReplyTo:  msg.messageID,
+		references: references(msg),
+		threadID:   msg.threadId,
+	}
+	// The quote goes in the body, where it can be trimmed here or in
+	// $EDITOR; the cursor starts above it.
+	m.replyBody.SetValue(fmt.Sprintf(
+		"\n\n--- Original Message ---\nFrom: %s\nDate: %s\n\n%s",
+		msg.from,
+		msg.date,
+		indentText(msg.body),
+	))
+	for m.replyBody.Line() > 0 {
+		m.replyBody.CursorUp()
+	}
+	m.replyBody.CursorStart()
+	m.state = replying
+	return m.replyBody.Focus()
+}
+
+// startForward opens the compose screen with msg forwarded inline, or
+// attached as a whole with asAttachment.
+func (m *model) startForward(msg *emailItem, asAttachment bool) tea.Cmd {
+	m.resetCompose()
+	m.composeSubj.SetValue(prefixSubject("Fwd:", msg.subject))
+	m.composeForward = &forwardSource{msg: msg, asAttachment: asAttachment}
+	// A forward goes out from the account the message is in.
+	if msg.account != "" {
+		m.draft.account = msg.account
+		m.composeFrom.SetValue(m.fromAddress(msg.account))
+	}
+	if !asAttachment {
+		var b strings.Builder
+		b.WriteString("\n\n---------- Forwarded message ---------\n")
+		fmt.Fprintf(&b, "From: %s\nDate: %s\nSubject: %s\nTo: %s\n", msg.from, msg.date, msg.subject, msg.recipient)
+		if msg.cc != "" {
+			fmt.Fprintf(&b, "Cc: %s\n", msg.cc)
+		}
+		b.WriteString("\n" + msg.body)
+		m.composeBody.SetValue(b.String())
+		for m.composeBody.Line() > 0 {
+			m.composeBody.CursorUp()
+		}
+		m.composeBody.CursorStart()
+	}
+	m.state = composing
+	m.focused = 1
+	return tea.Batch(m.focusComposeField(), m.watchDraft())
+}
+
+// resetCompose clears the compose screen for a new message, which starts
+// a new draft.
+func (m *model) resetCompose() {
+	m.composeFrom.SetValue(m.fromAddress(m.currentAccount().name))
+	m.composeTo.Reset()
+	m.composeCc.Reset()
+	m.composeBcc.Reset()
+	m.composeSubj.Reset()
+	m.composeBody.Reset()
+	m.composeAttachments = []string{}
+	m.composeKept = nil
+	m.composeForward = nil
+	m.draft = &draftSession{account: m.currentAccount().name}
+}
+
+// names lists what a forward re-attaches, for the compose screen.
+func (f *forwardSource) names() []string {
+	if f == nil {
+		return nil
+	}
+	if f.asAttachment {
+		return []string{sanitizeFilename(firstNonEmpty(f.msg.subject, "message")) + ".eml"}
+	}
+	var names []string
+	for _, att := range f.msg.attachments {
+		names = append(names, att.Filename)
+	}
+	return names
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"fmt"
+	"net/mail"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/publicsuffix"
+	"google.golang.org/api/gmail/v1"
+)
+
+// authResult is one method's verdict from an Authentication-Results
+// header (RFC 8601), such as spf=pass, with the domain it vouches for.
+type authResult struct {
+	result string
+	domain string
+}
+
+// senderAuth is what the receiving server found when it checked who sent
+// a message. Zero results mean the method wasn't reported.
+type senderAuth struct {
+	spf, dkim, dmarc authResult
+}
+
+// parseSenderAuth reads the checks of the server that took the message
+// in. That is the topmost Authentication-Results header of one of
+// servers, as lower ones and those naming any other server can come from
+// the sender; failing that, the newest ARC set from one of servers
+// vouches for what an earlier hop found. Without servers, nothing is
+// believed.
+func parseSenderAuth(headers []*gmail.MessagePartHeader, servers []string) senderAuth {
+	for _, h := range headers {
+		if strings.EqualFold(h.Name, "Authentication-Results") && trustedAuthServer(h.Value, servers) {
+			return parseAuthResults(h.Value)
+		}
+	}
+	var auth senderAuth
+	newest := -1
+	for _, h := range headers {
+		if !strings.EqualFold(h.Name, "ARC-Authentication-Results") {
+			continue
+		}
+		instance, rest, _ := strings.Cut(h.Value, ";")
+		tag, n, _ := strings.Cut(strings.TrimSpace(instance), "=")
+		i, err := strconv.Atoi(strings.TrimSpace(n))
+		if strings.TrimSpace(tag) != "i" || err != nil || i <= newest || !trustedAuthServer(rest, servers) {
+			continue
+		}
+		newest = i
+		auth = parseAuthResults(rest)
+	}
+	return auth
+}
+
+// trustedAuthServer tells whether the authserv-id that starts an
+// Authentication-Results value is one of servers or a host under one.
+func trustedAuthServer(value string, servers []string) bool {
+	id := authServID(value)
+	if id == "" {
+		return false
+	}
+	for _, s := range servers {
+		s = strings.ToLower(strings.TrimSuffix(s, "."))
+		if s != "" && (id == s || strings.HasSuffix(id, "."+s)) {
+			return true
+		}
+	}
+	return false
+}
+
+// authServID is the name of the server that wrote an
+// Authentication-Results value, lower-cased.
+func authServID(value string) string {
+	id, _, _ := strings.Cut(stripComments(value), ";")
+	fields := strings.Fields(id)
+	if len(fields) == 0 {
+		return ""
+	}
+	return strings.ToLower(strings.TrimSuffix(fields[0], "."))
+}
+
+// authNote explains why a message shows no sender checks when that is down
+// to the account's auth_servers: it trusts no server, or the checks in
+// headers came only from servers it doesn't trust, usually because the
+// provider's receiving servers go by another domain than its IMAP server.
+func authNote(headers []*gmail.MessagePartHeader, servers []string) string {
+	if len(servers) == 0 {
+		return "Sender checks off: set auth_servers for this account"
+	}
+	top := ""
+	for _, h := range headers {
+		if !strings.EqualFold(h.Name, "Authentication-Results") && !strings.EqualFold(h.Name, "ARC-Authentication-Results") {
+			continue
+		}
+		value := h.Value
+		if strings.EqualFold(h.Name, "ARC-Authentication-Results") {
+			_, value, _ = strings.Cut(value, ";")
+		}
+		if trustedAuthServer(value, servers) {
+			return ""
+		}
+		if top == "" && strings.EqualFold(h.Name, "Authentication-Results") {
+			top = authServID(value)
+		}
+	}
+	if top == "" {
+		return ""
+	}
+	return fmt.Sprintf("Sender checks by %s not shown: add it to auth_servers if it received this message", top)
+}
+
+// authServers are the servers whose sender checks are believed for the
+// account: those configured, or else Gmail's for Gmail and the IMAP
+// server's domain for IMAP. A Maildir's mail comes from wherever it was
+// fetched, so it has none by default.
+func (ac accountConfig) authServers() []string {
+	if len(ac.AuthServers) > 0 {
+		return ac.AuthServers
+	}
+	switch ac.Type {
+	case "", "gmail":
+		return []string{"mx.google.com"}
+	case "imap":
+		if ac.IMAP != nil {
+			return []string{registrableDomain(ac.IMAP.Host)}
+		}
+	}
+	return nil
+}
+
+// checkSender runs the sender checks on msg for the account it is in. The
+// results are kept on msg, as they don't change while it is shown.
+func (m model) checkSender(msg *emailItem) {
+	acct := m.account(msg.account)
+	msg.auth = parseSenderAuth(msg.authResults, acct.cfg.authServers())
+	msg.authNote = authNote(msg.authResults, acct.cfg.authServers())
+	msg.warnings = senderWarnings(msg, msg.auth, acct.ownAddresses(), acct.cfg.InternalDomains)
+}
+
+// parseAuthResults parses the value of an Authentication-Results header:
+// the server's name, then method=result entries separated by semicolons,
+// each with properties like header.from=example.com.
+func parseAuthResults(value string) senderAuth {
+	fields := strings.Split(stripComments(value), ";")
+	var auth senderAuth
+	for _, field := range fields[1:] {
+		words := strings.Fields(field)
+		if len(words) == 0 {
+			continue
+		}
+		method, result, ok := strings.Cut(words[0], "=")
+		if !ok {
+			continue
+		}
+		method, _, _ = strings.Cut(strings.ToLower(method), "/")
+		r := authResult{result: strings.ToLower(result)}
+		for _, prop := range words[1:] {
+			name, v, _ := strings.Cut(prop, "=")
+			switch strings.ToLower(name) {
+			case "header.from", "header.d", "smtp.mailfrom":
+				r.domain = v
+			case "header.i":
+				if r.domain == "" {
+					r.domain = v
+				}
+			}
+		}
+		if _, d, ok := strings.Cut(r.domain, "@"); ok {
+			r.domain = d
+		}
+		switch method {
+		case "spf":
+			auth.spf = preferPass(auth.spf, r)
+		case "dkim":
+			auth.dkim = preferPass(auth.dkim, r)
+		case "dmarc":
+			auth.dmarc = preferPass(auth.dmarc, r)
+		}
+	}
+	return auth
+}
+
+// preferPass keeps the first result of a method, or a later pass: a
+// message can carry several DKIM signatures and one good one is enough.
+func preferPass(have, r authResult) authResult {
+	if have.result == "" || have.result != "pass" && r.result == "pass" {
+		return r
+	}
+	return have
+}
+
+// stripComments removes RFC 5322 comments, which may nest.
+func stripComments(s string) string {
+	var b strings.Builder
+	depth := 0
+	for _, c := range s {
+		switch {
+		case c == '(':
+			depth++
+		case c == ')' && depth > 0:
+			depth--
+		case depth == 0:
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
+
+// spoofed reports mail that failed authentication outright: DMARC failed,
+// or without DMARC, SPF failed and no DKIM signature held up.
+func (a senderAuth) spoofed() bool {
+	if a.dmarc.result != "" {
+		return a.dmarc.result == "fail"
+	}
+	return (a.spf.result == "fail" || a.spf.result == "softfail") && a.dkim.result != "pass"
+}
+
+// nameDomain finds an address or domain name in a display name, as in
+// "PayPal Service <x@example.net>" written as "service@paypal.com".
+var nameDomain = regexp.MustCompile(`(?i)(?:[a-z0-9._%+-]+@)?((?:[a-z0-9-]+\.)+[a-z]{2,})\b`)
+
+// senderWarning is a sign of phishing, shown under the From line.
+type senderWarning struct {
+	level severity
+	text  string
+}
+
+// senderWarnings lists the signs of phishing in a message's headers, as
+// checked by auth. own are the account's addresses and internal its
+// organization's domains; without either, external mail can't be told
+// apart.
+func senderWarnings(msg *emailItem, auth senderAuth, own, internal []string) []senderWarning {
+	var warnings []senderWarning
+	warn := func(format string, args ...any) {
+		warnings = append(warnings, senderWarning{level: severityWarning, text: fmt.Sprintf(format, args...)})
+	}
+	if auth.spoofed() {
+		warnings = append(warnings, senderWarning{level: severityError, text: "Failed sender authentication: the From address may be forged"})
+	}
+	from, err := mail.ParseAddress(msg.from)
+	if err != nil {
+		return warnings
+	}
+	fromDomain := addressDomain(from.Address)
+
+	for _, m := range nameDomain.FindAllStringSubmatch(from.Name, -1) {
+		if _, icann := publicsuffix.PublicSuffix(strings.ToLower(m[1])); !icann {
+			continue
+		}
+		if registrableDomain(m[1]) != registrableDomain(fromDomain) {
+			warn("The name shows %s but the address is at %s", m[0], fromDomain)
+			break
+		}
+	}
+
+	if msg.replyTo != "" {
+		if list, err := mail.ParseAddressList(msg.replyTo); err == nil {
+			for _, a := range list {
+				if registrableDomain(addressDomain(a.Address)) != registrableDomain(fromDomain) {
+					warn("Replies go to %s, not to the sender's domain", a.Address)
+					break
+				}
+			}
+		}
+	}
+
+	if external, known := isExternal(from.Address, own, internal); known && external {
+		warn("External sender (%s)", fromDomain)
+	}
+	return warnings
+}
+
+// sharedMailDomains are mail providers anyone can sign up with. Sharing
+// one of them with the account says nothing about who the sender is.
+var sharedMailDomains = map[string]bool{
+	"aol.com": true, "gmail.com": true, "googlemail.com": true, "gmx.com": true,
+	"gmx.de": true, "gmx.net": true, "hey.com": true, "hotmail.com": true,
+	"icloud.com": true, "live.com": true, "mac.com": true, "mail.com": true,
+	"me.com": true, "msn.com": true, "outlook.com": true, "proton.me": true,
+	"protonmail.com": true, "web.de": true, "yahoo.com": true, "yandex.com": true,
+	"yandex.ru": true, "zoho.com": true,
+}
+
+// isExternal tells whether addr is from outside the account owner's
+// organization: at none of internal, or without those, at none of the
+// domains of own. At a shared mail provider only own addresses count as
+// inside. known is false when neither list says anything.
+func isExternal(addr string, own, internal []string) (external, known bool) {
+	domain := addressDomain(addr)
+	if len(internal) > 0 {
+		for _, d := range internal {
+			d = strings.ToLower(strings.TrimPrefix(d, "@"))
+			if domain == d || strings.HasSuffix(domain, "."+d) {
+				return false, true
+			}
+		}
+		return true, true
+	}
+	if len(own) == 0 {
+		return false, false
+	}
+	for _, o := range own {
+		switch {
+		case strings.EqualFold(addressOf(o), addr):
+			return false, true
+		case sharedMailDomains[registrableDomain(addressDomain(o))]:
+		case registrableDomain(addressDomain(o)) == registrableDomain(domain):
+			return false, true
+		}
+	}
+	return true, true
+}
+
+// addressOf is the bare address in s, or s as it is.
+func addressOf(s string) string {
+	if a, err := mail.ParseAddress(s); err == nil {
+		return a.Address
+	}
+	return s
+}
+
+func addressDomain(addr string) string {
+	if a, err := mail.ParseAddress(addr); err == nil {
+		addr = a.Address
+	}
+	_, domain, _ := strings.Cut(addr, "@")
+	return strings.ToLower(domain)
+}
+
+// summary renders the SPF, DKIM and DMARC verdicts for the From line,
+// with the domain that signed the message.
+func (a senderAuth) summary() string {
+	if a.spf.result == "" && a.dkim.result == "" && a.dmarc.result == "" {
+		return ""
+	}
+	var parts []string
+	for _, m := range []struct {
+		name string
+		r    authResult
+	}{{"SPF", a.spf}, {"DKIM", a.dkim}, {"DMARC", a.dmarc}} {
+		result := firstNonEmpty(m.r.result, "none")
+		level := severityWarning
+		switch result {
+		case "pass":
+			level = severityInfo
+		case "fail", "softfail", "permerror":
+			level = severityError
+		}
+		text := m.name + " " + result
+		if m.name == "DKIM" && m.r.domain != "" {
+			text += " (" + m.r.domain + ")"
+		}
+		parts = append(parts, toastStyles[level].Render(text))
+	}
+	return strings.Join(parts, " · ")
+}
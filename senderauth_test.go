@@ -0,0 +1,99 @@
+package main
+
+import (
+	"testing"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+func TestParseSenderAuthTrustsOnlyServers(t *testing.T) {
+	headers := []*gmail.MessagePartHeader{
+		// Forged by the sender, above the receiving server's own.
+		{Name: "Authentication-Results", Value: "evil.example.net; spf=pass smtp.mailfrom=bank.example; dmarc=pass header.from=bank.example"},
+		{Name: "Authentication-Results", Value: "mx.google.com (Google); spf=fail smtp.mailfrom=bank.example; dmarc=fail header.from=bank.example"},
+		{Name: "ARC-Authentication-Results", Value: "i=1; mx.google.com; spf=pass smtp.mailfrom=list.example"},
+	}
+	if auth := parseSenderAuth(headers, []string{"mx.google.com"}); auth.dmarc.result != "fail" || !auth.spoofed() {
+		t.Errorf("trusting mx.google.com: %+v, want its DMARC fail", auth)
+	}
+	if auth := parseSenderAuth(headers, []string{"google.com"}); auth.dmarc.result != "fail" {
+		t.Errorf("trusting google.com: %+v, want the result of its host mx.google.com", auth)
+	}
+	if auth := parseSenderAuth(headers, nil); auth != (senderAuth{}) {
+		t.Errorf("trusting nobody: %+v, want no results", auth)
+	}
+
+	arc := []*gmail.MessagePartHeader{
+		{Name: "ARC-Authentication-Results", Value: "i=2; evil.example.net; spf=pass smtp.mailfrom=bank.example"},
+		{Name: "ARC-Authentication-Results", Value: "i=1; mx.example.org; spf=softfail smtp.mailfrom=bank.example"},
+	}
+	if auth := parseSenderAuth(arc, []string{"example.org"}); auth.spf.result != "softfail" {
+		t.Errorf("ARC: %+v, want the trusted set's softfail", auth)
+	}
+}
+
+func TestAuthServers(t *testing.T) {
+	for _, tc := range []struct {
+		cfg  accountConfig
+		want string
+	}{
+		{accountConfig{}, "mx.google.com"},
+		{accountConfig{Type: "imap", IMAP: &imapConfig{Host: "imap.example.org"}}, "example.org"},
+		{accountConfig{Type: "imap", IMAP: &imapConfig{Host: "imap.example.org"}, AuthServers: []string{"mx.example.net"}}, "mx.example.net"},
+		{accountConfig{Type: "maildir"}, ""},
+	} {
+		got := ""
+		if servers := tc.cfg.authServers(); len(servers) > 0 {
+			got = servers[0]
+		}
+		if got != tc.want {
+			t.Errorf("%s account trusts %q, want %q", firstNonEmpty(tc.cfg.Type, "gmail"), got, tc.want)
+		}
+	}
+}
+
+func TestAuthNote(t *testing.T) {
+	fastmail := []*gmail.MessagePartHeader{
+		{Name: "Authentication-Results", Value: "mx6.messagingengine.com; spf=pass smtp.mailfrom=example.org"},
+		{Name: "ARC-Authentication-Results", Value: "i=1; mx6.messagingengine.com; spf=pass smtp.mailfrom=example.org"},
+	}
+	for _, tc := range []struct {
+		name    string
+		headers []*gmail.MessagePartHeader
+		servers []string
+		want    string
+	}{
+		{"no servers", fastmail, nil, "Sender checks off: set auth_servers for this account"},
+		{"other servers", fastmail, []string{"fastmail.com"}, "Sender checks by mx6.messagingengine.com not shown: add it to auth_servers if it received this message"},
+		{"trusted", fastmail, []string{"messagingengine.com"}, ""},
+		{"trusted by ARC", fastmail[1:], []string{"messagingengine.com"}, ""},
+		{"no checks", nil, []string{"fastmail.com"}, ""},
+	} {
+		if got := authNote(tc.headers, tc.servers); got != tc.want {
+			t.Errorf("%s: note %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestIsExternal(t *testing.T) {
+	for _, tc := range []struct {
+		addr            string
+		own, internal   []string
+		external, known bool
+	}{
+		{"boss@corp.example", []string{"me@corp.example"}, nil, false, true},
+		{"it@mail.corp.example", []string{"me@corp.example"}, nil, false, true},
+		{"x@phish.example", []string{"me@corp.example"}, nil, true, true},
+		// Everyone is at gmail.com; only the account's own address is inside.
+		{"stranger@gmail.com", []string{"me@gmail.com"}, nil, true, true},
+		{"Me@Gmail.com", []string{"Me <me@gmail.com>"}, nil, false, true},
+		{"boss@corp.example", []string{"me@gmail.com"}, []string{"corp.example"}, false, true},
+		{"stranger@gmail.com", []string{"me@gmail.com"}, []string{"corp.example"}, true, true},
+		{"x@corp.example", nil, nil, false, false},
+	} {
+		external, known := isExternal(tc.addr, tc.own, tc.internal)
+		if external != tc.external || known != tc.known {
+			t.Errorf("isExternal(%q, %q, %q) = %v, %v; want %v, %v", tc.addr, tc.own, tc.internal, external, known, tc.external, tc.known)
+		}
+	}
+}
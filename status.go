@@ -0,0 +1,186 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/bubbles/key"
+	"github.com/charmbracelet/bubbles/list"
+	"github.com/charmbracelet/bubbles/viewport"
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+)
+
+// severity ranks status messages; it picks the toast colour and how long
+// the toast stays up.
+type severity int
+
+const (
+	severityInfo severity = iota
+	severityWarning
+	severityError
+)
+
+func (s severity) String() string {
+	switch s {
+	case severityWarning:
+		return "WARN"
+	case severityError:
+		return "ERROR"
+	}
+	return "INFO"
+}
+
+const (
+	toastDuration      = 4 * time.Second
+	errorToastDuration = 8 * time.Second
+	// maxStatusLog is how many messages the log keeps.
+	maxStatusLog = 500
+)
+
+var toastStyles = map[severity]lipgloss.Style{
+	severityInfo:    lipgloss.NewStyle().Foreground(lipgloss.Color("42")),
+	severityWarning: lipgloss.NewStyle().Foreground(lipgloss.Color("214")),
+	severityError:   lipgloss.NewStyle().Foreground(lipgloss.Color("196")).Bold(true),
+}
+
+// statusEntry is one line of the message log.
+type statusEntry struct {
+	at    time.Time
+	level severity
+	text  string
+}
+
+func (e statusEntry) String() string {
+	return fmt.Sprintf("%s %-5s %s", e.at.Format("15:04:05"), e.level, e.text)
+}
+
+// toastExpiredMsg hides toast number id, unless a newer one replaced it.
+type toastExpiredMsg struct{ id int }
+
+func showStatus(level severity, text string) tea.Cmd {
+	return func() tea.Msg {
+		return notificationMsg{message: text, level: level}
+	}
+}
+
+type tokenWarningMsg struct{ text string }
+
+// waitTokenWarning delivers the next of tokenWarnings.
+func waitTokenWarning() tea.Cmd {
+	return func() tea.Msg {
+		return tokenWarningMsg{text: <-tokenWarnings}
+	}
+}
+
+// addStatus logs text and shows it as a toast until it times out.
+func (m *model) addStatus(level severity, text string) tea.Cmd {
+	e := statusEntry{at: time.Now(), level: level, text: text}
+	m.statusLog = append(m.statusLog, e)
+	if len(m.statusLog) > maxStatusLog {
+		m.statusLog = m.statusLog[len(m.statusLog)-maxStatusLog:]
+	}
+	if m.state == viewingLog {
+		m.refreshLog()
+	}
+
+	m.toastID++
+	m.toast = &e
+	id, d := m.toastID, toastDuration
+	if level == severityError {
+		d = errorToastDuration
+	}
+	return tea.Tick(d, func(time.Time) tea.Msg { return toastExpiredMsg{id: id} })
+}
+
+// handleLoadError reports err and leaves the loading screen, which would
+// otherwise wait for a result that isn't coming.
+func (m *model) handleLoadError(err error) tea.Cmd {
+	if m.state == loading {
+		m.state = inbox
+	}
+	return m.addStatus(severityError, errorText(err))
+}
+
+// errorText is err as shown in a toast. A rejected sign-in is reported as
+// what to do about it, without the request that ran into it.
+func errorText(err error) string {
+	var reauth *reauthError
+	if errors.As(err, &reauth) {
+		return reauth.Error()
+	}
+	return err.Error()
+}
+
+// statusLine renders the current toast, if any, for the bottom row.
+func (m model) statusLine() string {
+	if m.toast == nil {
+		return ""
+	}
+	text := m.toast.text
+	if m.toast.level == severityError {
+		text += "  ([L] log)"
+	}
+	return toastStyles[m.toast.level].MaxWidth(max(m.width, 20)).Render(text)
+}
+
+func (m *model) openLog() {
+	m.logReturn = m.state
+	m.state = viewingLog
+	m.logViewport = viewport.New(m.width, max(m.height-7, 1))
+	m.refreshLog()
+	m.logViewport.GotoBottom()
+}
+
+func (m *model) refreshLog() {
+	lines := make([]string, len(m.statusLog))
+	for i, e := range m.statusLog {
+		lines[i] = toastStyles[e.level].Render(e.String())
+	}
+	atBottom := m.logViewport.AtBottom()
+	m.logViewport.SetContent(strings.Join(lines, "\n"))
+	if atBottom {
+		m.logViewport.GotoBottom()
+	}
+}
+
+func updateLog(msg tea.Msg, m model) (tea.Model, tea.Cmd) {
+	if msg, ok := msg.(tea.KeyMsg); ok {
+		switch {
+		case key.Matches(msg, keys.Back), key.Matches(msg, keys.Log):
+			m.state = m.logReturn
+			return m, nil
+		case key.Matches(msg, keys.Quit):
+			return m, tea.Quit
+		}
+	}
+	var cmd tea.Cmd
+	m.logViewport, cmd = m.logViewport.Update(msg)
+	return m, cmd
+}
+
+func logView(m model) string {
+	if len(m.statusLog) == 0 {
+		return "\n  Message log\n\n  Nothing yet.\n\n[b] back\n"
+	}
+	return fmt.Sprintf("\n  Message log (%d)\n\n%s\n\n[↑/↓] scroll • [b] back\n", len(m.statusLog), m.logViewport.View())
+}
+
+// typing reports whether keys go to a text field rather than to commands.
+func (m model) typing() bool {
+	switch m.state {
+	case composing, replying, searching:
+		return true
+	case inbox:
+		return m.list.FilterState() == list.Filtering
+	case managingLabels:
+		return m.labelsList.FilterState() == list.Filtering
+	case viewingDrafts:
+		return m.draftsList.FilterState() == list.Filtering
+	case pickingLink:
+		return m.linksList.FilterState() == list.Filtering
+	}
+	return false
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"fmt"
+	"net/mail"
+	"slices"
+	"strings"
+
+	"github.com/charmbracelet/bubbles/key"
+	"github.com/charmbracelet/bubbles/list"
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+	"google.golang.org/api/gmail/v1"
+)
+
+// threadItem is a conversation row in the inbox list.
+type threadItem struct {
+	id           string
+	account      string
+	showAccount  bool
+	timestamp    int64
+	subject      string
+	participants string
+	snippet      string
+	count        int
+	isUnread     bool
+	labels       []string // union of the messages' labels
+}
+
+func (t threadItem) Title() string {
+	title := t.subject
+	if t.count > 1 {
+		title = fmt.Sprintf("%s (%d)", t.subject, t.count)
+	}
+	if t.isUnread {
+		return "● " + title
+	}
+	return "  " + title
+}
+
+func (t threadItem) Description() string {
+	if t.showAccount {
+		return fmt.Sprintf("[%s] %s - %s", t.account, t.participants, t.snippet)
+	}
+	return fmt.Sprintf("%s - %s", t.participants, t.snippet)
+}
+
+func (t threadItem) FilterValue() string { return t.subject + " " + t.participants }
+
+// newThreadItem summarises a thread fetched with metadata headers.
+func newThreadItem(t *gmail.Thread, account string) threadItem {
+	item := threadItem{id: t.Id, account: account, count: len(t.Messages), snippet: t.Snippet}
+	var senders []string
+	for _, msg := range t.Messages {
+		e := newEmailItem(msg)
+		if item.subject == "" {
+			item.subject = e.subject
+		}
+		if e.isUnread {
+			item.isUnread = true
+		}
+		for _, l := range e.labels {
+			if !slices.Contains(item.labels, l) {
+				item.labels = append(item.labels, l)
+			}
+		}
+		if e.timestamp > item.timestamp {
+			item.timestamp = e.timestamp
+			if e.snippet != "" {
+				item.snippet = e.snippet
+			}
+		}
+		senders = append(senders, e.from)
+	}
+	item.participants = participantNames(senders)
+	if len(item.snippet) > 80 {
+		item.snippet = item.snippet[:77] + "..."
+	}
+	return item
+}
+
+// participantNames lists the distinct senders of a thread by first name,
+// e.g. "Alice, Bob, Carol +2".
+func participantNames(from []string) string {
+	const maxShown = 3
+	var names []string
+	seen := make(map[string]bool)
+	for _, f := range from {
+		name, addr := f, f
+		if a, err := mail.ParseAddress(f); err == nil {
+			addr = strings.ToLower(a.Address)
+			name = a.Name
+			if name == "" {
+				name, _, _ = strings.Cut(a.Address, "@")
+			}
+		}
+		if seen[addr] {
+			continue
+		}
+		seen[addr] = true
+		if first, _, ok := strings.Cut(name, " "); ok {
+			name = first
+		}
+		names = append(names, name)
+	}
+	if len(names) > maxShown {
+		return fmt.Sprintf("%s +%d", strings.Join(names[:maxShown], ", "), len(names)-maxShown)
+	}
+	return strings.Join(names, ", ")
+}
+
+func threadRow(tb ThreadBackend, account string) rowFetcher {
+	return func(id string) list.Item {
+		if tb == nil {
+			return nil
+		}
+		t, err := tb.GetThread(id, "metadata", listHeaders...)
+		if err != nil || len(t.Messages) == 0 {
+			return nil
+		}
+		return newThreadItem(t, account)
+	}
+}
+
+// toggleConversations reloads the visible list as threads or back as
+// single messages, keeping the current query or label.
+func (m *model) toggleConversations() tea.Cmd {
+	if m.unified {
+		return showNotification("Conversations aren't available in the unified inbox")
+	}
+	acct := m.currentAccount()
+	if _, ok := capability[ThreadBackend](acct.backend); !ok {
+		return showNotification("Account " + acct.name + " doesn't support conversations")
+	}
+	p := m.pager
+	p.account = acct.name
+	p.threads = !p.threads
+	m.state = loading
+	return tea.Batch(m.loading.Tick, loadFirstPage(acct.backend, p))
+}
+
+// threadView is an open conversation: its messages stacked oldest first,
+// each either collapsed to one line or expanded to show headers and body.
+type threadView struct {
+	id       string
+	account  string
+	subject  string
+	messages []*emailItem
+	expanded []bool
+	cursor   int
+}
+
+// newThreadView opens t with the latest message and any unread ones
+// expanded and the cursor on the latest.
+func newThreadView(t *gmail.Thread, account string) *threadView {
+	tv := &threadView{id: t.Id, account: account}
+	for _, msg := range t.Messages {
+		item := newEmailItem(msg)
+		item.account = account
+		tv.messages = append(tv.messages, item)
+		tv.expanded = append(tv.expanded, item.isUnread)
+	}
+	last := len(tv.messages) - 1
+	tv.expanded[last] = true
+	tv.cursor = last
+	tv.subject = tv.messages[0].subject
+	return tv
+}
+
+func (tv *threadView) selected() *emailItem { return tv.messages[tv.cursor] }
+
+func (tv *threadView) isUnread() bool {
+	for _, msg := range tv.messages {
+		if msg.isUnread {
+			return true
+		}
+	}
+	return false
+}
+
+// toggleAll expands every message, or collapses all but the selected one
+// when everything is already expanded.
+func (tv *threadView) toggleAll() {
+	all := true
+	for _, e := range tv.expanded {
+		all = all && e
+	}
+	for i := range tv.expanded {
+		tv.expanded[i] = !all || i == tv.cursor
+	}
+}
+
+var (
+	threadHeaderStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("245"))
+	threadCursorStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("62")).Bold(true)
+)
+
+// render lays the thread out for a viewport of the given width and
+// returns the content along with the line the cursor is on.
+func (tv *threadView) render(width int) (string, int) {
+	var b strings.Builder
+	lines, cursorLine := 0, 0
+	write := func(s string) {
+		b.WriteString(s)
+		b.WriteString("\n")
+		lines += strings.Count(s, "\n") + 1
+	}
+
+	for i, msg := range tv.messages {
+		if i == tv.cursor {
+			cursorLine = lines
+		}
+		marker := "▸"
+		if tv.expanded[i] {
+			marker = "▾"
+		}
+		unread := " "
+		if msg.isUnread {
+			unread = "●"
+		}
+		header := fmt.Sprintf("%s %s %s", unread, marker, msg.from)
+		if msg.date != "" {
+			header += " · " + msg.date
+		}
+		if !tv.expanded[i] && msg.snippet != "" {
+			header += " · " + msg.snippet
+		}
+		style := threadHeaderStyle
+		if i == tv.cursor {
+			style = threadCursorStyle
+		}
+		write(style.MaxWidth(width).Render(header))
+
+		if !tv.expanded[i] {
+			continue
+		}
+		write("    To: " + msg.recipient)
+		if msg.cc != "" {
+			write("    CC: " + msg.cc)
+		}
+		write("")
+		write(indentLines(strings.TrimRight(msg.text(width-4), "\n"), "    "))
+		for _, att := range msg.attachments {
+			write(fmt.Sprintf("    📎 %s (%s)", att.Filename, humanSize(att.Body.Size)))
+		}
+		write("")
+	}
+	return b.String(), cursorLine
+}
+
+// refreshThread re-renders the open thread and scrolls the cursor into
+// view.
+func (m *model) refreshThread() {
+	content, cursorLine := m.thread.render(m.viewport.Width)
+	m.viewport.SetContent(content)
+	if cursorLine < m.viewport.YOffset || cursorLine >= m.viewport.YOffset+m.viewport.Height {
+		m.viewport.SetYOffset(cursorLine)
+	}
+	m.currentMsg = m.thread.selected()
+}
+
+func indentLines(text, prefix string) string {
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		lines[i] = prefix + line
+	}
+	return strings.Join(lines, "\n")
+}
+
+type threadLoadedMsg struct {
+	account string
+	thread  *gmail.Thread
+}
+
+func loadThread(b MailBackend, account, threadID string) tea.Cmd {
+	return func() tea.Msg {
+		tb, ok := capability[ThreadBackend](b)
+		if !ok {
+			return emailLoadErrorMsg{err: errNoThreads}
+		}
+		t, err := tb.GetThread(threadID, "full")
+		if err != nil {
+			return emailLoadErrorMsg{err: fmt.Errorf("failed to fetch conversation: %w", err)}
+		}
+		if len(t.Messages) == 0 {
+			return emailLoadErrorMsg{err: fmt.Errorf("conversation %s is empty", threadID)}
+		}
+		return threadLoadedMsg{account: account, thread: t}
+	}
+}
+
+func updateThread(msg tea.Msg, m model) (tea.Model, tea.Cmd) {
+	tv := m.thread
+	if msg, ok := msg.(tea.KeyMsg); ok {
+		switch {
+		case key.Matches(msg, keys.Back):
+			m.state = inbox
+			m.thread = nil
+			m.viewport.GotoTop()
+			return m, nil
+
+		case msg.String() == "up" || msg.String() == "k":
+			if tv.cursor > 0 {
+				tv.cursor--
+				m.refreshThread()
+			}
+			return m, nil
+
+		case msg.String() == "down" || msg.String() == "j":
+			if tv.cursor < len(tv.messages)-1 {
+				tv.cursor++
+				m.refreshThread()
+			}
+			return m, nil
+
+		case key.Matches(msg, keys.Select):
+			tv.expanded[tv.cursor] = !tv.expanded[tv.cursor]
+			m.refreshThread()
+			return m, nil
+
+		case key.Matches(msg, keys.ExpandAll):
+			tv.toggleAll()
+			m.refreshThread()
+			return m, nil
+
+		case key.Matches(msg, keys.Reply):
+			m.currentMsg = tv.selected()
+			return m, m.startReply(m.currentMsg, false)
+
+		case key.Matches(msg, keys.ReplyAll):
+			m.currentMsg = tv.selected()
+			return m, m.startReply(m.currentMsg, true)
+
+		case key.Matches(msg, keys.Forward):
+			m.currentMsg = tv.selected()
+			return m, m.startForward(m.currentMsg, false)
+
+		case key.Matches(msg, keys.ForwardAttachment):
+			m.currentMsg = tv.selected()
+			return m, m.startForward(m.currentMsg, true)
+
+		case key.Matches(msg, keys.Delete):
+			return m, m.queue(trashOp(tv.account, tv.id, tv.subject, true))
+
+		case key.Matches(msg, keys.ToggleRead):
+			return m, m.queue(readOp(tv.account, tv.id, tv.subject, true, tv.isUnread()))
+
+		case key.Matches(msg, keys.Labels):
+			return m, loadLabels(m.currentAccount().backend)
+
+		case key.Matches(msg, keys.Links):
+			m.currentMsg = tv.selected()
+			return m, m.openLinks()
+
+		case key.Matches(msg, keys.DownloadAttachment):
+			m.currentMsg = tv.selected()
+			if len(m.currentMsg.attachments) == 0 {
+				return m, showNotification("No attachments in this message")
+			}
+			m.attachmentDownloading = true
+			return m, nil
+
+		case key.Matches(msg, keys.Quit):
+			return m, tea.Quit
+		}
+	}
+	var cmd tea.Cmd
+	m.viewport, cmd = m.viewport.Update(msg)
+	return m, cmd
+}
+
+func threadViewView(m model) string {
+	var b strings.Builder
+	tv := m.thread
+	b.WriteString(fmt.Sprintf("\nSubject: %s\n", tv.subject))
+	b.WriteString(fmt.Sprintf("%d messages\n\n", len(tv.messages)))
+	b.WriteString(m.viewport.View() + "\n")
+
+	if m.attachmentDownloading {
+		b.WriteString("\nDownload which attachment? (1-9) [esc] cancel\n")
+		for i, att := range m.currentMsg.attachments {
+			if i < 9 {
+				b.WriteString(fmt.Sprintf("  [%d] %s (%s)\n", i+1, att.Filename, humanSize(att.Body.Size)))
+			}
+		}
+	}
+
+	b.WriteString("\n[j/k] move • [enter] expand/collapse • [e] expand all • [r] reply • [d] delete thread • [m] mark thread read/unread • [U] links • [b] back\n")
+	return b.String()
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/charmbracelet/x/term"
+	"github.com/zalando/go-keyring"
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/oauth2"
+)
+
+// errNoToken is returned by a tokenStore that has nothing saved yet.
+var errNoToken = errors.New("no saved token")
+
+// tokenStore persists the OAuth token of a single account.
+type tokenStore interface {
+	Load() (*oauth2.Token, error)
+	Save(*oauth2.Token) error
+	Delete() error
+	// Describe names the backend and location for diagnostics.
+	Describe() string
+}
+
+const keyringService = "gmail-tui"
+
+// openTokenStore picks the backend configured for the account. "auto" (the
+// default) uses the OS secret store when one is reachable and otherwise
+// falls back to a passphrase-encrypted file next to the token path.
+func openTokenStore(ac accountConfig) (tokenStore, error) {
+	switch ac.TokenStore {
+	case "file":
+		return &fileTokenStore{path: ac.Token}, nil
+	case "keyring":
+		return &keyringTokenStore{user: ac.Name}, nil
+	case "encrypted":
+		return newEncryptedTokenStore(ac), nil
+	case "", "auto":
+		if keyringAvailable() {
+			return &keyringTokenStore{user: ac.Name}, nil
+		}
+		return newEncryptedTokenStore(ac), nil
+	default:
+		return nil, fmt.Errorf("unknown token_store %q for account %s", ac.TokenStore, ac.Name)
+	}
+}
+
+// migrateLegacyToken moves a plaintext token left by older versions into
+// store and deletes the plaintext copy.
+func migrateLegacyToken(store tokenStore, legacyPath string) error {
+	if fts, ok := store.(*fileTokenStore); ok && fts.path == legacyPath {
+		return nil
+	}
+	if _, err := store.Load(); !errors.Is(err, errNoToken) {
+		return nil
+	}
+	tok, err := tokenFromFile(legacyPath)
+	if err != nil {
+		return nil
+	}
+	if err := store.Save(tok); err != nil {
+		return fmt.Errorf("unable to migrate token from %s: %v", legacyPath, err)
+	}
+	return os.Remove(legacyPath)
+}
+
+// fileTokenStore keeps the token as plaintext JSON, readable only by the
+// owner.
+type fileTokenStore struct {
+	path string
+}
+
+func (s *fileTokenStore) Load() (*oauth2.Token, error) {
+	fi, err := os.Stat(s.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, errNoToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	if runtime.GOOS != "windows" && fi.Mode().Perm()&0077 != 0 {
+		return nil, fmt.Errorf("token file %s is accessible by other users (mode %v); run chmod 600 on it", s.path, fi.Mode().Perm())
+	}
+	return tokenFromFile(s.path)
+}
+
+func (s *fileTokenStore) Save(tok *oauth2.Token) error { return saveToken(s.path, tok) }
+
+func (s *fileTokenStore) Delete() error { return removeIfExists(s.path) }
+
+func (s *fileTokenStore) Describe() string { return "file " + s.path }
+
+// keyringTokenStore keeps the token in the OS secret store: the Secret
+// Service over D-Bus on Linux, the Keychain on macOS and the Credential
+// Manager on Windows.
+type keyringTokenStore struct {
+	user string
+}
+
+func keyringAvailable() bool {
+	_, err := keyring.Get(keyringService, "__probe__")
+	return err == nil || errors.Is(err, keyring.ErrNotFound)
+}
+
+func (s *keyringTokenStore) Load() (*oauth2.Token, error) {
+	data, err := keyring.Get(keyringService, s.user)
+	if errors.Is(err, keyring.ErrNotFound) {
+		return nil, errNoToken
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read token from keyring: %v", err)
+	}
+	tok := &oauth2.Token{}
+	if err := json.Unmarshal([]byte(data), tok); err != nil {
+		return nil, fmt.Errorf("unable to decode token from keyring: %v", err)
+	}
+	return tok, nil
+}
+
+func (s *keyringTokenStore) Save(tok *oauth2.Token) error {
+	data, err := json.Marshal(tok)
+	if err != nil {
+		return err
+	}
+	if err := keyring.Set(keyringService, s.user, string(data)); err != nil {
+		return fmt.Errorf("unable to write token to keyring: %v", err)
+	}
+	return nil
+}
+
+func (s *keyringTokenStore) Delete() error {
+	err := keyring.Delete(keyringService, s.user)
+	if errors.Is(err, keyring.ErrNotFound) {
+		return nil
+	}
+	return err
+}
+
+func (s *keyringTokenStore) Describe() string {
+	return fmt.Sprintf("keyring %s/%s", keyringService, s.user)
+}
+
+// encryptedTokenStore seals the token with AES-256-GCM under a key derived
+// from a passphrase with scrypt. The passphrase comes from
+// GMAIL_TUI_PASSPHRASE or is prompted for once per run.
+type encryptedTokenStore struct {
+	path    string
+	account string
+
+	mu         sync.Mutex
+	passphrase []byte
+}
+
+type encryptedToken struct {
+	Salt       []byte `json:"salt"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+func newEncryptedTokenStore(ac accountConfig) *encryptedTokenStore {
+	return &encryptedTokenStore{
+		path:    strings.TrimSuffix(ac.Token, filepath.Ext(ac.Token)) + ".enc",
+		account: ac.Name,
+	}
+}
+
+// terminalBusy is set while the TUI owns the terminal; a passphrase
+// needed then is an error rather than a prompt.
+var terminalBusy atomic.Bool
+
+func (s *encryptedTokenStore) getPassphrase() ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.passphrase != nil {
+		return s.passphrase, nil
+	}
+	if p := os.Getenv("GMAIL_TUI_PASSPHRASE"); p != "" {
+		s.passphrase = []byte(p)
+		return s.passphrase, nil
+	}
+	if terminalBusy.Load() {
+		return nil, fmt.Errorf("passphrase for %s token needed; set GMAIL_TUI_PASSPHRASE or restart gmail-tui", s.account)
+	}
+	fmt.Fprintf(os.Stderr, "Passphrase for %s token: ", s.account)
+	p, err := term.ReadPassword(os.Stdin.Fd())
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read passphrase: %v", err)
+	}
+	if len(p) == 0 {
+		return nil, errors.New("empty passphrase")
+	}
+	s.passphrase = p
+	return p, nil
+}
+
+func (s *encryptedTokenStore) aead(salt []byte) (cipher.AEAD, error) {
+	pass, err := s.getPassphrase()
+	if err != nil {
+		return nil, err
+	}
+	key, err := scrypt.Key(pass, salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (s *encryptedTokenStore) Load() (*oauth2.Token, error) {
+	b, err := os.ReadFile(s.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, errNoToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	var et encryptedToken
+	if err := json.Unmarshal(b, &et); err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %v", s.path, err)
+	}
+	gcm, err := s.aead(et.Salt)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := gcm.Open(nil, et.Nonce, et.Ciphertext, []byte(s.account))
+	if err != nil {
+		return nil, fmt.Errorf("unable to decrypt %s: wrong passphrase?", s.path)
+	}
+	tok := &oauth2.Token{}
+	if err := json.Unmarshal(plain, tok); err != nil {
+		return nil, fmt.Errorf("unable to decode token: %v", err)
+	}
+	return tok, nil
+}
+
+func (s *encryptedTokenStore) Save(tok *oauth2.Token) error {
+	plain, err := json.Marshal(tok)
+	if err != nil {
+		return err
+	}
+	et := encryptedToken{Salt: make([]byte, 16)}
+	if _, err := rand.Read(et.Salt); err != nil {
+		return err
+	}
+	gcm, err := s.aead(et.Salt)
+	if err != nil {
+		return err
+	}
+	et.Nonce = make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(et.Nonce); err != nil {
+		return err
+	}
+	et.Ciphertext = gcm.Seal(nil, et.Nonce, plain, []byte(s.account))
+
+	data, err := json.Marshal(et)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, data, 0600)
+}
+
+func (s *encryptedTokenStore) Delete() error { return removeIfExists(s.path) }
+
+func (s *encryptedTokenStore) Describe() string { return "encrypted file " + s.path }
+
+func removeIfExists(path string) error {
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
@@ -4,17 +4,13 @@
 			"encoding/base64"
 			"fmt"
 			"log"
-			"regexp"
 			"strings"
 			"time"
 			"os"
 			"path/filepath"
-			"mime"
-			"mime/multipart"
-			"net/textproto"
+			"slices"
 			"strconv"
 			"unicode"
-		    "io"
     		"github.com/charmbracelet/bubbles/help"
 			"github.com/charmbracelet/bubbles/key"
 			"github.com/charmbracelet/bubbletea"
@@ -37,11 +33,22 @@
 			replying
 			searching
 			managingLabels
+			diagnostics
+			viewingThread
+			reviewingOutbox
+			viewingLog
+			viewingDrafts
+			previewing
+			pickingLink
+			viewingSource
 		)
 
 		type keyMap struct {
 			Back           key.Binding
 			Reply          key.Binding
+			ReplyAll       key.Binding
+			Forward        key.Binding
+			ForwardAttachment key.Binding
 			Compose        key.Binding
 			Delete         key.Binding
 			Search         key.Binding
@@ -57,6 +64,24 @@
 			AddAttachment  key.Binding
 			RemoveAttachment key.Binding
 			DownloadAttachment key.Binding
+			SwitchAccount  key.Binding
+			UnifiedInbox   key.Binding
+			Doctor         key.Binding
+			Threads        key.Binding
+			ExpandAll      key.Binding
+			Outbox         key.Binding
+			Retry          key.Binding
+			Discard        key.Binding
+			Log            key.Binding
+			Editor         key.Binding
+			Drafts         key.Binding
+			MarkdownMode   key.Binding
+			Preview        key.Binding
+			Links          key.Binding
+			CopyLink       key.Binding
+			ShowOriginal   key.Binding
+			PartTree       key.Binding
+			SaveEML        key.Binding
 		}
 
 		func (k keyMap) ShortHelp() []key.Binding {
@@ -67,10 +92,14 @@
 
 		func (k keyMap) FullHelp() [][]key.Binding {
 			return [][]key.Binding{
-				{k.Compose, k.Reply, k.Search, k.Labels},
-				{k.Delete, k.ToggleRead, k.Back, k.Quit},
-				{k.Send, k.NextInput, k.PrevInput},
+				{k.Compose, k.Drafts, k.Reply, k.ReplyAll, k.Forward, k.ForwardAttachment, k.Search, k.Labels},
+				{k.Delete, k.ToggleRead, k.Links, k.CopyLink, k.Back, k.Quit},
+				{k.ShowOriginal, k.PartTree, k.SaveEML},
+				{k.Send, k.Editor, k.MarkdownMode, k.Preview, k.NextInput, k.PrevInput},
 				{k.ShowHelp, k.CloseHelp, k.Select, k.AddAttachment, k.RemoveAttachment},
+				{k.SwitchAccount, k.UnifiedInbox, k.Doctor},
+				{k.Threads, k.ExpandAll},
+				{k.Outbox, k.Retry, k.Discard, k.Log},
 			}
 		}
 
@@ -83,6 +112,18 @@
 				key.WithKeys("r"),
 				key.WithHelp("r", "reply"),
 			),
+			ReplyAll: key.NewBinding(
+				key.WithKeys("R"),
+				key.WithHelp("R", "reply all"),
+			),
+			Forward: key.NewBinding(
+				key.WithKeys("f"),
+				key.WithHelp("f", "forward"),
+			),
+			ForwardAttachment: key.NewBinding(
+				key.WithKeys("F"),
+				key.WithHelp("F", "forward as attachment"),
+			),
 			Compose: key.NewBinding(
 				key.WithKeys("c"),
 				key.WithHelp("c", "compose"),
@@ -143,12 +184,87 @@
 			key.WithKeys("ctrl+d"),
 			key.WithHelp("ctrl+d", "download attachment"),
 			),
+			SwitchAccount: key.NewBinding(
+				key.WithKeys("a"),
+				key.WithHelp("a", "switch account"),
+			),
+			UnifiedInbox: key.NewBinding(
+				key.WithKeys("u"),
+				key.WithHelp("u", "unified inbox"),
+			),
+			Doctor: key.NewBinding(
+				key.WithKeys("D"),
+				key.WithHelp("D", "diagnostics"),
+			),
+			Threads: key.NewBinding(
+				key.WithKeys("t"),
+				key.WithHelp("t", "toggle conversations"),
+			),
+			ExpandAll: key.NewBinding(
+				key.WithKeys("e"),
+				key.WithHelp("e", "expand/collapse all"),
+			),
+			Outbox: key.NewBinding(
+				key.WithKeys("o"),
+				key.WithHelp("o", "outbox"),
+			),
+			Retry: key.NewBinding(
+				key.WithKeys("r"),
+				key.WithHelp("r", "retry"),
+			),
+			Discard: key.NewBinding(
+				key.WithKeys("d"),
+				key.WithHelp("d", "discard"),
+			),
+			Log: key.NewBinding(
+				key.WithKeys("L"),
+				key.WithHelp("L", "message log"),
+			),
+			Editor: key.NewBinding(
+				key.WithKeys("ctrl+e"),
+				key.WithHelp("ctrl+e", "edit in $EDITOR"),
+			),
+			Drafts: key.NewBinding(
+				key.WithKeys("p"),
+				key.WithHelp("p", "drafts"),
+			),
+			MarkdownMode: key.NewBinding(
+				key.WithKeys("ctrl+t"),
+				key.WithHelp("ctrl+t", "toggle Markdown"),
+			),
+			Preview: key.NewBinding(
+				key.WithKeys("ctrl+r"),
+				key.WithHelp("ctrl+r", "preview Markdown"),
+			),
+			Links: key.NewBinding(
+				key.WithKeys("U"),
+				key.WithHelp("U", "links"),
+			),
+			CopyLink: key.NewBinding(
+				key.WithKeys("y"),
+				key.WithHelp("y", "copy link"),
+			),
+			ShowOriginal: key.NewBinding(
+				key.WithKeys("O"),
+				key.WithHelp("O", "show original"),
+			),
+			PartTree: key.NewBinding(
+				key.WithKeys("T"),
+				key.WithHelp("T", "source / MIME tree"),
+			),
+			SaveEML: key.NewBinding(
+				key.WithKeys("s"),
+				key.WithHelp("s", "save as .eml"),
+			),
 		}
 
 
 		type emailItem struct {
 			id          string
 			threadId    string
+			account     string
+			showAccount bool
+			timestamp   int64
 			subject     string
 			from        string
 			snippet     string
@@ -156,10 +272,24 @@
 			labels      []string
 			isUnread    bool
 			body        string
+			// html is the HTML body when the message has no plain text;
+			// body is then its rendering without wrapping.
+			html        string
 			recipient   string
 			cc          string
 			bcc         string
+			replyTo     string
+			messageID   string
+			references  string
 			attachments []*gmail.MessagePart
+			links       []messageLink
+			// authResults are the Authentication-Results headers, read
+			// against the servers the account trusts when the message is
+			// opened, which sets auth, authNote and warnings.
+			authResults []*gmail.MessagePartHeader
+			auth        senderAuth
+			authNote    string
+			warnings    []senderWarning
 		}
 
 		func (e emailItem) Title() string {
@@ -170,11 +300,22 @@
 		}
 
 		func (e emailItem) Description() string {
+			if e.showAccount {
+				return fmt.Sprintf("[%s] %s - %s", e.account, e.from, e.snippet)
+			}
 			return fmt.Sprintf("%s - %s", e.from, e.snippet)
 		}
 
 		func (e emailItem) FilterValue() string { return e.subject + " " + e.from }
 
+		// text is the body to read, with an HTML body wrapped to width.
+		func (e emailItem) text(width int) string {
+			if e.html != "" {
+				return renderHTML(e.html, width)
+			}
+			return e.body
+		}
+
 		type labelItem struct {
 			label *gmail.Label
 		}
@@ -186,13 +327,17 @@
 		type model struct {
 			state             state
 			list              list.Model
-			srv               *gmail.Service
+			paths             appPaths
+			accounts          []*account
+			active            int
+			unified           bool
+			pager             listPager
+			rows              *rowStream
 			fullEmail         string
 			loading           spinner.Model
 			viewport          viewport.Model
 			width             int
 			height            int
-			err               string
 			help              help.Model
 			showHelp          bool
 			composeFrom       textinput.Model
@@ -206,26 +351,47 @@
 			labels            []*gmail.Label
 			labelsList        list.Model
 			currentMsg        *emailItem
+			thread            *threadView
 			replyToMsg        *emailItem
+			reply             outgoing
 			focused           int
 			searchQuery       string
 			composeAttachments []string
+			composeForward     *forwardSource
+			composeKept        []mimePart
+			draft              *draftSession
+			draftsList         list.Model
+			markdown           bool
+			previewViewport    viewport.Model
+			previewReturn      state
+			linksList          list.Model
+			linksReturn        state
+			clipboard          string // OSC 52 sequence written with the next frames
+			opener             string
+			original           *originalLoadedMsg
+			diagnosticsReport  string
+			originalTree       bool
+			sourceViewport     viewport.Model
 			replyAttachments   []string
 			attachmentInput    textinput.Model
 			addingAttachment   bool
 			composeFocus int
 			attachmentDownloading bool
 			downloadingIndex      int
+			outbox                *outbox
+			outboxList            list.Model
+			toast                 *statusEntry
+			toastID               int
+			statusLog             []statusEntry
+			logViewport           viewport.Model
+			logReturn             state
 
 		}
 
-		func initialModel(emails []*gmail.Message, srv *gmail.Service, labels []*gmail.Label) model {
-			items := []list.Item{}
-			for _, msg := range emails {
-				item := createEmailItem(srv, msg.Id, false)
-				if item != nil {
-					items = append(items, *item)
-				}
+		func initialModel(paths appPaths, accounts []*account, active int, firstPage *gmail.ListMessagesResponse, labels []*gmail.Label, ob *outbox) model {
+			acct := accounts[active]
+			if ob == nil {
+				ob = &outbox{}
 			}
 
 			composeBody := textarea.New()
@@ -241,22 +407,14 @@
 			replyBody.SetWidth(80)
 			replyBody.SetHeight(10)
 
-			delegate := list.NewDefaultDelegate()
-			delegate.Styles.SelectedTitle = delegate.Styles.SelectedTitle.
-				BorderForeground(lipgloss.Color("62")).
-				Foreground(lipgloss.Color("62"))
-			delegate.Styles.SelectedDesc = delegate.Styles.SelectedTitle.Copy().
-				Foreground(lipgloss.Color("245"))
-
-			l := list.New(items, delegate, 0, 0)
-			l.Title = "Inbox"
-			l.Styles.Title = lipgloss.NewStyle().MarginLeft(2)
-			l.SetShowStatusBar(true)
-			l.SetFilteringEnabled(true)
-			l.SetShowHelp(false)
-			l.DisableQuitKeybindings()
-			l.KeyMap.Quit = key.NewBinding(key.WithKeys("q"))
-			l.SetSize(0, 0)
+			for i, a := range accounts {
+				a.list = newEmailList(inboxTitle(accounts, a.name), nil)
+				if i == active {
+					a.pager = newListPager(a.name, inboxQuery, nil, firstPage)
+					setListStatus(&a.list, a.pager)
+					a.loaded = true
+				}
+			}
 
 			labelsList := list.New([]list.Item{}, list.NewDefaultDelegate(), 0, 0)
 			labelsList.Title = "Labels"
@@ -280,18 +438,20 @@
 			from.Focus()
 			from.CharLimit = 100
 
+			// Address lists are unlimited: $EDITOR and resumed drafts fill
+			// them with however many recipients they have.
 			to := textinput.New()
 			to.Placeholder = "To"
-			to.CharLimit = 100
+			to.CharLimit = 0
 
 			cc := textinput.New()
 			cc.Placeholder = "CC"
-			cc.CharLimit = 100
+			cc.CharLimit = 0
 
 
 			bcc := textinput.New()
 			bcc.Placeholder = "BCC"
-			bcc.CharLimit = 100
+			bcc.CharLimit = 0
 
 			subj := textinput.New()
 			subj.Placeholder = "Subject"
@@ -306,10 +466,13 @@
 			help := help.New()
 			help.ShowAll = false
 
-			return model{
+			m := model{
 				state:             inbox,
-        		list:              l,
-        		srv:               srv,
+        		list:              acct.list,
+        		pager:             acct.pager,
+        		paths:             paths,
+        		accounts:          accounts,
+        		active:            active,
         		loading:           s,
         		viewport:          vp,
         		help:              help,
@@ -327,44 +490,67 @@
         		composeAttachments: []string{},
         		replyAttachments:   []string{},
         		focused:           0,
+        		outbox:            ob,
+			}
+			// Rows of the first page stream in once the program starts.
+			var ids []string
+			if firstPage != nil {
+				for _, msg := range firstPage.Messages {
+					ids = append(ids, msg.Id)
+				}
 			}
+			m.streamRows(ids)
+			return m
 		}
 
-		func (m model) Init() tea.Cmd {
-			return m.loading.Tick
+		func newEmailList(title string, items []list.Item) list.Model {
+			delegate := list.NewDefaultDelegate()
+			delegate.Styles.SelectedTitle = delegate.Styles.SelectedTitle.
+				BorderForeground(lipgloss.Color("62")).
+				Foreground(lipgloss.Color("62"))
+			delegate.Styles.SelectedDesc = delegate.Styles.SelectedTitle.Copy().
+				Foreground(lipgloss.Color("245"))
+
+			l := list.New(items, delegate, 0, 0)
+			l.Title = title
+			l.Styles.Title = lipgloss.NewStyle().MarginLeft(2)
+			l.SetShowStatusBar(true)
+			l.SetStatusBarItemName("email", "emails")
+			l.SetFilteringEnabled(true)
+			l.SetShowHelp(false)
+			l.DisableQuitKeybindings()
+			l.KeyMap.Quit = key.NewBinding(key.WithKeys("q"))
+			l.SetSize(0, 0)
+			return l
 		}
 
-		func loadEmailsByLabel(srv *gmail.Service, labelID string) tea.Cmd {
-			return func() tea.Msg {
-				msgs, err := srv.Users.Messages.List("me").LabelIds(labelID).MaxResults(10).Do()
-				if err != nil {
-					return emailLoadErrorMsg{err: err}
-				}
-				return searchResultMsg{messages: msgs.Messages}
+		func (m model) Init() tea.Cmd {
+			cmds := []tea.Cmd{m.loading.Tick, m.pollHistory(), schedulePoll(), m.outbox.flush(m.accounts), loadIdentities(m.accounts), waitTokenWarning()}
+			if m.rows != nil {
+				cmds = append(cmds, m.rows.next())
 			}
+			return tea.Batch(cmds...)
 		}
 
+		func loadEmailsByLabel(acct *account, labelID string, threads bool) tea.Cmd {
+			return loadFirstPage(acct.backend, listPager{account: acct.name, labelIDs: []string{labelID}, threads: threads})
+		}
 
-		func downloadAttachment(srv *gmail.Service, msgID string, attachment *gmail.MessagePart) tea.Cmd {
-		return func() tea.Msg {
-			att, err := srv.Users.Messages.Attachments.Get("me", msgID, attachment.Body.AttachmentId).Do()
-			if err != nil {
-				return notificationMsg{message: fmt.Sprintf("Download failed: %v", err)}
-			}
 
-			// Use base64.RawURLEncoding for proper decoding
-			data, err := base64.RawURLEncoding.DecodeString(att.Data)
+		func downloadAttachment(b MailBackend, dir, msgID string, attachment *gmail.MessagePart) tea.Cmd {
+		return func() tea.Msg {
+			data, err := b.GetAttachment(msgID, attachment.Body.AttachmentId)
 			if err != nil {
-				return notificationMsg{message: fmt.Sprintf("Failed to decode attachment: %v", err)}
+				return notificationMsg{message: "Download failed: "+errorText(err), level: severityError}
 			}
 
-			if err := os.MkdirAll("downloads", 0755); err != nil {
-				return notificationMsg{message: fmt.Sprintf("Couldn't create downloads directory: %v", err)}
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				return notificationMsg{message: fmt.Sprintf("Couldn't create downloads directory: %v", err), level: severityError}
 			}
 
-			filename := filepath.Join("downloads", sanitizeFilename(attachment.Filename))
+			filename := filepath.Join(dir, sanitizeFilename(attachment.Filename))
 			if err := os.WriteFile(filename, data, 0644); err != nil {
-				return notificationMsg{message: fmt.Sprintf("Save failed: %v", err)}
+				return notificationMsg{message: fmt.Sprintf("Save failed: %v", err), level: severityError}
 			}
 
 			return attachmentDownloadedMsg{filename: filename}
@@ -393,10 +579,33 @@
 				m.help.Width = msg.Width
 
 				if m.state == inbox {
-					m.list.SetSize(msg.Width, msg.Height-3)
+					m.list.SetSize(msg.Width, msg.Height-4)
 				} else if m.state == viewing {
 					m.viewport.Width = msg.Width
-					m.viewport.Height = msg.Height - 7
+					m.viewport.Height = msg.Height - 8
+					if m.currentMsg != nil && m.currentMsg.html != "" {
+						m.fullEmail = formatEmailBody(m.currentMsg, m.viewport.Width-m.viewport.Style.GetHorizontalFrameSize())
+						m.viewport.SetContent(m.fullEmail)
+					}
+				} else if m.state == viewingThread {
+					m.viewport.Width = msg.Width
+					m.viewport.Height = msg.Height - 8
+					m.refreshThread()
+				} else if m.state == reviewingOutbox {
+					m.outboxList.SetSize(msg.Width, msg.Height-4)
+				} else if m.state == viewingLog {
+					m.logViewport.Width = msg.Width
+					m.logViewport.Height = msg.Height - 7
+				} else if m.state == viewingDrafts {
+					m.draftsList.SetSize(msg.Width, msg.Height-4)
+				} else if m.state == previewing {
+					m.previewViewport.Width = msg.Width
+					m.previewViewport.Height = msg.Height - 5
+				} else if m.state == pickingLink {
+					m.linksList.SetSize(msg.Width, msg.Height-4)
+				} else if m.state == viewingSource {
+					m.sourceViewport.Width = msg.Width
+					m.sourceViewport.Height = msg.Height - 5
 				}
 				return m, nil
 
@@ -415,7 +624,12 @@
 					}
 				}
 
-				if m.state == viewing && m.attachmentDownloading {
+				if key.Matches(msg, keys.Log) && m.state != viewingLog && !m.typing() {
+					m.openLog()
+					return m, nil
+				}
+
+				if (m.state == viewing || m.state == viewingThread) && m.attachmentDownloading {
 					switch {
 					case key.Matches(msg, keys.Back):
 						m.attachmentDownloading = false
@@ -428,7 +642,7 @@
 									attachment := m.currentMsg.attachments[digit-1]
 									return m, tea.Batch(
 										showNotification(fmt.Sprintf("Downloading 			%s...", attachment.Filename)),
-										downloadAttachment(m.srv, m.currentMsg.id, 			attachment),
+										downloadAttachment(m.backend(m.currentMsg.account), m.paths.DownloadDir, m.currentMsg.id, 			attachment),
 									)
 								}
 							}
@@ -450,20 +664,133 @@
 					return updateSearching(msg, m)
 				case managingLabels:
 					return updateLabelManagement(msg, m)
+				case viewingThread:
+					return updateThread(msg, m)
+				case reviewingOutbox:
+					return updateOutbox(msg, m)
+				case viewingLog:
+					return updateLog(msg, m)
+				case viewingDrafts:
+					return updateDrafts(msg, m)
+				case previewing:
+					return updatePreview(msg, m)
+				case pickingLink:
+					return updateLinks(msg, m)
+				case viewingSource:
+					return updateSource(msg, m)
+				case loading:
+					if key.Matches(msg, keys.Back) {
+						// Whatever was loading is dropped when it arrives.
+						m.state = inbox
+						return m, nil
+					}
+					if key.Matches(msg, keys.Quit) {
+						return m, tea.Quit
+					}
+				case diagnostics:
+					if key.Matches(msg, keys.Back) {
+						m.state = inbox
+					} else if key.Matches(msg, keys.Quit) {
+						return m, tea.Quit
+					}
+					return m, nil
 				}
 
+			case notificationMsg:
+				return m, m.addStatus(msg.level, msg.message)
+
+			case tokenWarningMsg:
+				return m, tea.Batch(m.addStatus(severityWarning, msg.text), waitTokenWarning())
+
+			case clipboardSentMsg:
+				if m.clipboard == msg.seq {
+					m.clipboard = ""
+				}
+				return m, nil
+
+			case emailLoadErrorMsg:
+				return m, m.handleLoadError(msg.err)
+
+			case identityMsg:
+				for _, a := range m.accounts {
+					if a.name == msg.account {
+						a.addresses = msg.addresses
+					}
+				}
+				return m, nil
+
+			case toastExpiredMsg:
+				if msg.id == m.toastID {
+					m.toast = nil
+				}
+				return m, nil
+
+			case diagnosticsMsg:
+				m.diagnosticsReport = msg.report
+				return m, nil
+
 			case emailLoadedMsg:
+				if m.state != loading {
+					return m, nil
+				}
+				// List rows only carry headers; take body and attachments
+				// from the full message.
+				if m.currentMsg != nil {
+					msg.item.account = m.currentMsg.account
+				}
+				m.currentMsg = msg.item
+				m.checkSender(m.currentMsg)
 				m.state = viewing
-				m.fullEmail = msg.content
 				m.viewport.Width = m.width
-				m.viewport.Height = m.height - 7
+				m.viewport.Height = m.height - 8
+				m.fullEmail = formatEmailBody(m.currentMsg, m.viewport.Width-m.viewport.Style.GetHorizontalFrameSize())
 				m.viewport.SetContent(m.fullEmail)
 				return m, nil
 
+			case originalLoadedMsg:
+				if m.state != loading {
+					return m, nil
+				}
+				m.openOriginal(msg)
+				return m, nil
+
+			case editorFinishedMsg:
+				return m, m.applyEditedDraft(msg)
+
+			case draftTickMsg:
+				if msg.session != m.draft {
+					return m, nil
+				}
+				// The session outlives trips to the preview and elsewhere;
+				// only the compose screen, or its preview, has it to save.
+				if m.state == composing || m.state == previewing && m.previewReturn == composing {
+					return m, tea.Batch(m.saveDraft(true), draftTick(msg.session))
+				}
+				return m, draftTick(msg.session)
+
+			case draftSavedMsg:
+				return m, m.draftSaved(msg)
+
+			case draftsLoadedMsg:
+				if m.state != loading || msg.account != m.currentAccount().name {
+					return m, nil
+				}
+				m.openDrafts(msg.items)
+				return m, nil
+
+			case draftResumedMsg:
+				if m.state != loading {
+					return m, nil
+				}
+				return m, m.resumeDraftLoaded(msg)
+
 			case emailSentMsg:
 				m.state = inbox
 				m.viewport.GotoTop()
-				return m, tea.Batch(showNotification("Email sent successfully!"))
+				return m, m.queue(msg.op)
+
+			case outboxFlushedMsg:
+				return m, m.flushDone(msg)
 
 			case labelsLoadedMsg:
 				items := make([]list.Item, len(msg.labels))
@@ -476,19 +803,68 @@
 				return m, nil
 
 			case searchResultMsg:
-				items := []list.Item{}
-				for _, msg := range msg.messages {
-					item := createEmailItem(m.srv, msg.Id, true)
-					if item != nil {
-						items = append(items, *item)
-					}
+				if !msg.refresh && m.state != loading {
+					return m, nil
+				}
+				m.list.SetItems(nil)
+				m.list.ResetSelected()
+				m.pager = msg.pager
+				setListStatus(&m.list, m.pager)
+				if !msg.refresh {
+					m.state = inbox
+				}
+				return m, m.streamRows(msg.ids)
+
+			case pollTickMsg:
+				return m, tea.Batch(m.pollHistory(), schedulePoll(), m.outbox.flush(m.accounts))
+
+			case historyMsg:
+				return m, m.applyHistory(msg)
+
+			case threadLoadedMsg:
+				if m.state != loading {
+					return m, nil
 				}
-				m.list.SetItems(items)
+				m.thread = newThreadView(msg.thread, msg.account)
+				m.state = viewingThread
+				m.viewport.Width = m.width
+				m.viewport.Height = m.height - 8
+				m.viewport.GotoTop()
+				m.refreshThread()
+				return m, nil
+
+			case rowsArrivedMsg:
+				return m, m.insertRows(msg)
+
+			case pageLoadedMsg:
+				return m, m.appendPage(msg)
+
+			case inboxLoadedMsg:
+				acct := m.currentAccount()
+				if acct.name != msg.account || m.unified {
+					return m, nil
+				}
+				acct.loaded = true
+				m.list.SetItems(nil)
+				m.pager = msg.pager
+				setListStatus(&m.list, m.pager)
 				m.state = inbox
+				return m, m.streamRows(msg.ids)
+
+			case unifiedInboxMsg:
+				if m.unified {
+					m.list.SetItems(msg.items)
+					if m.state == loading {
+						m.state = inbox
+					}
+				}
 				return m, nil
 
 			case attachmentDownloadedMsg:
 				return m, showNotification(fmt.Sprintf("Downloaded: %s", msg.filename))
+
+			case emlSavedMsg:
+				return m, showNotification(fmt.Sprintf("Saved: %s", msg.filename))
 			}
 
 			// Handle other states
@@ -497,7 +873,7 @@
 				var cmd tea.Cmd
 				m.loading, cmd = m.loading.Update(msg)
 				cmds = append(cmds, cmd)
-			case viewing:
+			case viewing, viewingThread:
 				var cmd tea.Cmd
 				m.viewport, cmd = m.viewport.Update(msg)
 				cmds = append(cmds, cmd)
@@ -521,9 +897,16 @@
 
 		func (m model) View() string {
 			if m.showHelp {
-				return m.help.View(keys)
+				return m.clipboard + m.help.View(keys)
+			}
+			view := m.clipboard + m.screenView()
+			if status := m.statusLine(); status != "" {
+				view += "\n" + status
 			}
+			return view
+		}
 
+		func (m model) screenView() string {
 			switch m.state {
 			case inbox:
 				return inboxView(m)
@@ -539,6 +922,22 @@
 				return searchView(m)
 			case managingLabels:
 				return labelsView(m)
+			case diagnostics:
+				return diagnosticsView(m)
+			case viewingThread:
+				return threadViewView(m)
+			case reviewingOutbox:
+				return outboxView(m)
+			case viewingLog:
+				return logView(m)
+			case viewingDrafts:
+				return draftsView(m)
+			case previewing:
+				return previewView(m)
+			case pickingLink:
+				return linksView(m)
+			case viewingSource:
+				return sourceView(m)
 			default:
 				return ""
 			}
@@ -551,24 +950,27 @@
 					attachments = append(attachments, findAttachments(p)...)
 				}
 			} else if part.Filename != "" {
+				part.Filename = decodeHeader(part.Filename)
 				attachments = append(attachments, part)
 			}
 			return attachments
 		}
 
-		func createEmailItem(srv *gmail.Service, msgId string, minimal bool) *emailItem {
-			if srv == nil {
-				log.Println("Gmail service is not initialized")
+		// createEmailItem fetches msgId in format; "metadata" asks only for
+		// listHeaders.
+		func createEmailItem(b MailBackend, msgId string, format string) *emailItem {
+			if b == nil {
+				log.Println("Mail backend is not initialized")
 				return nil
 			}
 
 			var msg *gmail.Message
 			var err error
 
-			if minimal {
-				msg, err = srv.Users.Messages.Get("me", msgId).Format("minimal").Do()
+			if format == "metadata" {
+				msg, err = b.GetMessage(msgId, format, listHeaders...)
 			} else {
-				msg, err = srv.Users.Messages.Get("me", msgId).Format("full").Do()
+				msg, err = b.GetMessage(msgId, format)
 			}
 
 			if err != nil {
@@ -580,34 +982,55 @@
 				log.Printf("Received nil message for ID %s\n", msgId)
 				return nil
 			}
+			return newEmailItem(msg)
+		}
 
+		// newEmailItem builds a list row from msg. Body and attachments are
+		// only filled in when msg has its full payload.
+		func newEmailItem(msg *gmail.Message) *emailItem {
 			item := &emailItem{
-				id:       msg.Id,
-				threadId: msg.ThreadId,
-				snippet:  msg.Snippet,
+				id:        msg.Id,
+				threadId:  msg.ThreadId,
+				snippet:   msg.Snippet,
+				timestamp: msg.InternalDate,
 			}
 
 			if msg.Payload != nil {
 			for _, h := range msg.Payload.Headers {
 				switch h.Name {
 				case "Subject":
-					item.subject = h.Value
+					item.subject = decodeHeader(h.Value)
 				case "From":
-					item.from = h.Value
+					item.from = decodeAddresses(h.Value)
 				case "Date":
 					item.date = formatDate(h.Value)
 				case "To":
-					item.recipient = h.Value
+					item.recipient = decodeAddresses(h.Value)
 				case "Cc":
-					item.cc = h.Value
+					item.cc = decodeAddresses(h.Value)
 				case "Bcc":
-					item.bcc = h.Value
+					item.bcc = decodeAddresses(h.Value)
+				case "Reply-To":
+					item.replyTo = decodeAddresses(h.Value)
+				case "Message-ID", "Message-Id":
+					item.messageID = h.Value
+				case "References":
+					item.references = h.Value
 				}
 			}
 
-			if !minimal {
-				item.body = extractPlainText(msg.Payload)
-				item.attachments = findAttachments(msg.Payload)
+			if body, isHTML := messageBody(msg.Payload); isHTML {
+				item.html = body
+				item.body = renderHTML(body, 0)
+			} else {
+				item.body = body
+			}
+			item.attachments = findAttachments(msg.Payload)
+			item.links = messageLinks(msg.Payload)
+			for _, h := range msg.Payload.Headers {
+				if strings.EqualFold(h.Name, "Authentication-Results") || strings.EqualFold(h.Name, "ARC-Authentication-Results") {
+					item.authResults = append(item.authResults, h)
+				}
 			}
 		}
 
@@ -627,7 +1050,13 @@
 
 
 		func inboxView(m model) string {
-			help := "\n[c] compose • [r] reply • [d] delete • [m] mark read/unread • [l] labels • [/] search • [?] help • [q] quit\n"
+			help := "\n[c] compose • [r] reply • [d] delete • [m] mark read/unread • [l] labels • [/] search • [t] conversations • [?] help • [q] quit\n"
+			if len(m.accounts) > 1 {
+				help = "\n[a] switch account • [u] unified inbox" + help
+			}
+			if status := outboxStatus(m.outbox); status != "" {
+				help += status
+			}
 			return m.list.View() + help
 		}
 
@@ -636,7 +1065,17 @@
 func emailView(m model) string {
     var b strings.Builder
 
-    b.WriteString(fmt.Sprintf("\nFrom: %s\n", m.currentMsg.from))
+    b.WriteString(fmt.Sprintf("\nFrom: %s", m.currentMsg.from))
+    if summary := m.currentMsg.auth.summary(); summary != "" {
+        b.WriteString("  " + summary)
+    }
+    b.WriteString("\n")
+    if m.currentMsg.authNote != "" {
+        b.WriteString(toastStyles[severityInfo].Render("ⓘ "+m.currentMsg.authNote) + "\n")
+    }
+    for _, w := range m.currentMsg.warnings {
+        b.WriteString(toastStyles[w.level].Render("⚠ "+w.text) + "\n")
+    }
     b.WriteString(fmt.Sprintf("To: %s\n", m.currentMsg.recipient))
 
     if m.currentMsg.cc != "" {
@@ -665,19 +1104,20 @@ func emailView(m model) string {
         b.WriteString("\n")
     }
 
-    b.WriteString("\n[b] back • [r] reply • [d] delete • [m] mark read/unread • [ctrl+d] download attachment • [q] quit\n")
+    b.WriteString("\n[b] back • [r] reply • [d] delete • [m] mark read/unread • [U] links • [O] original • [ctrl+d] download attachment • [q] quit\n")
     return b.String()
 }
 
 
 		func loadingView(m model) string {
 			return lipgloss.Place(
-				m.width, m.height,
+				m.width, m.height-1,
 				lipgloss.Center, lipgloss.Center,
 				lipgloss.JoinVertical(
 					lipgloss.Center,
 					m.loading.View(),
 					"Loading...",
+					"[esc] cancel",
 				),
 			)
 		}
@@ -691,11 +1131,18 @@ func emailView(m model) string {
 			view.WriteString(fmt.Sprintf("  BCC:  %s\n", m.composeBcc.View()))
 			view.WriteString(fmt.Sprintf("  Subj: %s\n\n", m.composeSubj.View()))
 			view.WriteString("  Body:\n" + m.composeBody.View() + "\n")
+			view.WriteString(m.markdownStatus())
 
-			if len(m.composeAttachments) > 0 {
+			if len(m.composeAttachments) > 0 || len(m.composeKept) > 0 || m.composeForward != nil {
 				view.WriteString("\nAttachments:\n")
+				for i, p := range m.composeKept {
+					view.WriteString(fmt.Sprintf("  [%d] %s\n", i+1, p.filename()))
+				}
 				for i, f := range m.composeAttachments {
-					view.WriteString(fmt.Sprintf("  [%d] %s\n", i+1, filepath.Base(f)))
+					view.WriteString(fmt.Sprintf("  [%d] %s\n", len(m.composeKept)+i+1, filepath.Base(f)))
+				}
+				for _, name := range m.composeForward.names() {
+					view.WriteString(fmt.Sprintf("  [fwd] %s\n", name))
 				}
 			}
 
@@ -703,16 +1150,20 @@ func emailView(m model) string {
 				view.WriteString("\nAttachment Path: " + m.attachmentInput.View())
 			}
 
-			view.WriteString("\n[ctrl+s] send • [ctrl+a] add attachment • [ctrl+x] remove attachment • [esc] back")
+			view.WriteString("\n[ctrl+s] send • [ctrl+e] $EDITOR • [ctrl+a] add attachment • [ctrl+x] remove attachment • [esc] back")
 
 			return view.String()
 		}
 
 		func replyView(m model) string {
 			view := strings.Builder{}
-			view.WriteString(fmt.Sprintf("\n  Reply to: %s\n", m.replyToMsg.from))
-			view.WriteString(fmt.Sprintf("  Subject: Re: %s\n\n", m.replyToMsg.subject))
+			view.WriteString(fmt.Sprintf("\n  To: %s\n", m.reply.to))
+			if m.reply.cc != "" {
+				view.WriteString(fmt.Sprintf("  CC: %s\n", m.reply.cc))
+			}
+			view.WriteString(fmt.Sprintf("  Subject: %s\n\n", m.reply.subject))
 			view.WriteString(m.replyBody.View() + "\n")
+			view.WriteString(m.markdownStatus())
 
 			if len(m.replyAttachments) > 0 {
 				view.WriteString("\nAttachments:\n")
@@ -725,7 +1176,7 @@ func emailView(m model) string {
 				view.WriteString("\nAttachment Path: " + m.attachmentInput.View())
 			}
 
-			view.WriteString("\n[ctrl+s] send • [ctrl+a] add attachment • [ctrl+x] remove attachment • [esc] back")
+			view.WriteString("\n[ctrl+s] send • [ctrl+e] $EDITOR • [ctrl+a] add attachment • [ctrl+x] remove attachment • [esc] back")
 			return view.String()
 
 		}
@@ -748,6 +1199,25 @@ func emailView(m model) string {
 			return "\n  Search: " + m.searchInput.View() + "\n\n[enter] search • [esc] cancel\n"
 		}
 
+		type diagnosticsMsg struct{ report string }
+
+		// loadDiagnostics builds the doctor report off the UI goroutine: it
+		// stats files and probes the keyring for each account.
+		func loadDiagnostics(paths appPaths, accounts []*account) tea.Cmd {
+			cfgs := make([]accountConfig, len(accounts))
+			for i, a := range accounts {
+				cfgs[i] = a.cfg
+			}
+			return func() tea.Msg {
+				return diagnosticsMsg{report: doctorReport(paths, cfgs)}
+			}
+		}
+
+		func diagnosticsView(m model) string {
+			report := firstNonEmpty(m.diagnosticsReport, "Checking…\n")
+			return "\n  Diagnostics\n\n" + report + "\n[b] back • [q] quit\n"
+		}
+
 		func labelsView(m model) string {
 			help := "\n[↑/↓] navigate • [enter] select • [b] back\n"
 			return m.labelsList.View() + help
@@ -760,8 +1230,16 @@ func emailView(m model) string {
 				switch {
 				case key.Matches(msg, keys.Compose):
 					m.state = composing
-					m.composeFrom.SetValue("me")
-					return m, nil
+					m.resetCompose()
+					m.focused = 0
+					return m, tea.Batch(m.focusComposeField(), m.watchDraft())
+
+				case key.Matches(msg, keys.Drafts):
+					if m.list.FilterState() == list.Filtering {
+						break
+					}
+					m.state = loading
+					return m, loadDrafts(m.currentAccount())
 
 				case key.Matches(msg, keys.Search):
 					m.state = searching
@@ -769,12 +1247,49 @@ func emailView(m model) string {
 					return m, nil
 
 				case key.Matches(msg, keys.Labels):
-					return m, loadLabels(m.srv)
+					return m, loadLabels(m.currentAccount().backend)
+
+				case key.Matches(msg, keys.SwitchAccount):
+					if m.list.FilterState() == list.Filtering || len(m.accounts) < 2 {
+						break
+					}
+					return m, m.switchAccount((m.active + 1) % len(m.accounts))
+
+				case key.Matches(msg, keys.Doctor):
+					if m.list.FilterState() == list.Filtering {
+						break
+					}
+					m.state = diagnostics
+					m.diagnosticsReport = ""
+					return m, loadDiagnostics(m.paths, m.accounts)
+
+				case key.Matches(msg, keys.UnifiedInbox):
+					if m.list.FilterState() == list.Filtering || len(m.accounts) < 2 {
+						break
+					}
+					return m, m.toggleUnified()
+
+				case key.Matches(msg, keys.Threads):
+					if m.list.FilterState() == list.Filtering {
+						break
+					}
+					return m, m.toggleConversations()
+
+				case key.Matches(msg, keys.Outbox):
+					if m.list.FilterState() == list.Filtering {
+						break
+					}
+					m.openOutbox()
+					return m, nil
 
 				case key.Matches(msg, keys.Quit):
 					return m, tea.Quit
 
 				case msg.String() == "enter":
+					if t, ok := m.list.SelectedItem().(threadItem); ok {
+						m.state = loading
+						return m, tea.Batch(m.loading.Tick, loadThread(m.backend(t.account), t.account, t.id))
+					}
 					selected, ok := m.list.SelectedItem().(emailItem)
 					if !ok {
 						return m, nil
@@ -783,25 +1298,29 @@ func emailView(m model) string {
 					m.state = loading
 					return m, tea.Batch(
 						m.loading.Tick,
-						loadEmail(m.srv, selected.id),
+						loadEmail(m.backend(selected.account), selected.id),
 					)
 
 				case key.Matches(msg, keys.Delete):
-					selected, ok := m.list.SelectedItem().(emailItem)
-					if ok {
-						return m, deleteEmail(m.srv, selected.id)
+					switch selected := m.list.SelectedItem().(type) {
+					case emailItem:
+						return m, m.queue(trashOp(selected.account, selected.id, selected.subject, false))
+					case threadItem:
+						return m, m.queue(trashOp(selected.account, selected.id, selected.subject, true))
 					}
 
 				case key.Matches(msg, keys.ToggleRead):
-					selected, ok := m.list.SelectedItem().(emailItem)
-					if ok {
-						return m, toggleReadStatus(m.srv, selected.id, selected.isUnread)
+					switch selected := m.list.SelectedItem().(type) {
+					case emailItem:
+						return m, m.queue(readOp(selected.account, selected.id, selected.subject, false, selected.isUnread))
+					case threadItem:
+						return m, m.queue(readOp(selected.account, selected.id, selected.subject, true, selected.isUnread))
 					}
 				}
 			}
 
 			m.list, cmd = m.list.Update(msg)
-			return m, cmd
+			return m, tea.Batch(cmd, m.loadMoreIfNeeded())
 		}
 
 		type emailLoadErrorMsg struct {
@@ -823,19 +1342,32 @@ func emailView(m model) string {
 					return m, nil
 
 				case key.Matches(msg, keys.Reply):
-					m.state = replying
-					m.replyToMsg = m.currentMsg
-					m.replyBody.Focus()
-					return m, nil
+					return m, m.startReply(m.currentMsg, false)
+
+				case key.Matches(msg, keys.ReplyAll):
+					return m, m.startReply(m.currentMsg, true)
+
+				case key.Matches(msg, keys.Forward):
+					return m, m.startForward(m.currentMsg, false)
+
+				case key.Matches(msg, keys.ForwardAttachment):
+					return m, m.startForward(m.currentMsg, true)
 
 				case key.Matches(msg, keys.Delete):
-					return m, deleteEmail(m.srv, m.currentMsg.id)
+					return m, m.queue(trashOp(m.currentMsg.account, m.currentMsg.id, m.currentMsg.subject, false))
 
 				case key.Matches(msg, keys.ToggleRead):
-					return m, toggleReadStatus(m.srv, m.currentMsg.id, m.currentMsg.isUnread)
+					return m, m.queue(readOp(m.currentMsg.account, m.currentMsg.id, m.currentMsg.subject, false, m.currentMsg.isUnread))
 
 				case key.Matches(msg, keys.Labels):
-					return m, loadLabels(m.srv)
+					return m, loadLabels(m.currentAccount().backend)
+
+				case key.Matches(msg, keys.Links):
+					return m, m.openLinks()
+
+				case key.Matches(msg, keys.ShowOriginal):
+					m.state = loading
+					return m, tea.Batch(m.loading.Tick, loadOriginal(m.backend(m.currentMsg.account), m.currentMsg))
 
 				case key.Matches(msg, keys.Quit):
 					return m, tea.Quit
@@ -899,19 +1431,25 @@ func updateComposing(msg tea.Msg, m model) (tea.Model, tea.Cmd) {
                 return m, m.focusComposeField()
             } else {
                 m.state = inbox
-                return m, nil
+                return m, m.saveDraft(false)
             }
 
+        case key.Matches(msg, keys.Editor) && !m.addingAttachment:
+            return m, m.editDraft()
+
+        case key.Matches(msg, keys.MarkdownMode) && !m.addingAttachment:
+            m.markdown = !m.markdown
+            return m, nil
+
+        case key.Matches(msg, keys.Preview) && !m.addingAttachment:
+            return m, m.openPreview()
+
         case key.Matches(msg, keys.Send):
-				return m, sendEmail(
-					m.srv,
-					m.composeTo.Value(),
-					m.composeCc.Value(),
-					m.composeBcc.Value(),
-					m.composeSubj.Value(),
-					m.composeBody.Value(),
-					m.composeAttachments,
-				)
+				out := m.composeOutgoing()
+				if _, err := m.senderAddress(out.account, m.composeFrom.Value()); err != nil {
+					return m, showStatus(severityError, err.Error())
+				}
+				return m, sendEmail(m.backend(out.account), out)
 
         case key.Matches(msg, keys.AddAttachment):
             if !m.addingAttachment {
@@ -925,11 +1463,18 @@ func updateComposing(msg tea.Msg, m model) (tea.Model, tea.Cmd) {
                 m.composeAttachments = m.composeAttachments[:len(m.composeAttachments)-1]
                 return m, showNotification("Removed last attachment")
             }
+            if !m.addingAttachment && len(m.composeKept) > 0 {
+                m.composeKept = m.composeKept[:len(m.composeKept)-1]
+                return m, showNotification("Removed last attachment")
+            }
 
         case msg.Type == tea.KeyEnter && m.addingAttachment:
             path := strings.TrimSpace(m.attachmentInput.Value())
             if path != "" {
                 if _, err := os.Stat(path); err == nil {
+                    if err := checkAttachmentSize(append(slices.Clone(m.composeAttachments), path), partsSize(m.composeKept)); err != nil {
+                        return m, showStatus(severityError, err.Error())
+                    }
                     m.composeAttachments = append(m.composeAttachments, path)
                     m.addingAttachment = false
                     m.attachmentInput.Reset()
@@ -1051,26 +1596,28 @@ func updateComposing(msg tea.Msg, m model) (tea.Model, tea.Cmd) {
 				switch {
 				case key.Matches(msg, keys.Back):
 					m.state = viewing
+					if m.thread != nil {
+						m.state = viewingThread
+					}
 					m.addingAttachment = false
 					return m, nil
 
+				case key.Matches(msg, keys.Editor) && !m.addingAttachment:
+					return m, m.editDraft()
+
+				case key.Matches(msg, keys.MarkdownMode) && !m.addingAttachment:
+					m.markdown = !m.markdown
+					return m, nil
+
+				case key.Matches(msg, keys.Preview) && !m.addingAttachment:
+					return m, m.openPreview()
+
 				case key.Matches(msg, keys.Send):
-					quoted := fmt.Sprintf(
-						"\n\n--- Original Message ---\nFrom: %s\nDate: %s\n\n%s",
-						m.replyToMsg.from,
-						m.replyToMsg.date,
-						indentText(m.currentMsg.body),
-					)
-					fullBody := m.replyBody.Value() + quoted
-					return m, sendEmail(
-						m.srv,
-						m.replyToMsg.from,
-						"",
-						"",
-						"Re: "+m.replyToMsg.subject,
-						fullBody,
-						m.replyAttachments,
-					)
+					out := m.reply
+					out.body = m.replyBody.Value()
+					out.markdown = m.markdown
+					out.attachments = m.replyAttachments
+					return m, sendEmail(m.backend(out.account), out)
 
 				case key.Matches(msg, keys.AddAttachment):
 					m.addingAttachment = true
@@ -1086,6 +1633,9 @@ func updateComposing(msg tea.Msg, m model) (tea.Model, tea.Cmd) {
 				case msg.Type == tea.KeyEnter && m.addingAttachment:
 					path := m.attachmentInput.Value()
 					if _, err := os.Stat(path); err == nil {
+						if err := checkAttachmentSize(append(slices.Clone(m.replyAttachments), path), 0); err != nil {
+							return m, showStatus(severityError, err.Error())
+						}
 						m.replyAttachments = append(m.replyAttachments, path)
 						m.addingAttachment = false
 						m.attachmentInput.Reset()
@@ -1125,7 +1675,7 @@ func updateComposing(msg tea.Msg, m model) (tea.Model, tea.Cmd) {
 					m.searchQuery = m.searchInput.Value()
 					return m, tea.Batch(
 						m.loading.Tick,
-						performSearch(m.srv, m.searchQuery),
+						performSearch(m.currentAccount(), m.searchQuery, m.pager.threads),
 					)
 				}
 			}
@@ -1147,7 +1697,7 @@ func updateComposing(msg tea.Msg, m model) (tea.Model, tea.Cmd) {
 						m.state = loading
 						return m, tea.Batch(
 							m.loading.Tick,
-							loadEmailsByLabel(m.srv, selected.label.Id),
+							loadEmailsByLabel(m.currentAccount(), selected.label.Id, m.pager.threads),
 						)
 					}
 					return m, nil
@@ -1159,204 +1709,55 @@ func updateComposing(msg tea.Msg, m model) (tea.Model, tea.Cmd) {
 			return m, cmd
 		}
 
-		func loadEmail(srv *gmail.Service, msgID string) tea.Cmd {
+		func loadEmail(b MailBackend, msgID string) tea.Cmd {
 			return func() tea.Msg {
-				content, err := fetchFullEmailBody(srv, msgID)
+				msg, err := b.GetMessage(msgID, "full")
 				if err != nil {
-					return emailLoadErrorMsg{err: err}
+					return emailLoadErrorMsg{err: fmt.Errorf("failed to fetch message: %w", err)}
 				}
-				return emailLoadedMsg{content: content}
+				return emailLoadedMsg{item: newEmailItem(msg)}
 			}
 		}
 
-		func fetchFullEmailBody(srv *gmail.Service, msgID string) (string, error) {
-			msg, err := srv.Users.Messages.Get("me", msgID).Format("full").Do()
-			if err != nil {
-				return "", fmt.Errorf("failed to fetch message: %w", err)
-			}
-
-			var from, subject, date string
-			for _, h := range msg.Payload.Headers {
-				switch h.Name {
-				case "From":
-					from = h.Value
-				case "Subject":
-					subject = h.Value
-				case "Date":
-					date = formatDate(h.Value)
-				}
-			}
-
-			body := extractPlainText(msg.Payload)
+		// formatEmailBody lays msg out for the reader, with an HTML body
+		// wrapped to width.
+		func formatEmailBody(msg *emailItem, width int) string {
+			body := msg.text(width)
 			if body == "" {
 				body = "(no text content found)"
 			}
 
 			return fmt.Sprintf("From: %s\nSubject: %s\nDate: %s\n\n%s", 
-				from, subject, date, body), nil
+				msg.from, msg.subject, msg.date, body)
 		}
 
-		func sendEmail(srv *gmail.Service, to, cc, bcc, subject, body string, attachments []string) tea.Cmd {
-    return func() tea.Msg {
-        // Create a temporary file to hold the entire message
-        tmpFile, err := os.CreateTemp("", "gmail-attachment-")
-        if err != nil {
-            return emailLoadErrorMsg{err: fmt.Errorf("failed to create temp file: %w", err)}
-        }
-        defer os.Remove(tmpFile.Name())
-        defer tmpFile.Close()
-
-        // Create a multipart writer
-        writer := multipart.NewWriter(tmpFile)
-        boundary := writer.Boundary()
-
-        // Write headers
-        headers := fmt.Sprintf("To: %s\r\n", to)
-        if cc != "" {
-            headers += fmt.Sprintf("Cc: %s\r\n", cc)
-        }
-        if bcc != "" {
-            headers += fmt.Sprintf("Bcc: %s\r\n", bcc)
-        }
-        headers += fmt.Sprintf("Subject: %s\r\n", subject)
-        headers += fmt.Sprintf("MIME-Version: 1.0\r\nContent-Type: multipart/mixed; boundary=%s\r\n\r\n", boundary)
-        
-        if _, err := tmpFile.WriteString(headers); err != nil {
-            return emailLoadErrorMsg{err: fmt.Errorf("failed to write headers: %w", err)}
-        }
-
-        // Write text part
-        textPart := fmt.Sprintf("--%s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s\r\n", boundary, body)
-        if _, err := tmpFile.WriteString(textPart); err != nil {
-            return emailLoadErrorMsg{err: fmt.Errorf("failed to write text part: %w", err)}
-        }
-
-        // Process attachments
-        for _, filePath := range attachments {
-            file, err := os.Open(filePath)
-            if err != nil {
-                return emailLoadErrorMsg{err: fmt.Errorf("failed to open attachment: %w", err)}
-            }
-            defer file.Close()
-
-            fileInfo, err := file.Stat()
-            if err != nil {
-                return emailLoadErrorMsg{err: fmt.Errorf("failed to get file info: %w", err)}
-            }
-
-            // Size check (25MB Gmail limit)
-            const maxAttachmentSize = 25 * 1024 * 1024
-            if fileInfo.Size() > maxAttachmentSize {
-                return emailLoadErrorMsg{err: fmt.Errorf("attachment too large: %s (max %dMB)", 
-                    filepath.Base(filePath), maxAttachmentSize/1024/1024)}
-            }
-
-            // Create part header
-            partHeader := textproto.MIMEHeader{}
-            mimeType := mime.TypeByExtension(filepath.Ext(filePath))
-            if mimeType == "" {
-                mimeType = "application/octet-stream"
-            }
-            partHeader.Set("Content-Type", mimeType)
-            partHeader.Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filepath.Base(filePath)))
-            partHeader.Set("Content-Transfer-Encoding", "base64")
-
-            partWriter, err := writer.CreatePart(partHeader)
-            if err != nil {
-                return emailLoadErrorMsg{err: fmt.Errorf("failed to create attachment part: %w", err)}
-            }
-
-            // Create a base64 encoder that writes to the part
-            encoder := base64.NewEncoder(base64.StdEncoding, partWriter)
-
-            // Copy the file in chunks
-            if _, err := io.Copy(encoder, file); err != nil {
-                return emailLoadErrorMsg{err: fmt.Errorf("failed to write attachment: %w", err)}
-            }
-
-            if err := encoder.Close(); err != nil {
-                return emailLoadErrorMsg{err: fmt.Errorf("failed to close encoder: %w", err)}
-            }
-        }
-
-        // Write final boundary
-        if _, err := tmpFile.WriteString(fmt.Sprintf("\r\n--%s--\r\n", boundary)); err != nil {
-            return emailLoadErrorMsg{err: fmt.Errorf("failed to write final boundary: %w", err)}
-        }
-
-        // Close the writer
-        if err := writer.Close(); err != nil {
-            return emailLoadErrorMsg{err: fmt.Errorf("failed to close writer: %w", err)}
-        }
-
-        // Read the entire temp file back for sending
-        if _, err := tmpFile.Seek(0, 0); err != nil {
-            return emailLoadErrorMsg{err: fmt.Errorf("failed to seek temp file: %w", err)}
-        }
-
-        content, err := io.ReadAll(tmpFile)
-        if err != nil {
-            return emailLoadErrorMsg{err: fmt.Errorf("failed to read temp file: %w", err)}
-        }
-
-        raw := base64.URLEncoding.EncodeToString(content)
-        _, err = srv.Users.Messages.Send("me", &gmail.Message{Raw: raw}).Do()
-        if err != nil {
-            return emailLoadErrorMsg{err: err}
-        }
-        return emailSentMsg{}
-    }
-}
-
-
-		func deleteEmail(srv *gmail.Service, msgId string) tea.Cmd {
+		// sendEmail builds out and hands it to the outbox. Forwarded parts
+		// are fetched from b.
+		func sendEmail(b MailBackend, out outgoing) tea.Cmd {
 			return func() tea.Msg {
-				_, err := srv.Users.Messages.Trash("me", msgId).Do()
+				content, err := buildMessage(b, out)
 				if err != nil {
 					return emailLoadErrorMsg{err: err}
 				}
-				return notificationMsg{message: "Email moved to trash"}
+				op := sendOp(out.account, content, out.threadID, out.to, out.subject)
+				// A saved draft is sent as such, which also removes it.
+				op.Target = out.draft.finish()
+				return emailSentMsg{op: op}
 			}
 		}
 
-		func toggleReadStatus(srv *gmail.Service, msgId string, isUnread bool) tea.Cmd {
-			return func() tea.Msg {
-				mod := gmail.ModifyMessageRequest{}
-				if isUnread {
-					mod.RemoveLabelIds = []string{"UNREAD"}
-				} else {
-					mod.AddLabelIds = []string{"UNREAD"}
-				}
-
-				_, err := srv.Users.Messages.Modify("me", msgId, &mod).Do()
-				if err != nil {
-					return emailLoadErrorMsg{err: err}
-				}
-				action := "marked as read"
-				if isUnread {
-					action = "marked as unread"
-				}
-				return notificationMsg{message: "Email " + action}
-			}
-		}
 
-		func performSearch(srv *gmail.Service, query string) tea.Cmd {
-			return func() tea.Msg {
-				msgs, err := srv.Users.Messages.List("me").Q(query).MaxResults(30).Do()
-				if err != nil {
-					return emailLoadErrorMsg{err: err}
-				}
-				return searchResultMsg{messages: msgs.Messages}
-			}
+		func performSearch(acct *account, query string, threads bool) tea.Cmd {
+			return loadFirstPage(acct.backend, listPager{account: acct.name, query: query, threads: threads})
 		}
 
-		func loadLabels(srv *gmail.Service) tea.Cmd {
+		func loadLabels(b MailBackend) tea.Cmd {
 			return func() tea.Msg {
-				labels, err := srv.Users.Labels.List("me").Do()
+				labels, err := b.ListLabels()
 				if err != nil {
 					return emailLoadErrorMsg{err: err}
 				}
-				return labelsLoadedMsg{labels: labels.Labels}
+				return labelsLoadedMsg{labels: labels}
 			}
 		}
 
@@ -1377,35 +1778,56 @@ func updateComposing(msg tea.Msg, m model) (tea.Model, tea.Cmd) {
 			return dateStr
 		}
 
+		// extractPlainText returns the text of a message, rendering an HTML
+		// body when there is no plain one.
 		func extractPlainText(payload *gmail.MessagePart) string {
+			body, isHTML := messageBody(payload)
+			if isHTML {
+				return renderHTML(body, 0)
+			}
+			return body
+		}
+
+		// messageBody finds the body to show: plain text if the message has
+		// it, HTML otherwise.
+		func messageBody(payload *gmail.MessagePart) (body string, isHTML bool) {
 			if payload.MimeType == "text/plain" && payload.Body != nil && payload.Body.Data != "" {
-				return decodeBody(payload.Body.Data)
+				return partText(payload), false
 			}
 
 			if strings.HasPrefix(payload.MimeType, "multipart/") && len(payload.Parts) > 0 {
 				for _, p := range payload.Parts {
-					if p.MimeType == "text/plain" {
-						if text := extractPlainText(p); text != "" {
-							return text
+					if p.MimeType == "text/plain" && p.Filename == "" {
+						if body, isHTML := messageBody(p); body != "" {
+							return body, isHTML
 						}
 					}
 				}
 
 				for _, p := range payload.Parts {
-					if p.MimeType == "text/html" {
-						if text := extractPlainText(p); text != "" {
-							return text
+					if p.MimeType == "text/html" && p.Filename == "" {
+						if body, isHTML := messageBody(p); body != "" {
+							return body, isHTML
+						}
+					}
+				}
+
+				// The text of a message with attachments can sit in a
+				// nested multipart/alternative or multipart/related.
+				for _, p := range payload.Parts {
+					if strings.HasPrefix(p.MimeType, "multipart/") {
+						if body, isHTML := messageBody(p); body != "" {
+							return body, isHTML
 						}
 					}
 				}
 			}
 
 			if payload.MimeType == "text/html" && payload.Body != nil && payload.Body.Data != "" {
-				htmlContent := decodeBody(payload.Body.Data)
-				return stripHTML(htmlContent)
+				return partText(payload), true
 			}
 
-			return ""
+			return "", false
 		}
 
 		func decodeBody(body string) string {
@@ -1423,36 +1845,25 @@ func updateComposing(msg tea.Msg, m model) (tea.Model, tea.Cmd) {
 			return string(decoded)
 		}
 
-		func stripHTML(input string) string {
-			re := regexp.MustCompile(`<[^>]*>`)
-			input = re.ReplaceAllString(input, "")
-
-			entities := map[string]string{
-				"&nbsp;": " ", "&lt;": "<", "&gt;": ">", 
-				"&amp;": "&", "&quot;": "\"", "&apos;": "'",
-			}
-
-			for k, v := range entities {
-				input = strings.ReplaceAll(input, k, v)
-			}
-
-			input = regexp.MustCompile(`\s+`).ReplaceAllString(input, " ")
-			return strings.TrimSpace(input)
-		}
-
 		type notificationMsg struct {
 			message string
+			level   severity
 		}
 
 		func showNotification(msg string) tea.Cmd {
-			return func() tea.Msg {
-				return notificationMsg{message: msg}
-			}
+			return showStatus(severityInfo, msg)
 		}
 
 		type (
-			emailLoadedMsg struct{ content string }
-			emailSentMsg   struct{}
+			emailLoadedMsg struct {
+				item *emailItem
+			}
+			emailSentMsg   struct{ op *outboxOp }
 			labelsLoadedMsg struct{ labels []*gmail.Label }
-			searchResultMsg struct{ messages []*gmail.Message }
+			searchResultMsg struct {
+				account string
+				ids     []string
+				pager   listPager
+				refresh bool // a background resync; leave the current screen alone
+			}
 		)
\ No newline at end of file
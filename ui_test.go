@@ -0,0 +1,286 @@
+package main
+
+import (
+	"fmt"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/charmbracelet/bubbles/spinner"
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/x/ansi"
+)
+
+// newTestModel starts the TUI on mb's inbox, sized and with its first page
+// of rows loaded.
+func newTestModel(t *testing.T, mb *memoryBackend) tea.Model {
+	t.Helper()
+	return newTestAccountModel(t, &account{name: "test", backend: mb})
+}
+
+func newTestAccountModel(t *testing.T, acct *account) tea.Model {
+	t.Helper()
+	first, err := acct.backend.ListMessages(inboxQuery, nil, "", pageSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	labels, _ := acct.backend.ListLabels()
+	var m tea.Model = initialModel(appPaths{DownloadDir: t.TempDir()}, []*account{acct}, 0, first, labels, nil)
+	m, _ = m.Update(tea.WindowSizeMsg{Width: 100, Height: 40})
+	if rows := m.(model).rows; rows != nil {
+		m = drive(t, m, rows.next())
+	}
+	return m
+}
+
+// drive runs cmd and every command its messages lead to, feeding the
+// messages back into m as the program would. Commands that don't finish
+// promptly are timers (polling, toast expiry) and are dropped, as are
+// spinner frames.
+func drive(t *testing.T, m tea.Model, cmd tea.Cmd) tea.Model {
+	t.Helper()
+	queue := []tea.Cmd{cmd}
+	for len(queue) > 0 {
+		c := queue[0]
+		queue = queue[1:]
+		if c == nil {
+			continue
+		}
+		ch := make(chan tea.Msg, 1)
+		go func() { ch <- c() }()
+		var msg tea.Msg
+		select {
+		case msg = <-ch:
+		case <-time.After(200 * time.Millisecond):
+			continue
+		}
+		switch msg := msg.(type) {
+		case nil, spinner.TickMsg:
+			continue
+		case tea.BatchMsg:
+			queue = append(queue, msg...)
+			continue
+		}
+		var next tea.Cmd
+		m, next = m.Update(msg)
+		queue = append(queue, next)
+	}
+	return m
+}
+
+// press sends a key to m, then drives what it started.
+func press(t *testing.T, m tea.Model, k string) tea.Model {
+	t.Helper()
+	msg := tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune(k)}
+	switch k {
+	case "enter":
+		msg = tea.KeyMsg{Type: tea.KeyEnter}
+	case "down":
+		msg = tea.KeyMsg{Type: tea.KeyDown}
+	case "esc":
+		msg = tea.KeyMsg{Type: tea.KeyEsc}
+	}
+	m, cmd := m.Update(msg)
+	return drive(t, m, cmd)
+}
+
+func listTitles(m tea.Model) []string {
+	var titles []string
+	for _, it := range m.(model).list.Items() {
+		titles = append(titles, it.(emailItem).subject)
+	}
+	return titles
+}
+
+func TestReadMessage(t *testing.T) {
+	mb := newMemoryBackend()
+	mb.AddRaw([]byte("From: Ann <ann@example.com>\r\nSubject: Lunch\r\n\r\nNoon at the usual place?\r\n"), "INBOX", "UNREAD")
+
+	m := newTestModel(t, mb)
+	if got := listTitles(m); len(got) != 1 || got[0] != "Lunch" {
+		t.Fatalf("inbox shows %q", got)
+	}
+	m = press(t, m, "enter")
+	if m.(model).state != viewing {
+		t.Fatalf("state is %v after opening a message", m.(model).state)
+	}
+	if view := m.View(); !strings.Contains(view, "Noon at the usual place?") {
+		t.Errorf("message view doesn't show the body:\n%s", view)
+	}
+
+	m = press(t, m, "m")
+	msg, _ := mb.GetMessage(m.(model).currentMsg.id, "minimal")
+	if containsFold(msg.LabelIds, "UNREAD") {
+		t.Error("[m] left the message unread")
+	}
+}
+
+func TestTrashMessage(t *testing.T) {
+	mb := newMemoryBackend()
+	for _, subject := range []string{"Keep", "Spam"} {
+		mb.AddRaw([]byte(fmt.Sprintf("From: a@example.com\r\nSubject: %s\r\n\r\nbody\r\n", subject)), "INBOX")
+	}
+
+	m := newTestModel(t, mb)
+	titles := listTitles(m)
+	if len(titles) != 2 {
+		t.Fatalf("inbox shows %q", titles)
+	}
+	if titles[0] != "Spam" {
+		m = press(t, m, "down")
+	}
+	m = press(t, m, "d")
+	if got := listTitles(m); len(got) != 1 || got[0] != "Keep" {
+		t.Errorf("inbox shows %q after trashing", got)
+	}
+
+	// The trashed message is listed under the TRASH label.
+	trash, err := mb.ListMessages("", []string{"TRASH"}, "", pageSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trash.Messages) != 1 {
+		t.Fatalf("TRASH lists %d messages, want 1", len(trash.Messages))
+	}
+	msg, _ := mb.GetMessage(trash.Messages[0].Id, "metadata", "Subject")
+	if headerValue(msg.Payload.Headers, "Subject") != "Spam" {
+		t.Errorf("TRASH lists %q", headerValue(msg.Payload.Headers, "Subject"))
+	}
+}
+
+func TestComposeFrom(t *testing.T) {
+	mb := newMemoryBackend()
+	acct := &account{name: "test", backend: mb, cfg: accountConfig{Addresses: []string{"me@example.org", "alias@example.org"}}}
+	m := newTestAccountModel(t, acct)
+
+	m = press(t, m, "c")
+	mm := m.(model)
+	if got := mm.composeFrom.Value(); got != "me@example.org" {
+		t.Errorf("From starts as %q, want the account's address", got)
+	}
+
+	// Someone else's address is refused.
+	mm.composeFrom.SetValue("ceo@example.com")
+	mm.composeTo.SetValue("bob@example.org")
+	mm.composeSubj.SetValue("Hi")
+	m, cmd := mm.Update(tea.KeyMsg{Type: tea.KeyCtrlS})
+	m = drive(t, m, cmd)
+	if toast := m.(model).toast; toast == nil || !strings.Contains(toast.text, "ceo@example.com is not an address of test") {
+		t.Errorf("toast %+v, want the From address refused", toast)
+	}
+	if sent, _ := mb.ListMessages("in:sent", nil, "", pageSize); len(sent.Messages) != 0 {
+		t.Fatal("sent from an address that isn't the account's")
+	}
+
+	// Another of the account's own addresses is used as typed.
+	mm = m.(model)
+	mm.composeFrom.SetValue("Me <alias@example.org>")
+	m, cmd = mm.Update(tea.KeyMsg{Type: tea.KeyCtrlS})
+	drive(t, m, cmd)
+	sent, _ := mb.ListMessages("in:sent", nil, "", pageSize)
+	if len(sent.Messages) != 1 {
+		t.Fatalf("sent %d messages, want 1", len(sent.Messages))
+	}
+	msg, _ := mb.GetMessage(sent.Messages[0].Id, "metadata", "From")
+	if from, err := mail.ParseAddress(headerValue(msg.Payload.Headers, "From")); err != nil || from.Name != "Me" || from.Address != "alias@example.org" {
+		t.Errorf("sent From: %q", headerValue(msg.Payload.Headers, "From"))
+	}
+}
+
+func TestEditedDraftKeepsLongAddressLists(t *testing.T) {
+	var rcpts []string
+	for i := 0; i < 20; i++ {
+		rcpts = append(rcpts, fmt.Sprintf("person%d@example.org", i))
+	}
+	to := strings.Join(rcpts, ", ")
+
+	m := newTestModel(t, newMemoryBackend())
+	m = press(t, m, "c")
+	m = drive(t, m, func() tea.Msg {
+		return editorFinishedMsg{fields: draftFields{to: to, cc: to, bcc: to, subject: "All hands"}}
+	})
+	mm := m.(model)
+	for name, field := range map[string]string{"To": mm.composeTo.Value(), "Cc": mm.composeCc.Value(), "Bcc": mm.composeBcc.Value()} {
+		if field != to {
+			t.Errorf("%s holds %d of %d characters", name, len(field), len(to))
+		}
+	}
+}
+
+func TestDraftAutosaveDuringPreview(t *testing.T) {
+	mb := newMemoryBackend()
+	m := newTestModel(t, mb)
+
+	m = press(t, m, "c")
+	mm := m.(model)
+	mm.composeSubj.SetValue("Plans")
+	mm.composeBody.SetValue("- lunch\n- walk\n")
+	m, _ = mm.Update(tea.KeyMsg{Type: tea.KeyCtrlT})
+	m, _ = m.Update(tea.KeyMsg{Type: tea.KeyCtrlR})
+	if m.(model).state != previewing {
+		t.Fatalf("state %v, want the preview", m.(model).state)
+	}
+
+	session := m.(model).draft
+	m, cmd := m.Update(draftTickMsg{session: session})
+	drive(t, m, cmd)
+	if drafts, _ := mb.ListDrafts(); len(drafts) != 1 {
+		t.Errorf("%d drafts saved from the preview, want 1", len(drafts))
+	}
+
+	// Away from the compose screen the tick keeps going without saving.
+	m = press(t, m, "esc")
+	m = press(t, m, "esc")
+	if m.(model).state == composing || m.(model).state == previewing {
+		t.Fatalf("state %v, want the compose screen left", m.(model).state)
+	}
+	mm = m.(model)
+	mm.composeSubj.SetValue("Changed")
+	if _, cmd := mm.Update(draftTickMsg{session: session}); cmd == nil {
+		t.Error("autosave stopped for good after leaving the compose screen")
+	}
+}
+
+func TestForwardFromOtherAccount(t *testing.T) {
+	home := &account{name: "home", backend: newMemoryBackend(), cfg: accountConfig{Addresses: []string{"me@home.example"}}}
+	work := &account{name: "work", backend: newMemoryBackend(), cfg: accountConfig{Addresses: []string{"me@work.example"}}}
+	first, _ := home.backend.ListMessages(inboxQuery, nil, "", pageSize)
+	var m tea.Model = initialModel(appPaths{}, []*account{home, work}, 0, first, nil, nil)
+	m, _ = m.Update(tea.WindowSizeMsg{Width: 100, Height: 40})
+
+	// As from the unified inbox, with home the current account.
+	mm := m.(model)
+	mm.startForward(&emailItem{account: "work", subject: "Budget", from: "cfo@work.example"}, false)
+	if got := mm.composeFrom.Value(); got != "me@work.example" {
+		t.Errorf("From is %q, want the address of the account the message is in", got)
+	}
+	if from, err := mm.senderAddress(mm.draft.account, mm.composeFrom.Value()); err != nil || from != "me@work.example" {
+		t.Errorf("senderAddress = %q, %v", from, err)
+	}
+}
+
+func TestCopyLinkLeavesNoLine(t *testing.T) {
+	mb := newMemoryBackend()
+	mb.AddRaw([]byte("From: Ann <ann@example.com>\r\nSubject: Slides\r\n\r\nSee https://example.com/slides\r\n"), "INBOX")
+
+	m := newTestModel(t, mb)
+	m = press(t, m, "enter")
+	m = press(t, m, "U")
+	if m.(model).state != pickingLink {
+		t.Fatalf("state is %v after [U]", m.(model).state)
+	}
+	m, cmd := m.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune("y")})
+	seq := ansi.SetSystemClipboard("https://example.com/slides")
+	if view := m.View(); !strings.HasPrefix(view, seq) {
+		t.Errorf("view doesn't start with the clipboard sequence:\n%q", view)
+	}
+	m = drive(t, m, cmd)
+	view := m.View()
+	if strings.Contains(view, seq) {
+		t.Error("the clipboard sequence is still in the view")
+	}
+	if !strings.Contains(view, "Copied https://example.com/slides") {
+		t.Errorf("no notification for the copy:\n%s", view)
+	}
+}